@@ -8,26 +8,36 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"time"
 
+	"github.com/cloudflare/circl/oprf"
 	"github.com/cloudflare/migp-go/pkg/migp"
 )
 
 func main() {
-	var targetURL, configFile, inputFilename string
-	var dumpConfig, showPassword bool
+	var targetURL, configFile, inputFilename, publicKey string
+	var dumpConfig, showPassword, allMatches bool
+	var batchSize, retries int
+	var timeout time.Duration
 	var err error
 
 	flag.StringVar(&configFile, "config", "", "Client configuration file (default: retrieve from server)")
 	flag.BoolVar(&dumpConfig, "dump-config", false, "Dump the client configuration to stdout and exit")
 	flag.BoolVar(&showPassword, "show-password", false, "Show the password in the output")
+	flag.BoolVar(&allMatches, "all-matches", false, "Report every matching bucket entry rather than only the first (not supported with -batch-size)")
 	flag.StringVar(&inputFilename, "infile", "-", "input file of credentials to query in the format <username>:<password> ('-' for stdin)")
 	flag.StringVar(&targetURL, "target", "http://localhost:8080", "target MIGP server")
+	flag.StringVar(&publicKey, "public-key", "", "base64-encoded server public key to pin (requires the verifiable OPRF mode)")
+	flag.IntVar(&batchSize, "batch-size", 1, "number of credentials to send per request (values above 1 use the batch endpoint)")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "timeout for each query, including retries")
+	flag.IntVar(&retries, "retries", 2, "number of times to retry a query after a network or server error")
 
 	flag.Parse()
 
@@ -44,17 +54,26 @@ func main() {
 		}
 	} else {
 		// retrieve the config from the server
-		resp, err := http.Get(targetURL + "/config")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		cfg, err = migp.FetchConfig(ctx, nil, targetURL)
+		cancel()
+		if err != nil {
+			log.Fatalf("Unable to retrieve MIGP config from target %q: %v", targetURL, err)
+		}
+	}
+
+	if publicKey != "" {
+		pinnedKey, err := base64.StdEncoding.DecodeString(publicKey)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if resp.StatusCode != http.StatusOK {
-			log.Fatalf("Unable to retrieve MIGP config from target %q: status code %d", targetURL, resp.StatusCode)
+		if cfg.OPRFMode != oprf.VerifiableMode {
+			log.Fatalf("A public key was pinned but the MIGP config does not use the verifiable OPRF mode")
 		}
-		decoder := json.NewDecoder(resp.Body)
-		if err := decoder.Decode(&cfg); err != nil {
-			log.Fatal(err)
+		if cfg.PublicKey != nil && !bytes.Equal(cfg.PublicKey, pinnedKey) {
+			log.Fatalf("The public key in the MIGP config does not match the pinned public key")
 		}
+		cfg.PublicKey = pinnedKey
 	}
 
 	if dumpConfig {
@@ -81,6 +100,32 @@ func main() {
 		defer inputFile.Close()
 	}
 
+	client, err := migp.NewQueryClient(cfg, migp.QueryClientConfig{
+		BaseURL:    targetURL,
+		MaxRetries: retries,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var batch []migp.Credential
+	flushBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		results, err := client.QueryBatch(ctx, batch)
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for i, result := range results {
+			printResult(batch[i].Username, batch[i].Password, result.Status, result.Metadata, nil, showPassword)
+		}
+		batch = batch[:0]
+	}
+
 	scanner := bufio.NewScanner(inputFile)
 	for scanner.Scan() {
 		fields := bytes.SplitN(scanner.Bytes(), []byte(":"), 2)
@@ -88,30 +133,90 @@ func main() {
 			continue
 		}
 		username, password := fields[0], fields[1]
-		if status, metadata, err := migp.Query(cfg, targetURL+"/evaluate", username, password); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		} else {
-
-			if !showPassword {
-				password = nil
-			}
-			out, err := json.Marshal(struct {
-				Username string `json:"username"`
-				Password string `json:"password,omitempty"`
-				Status   string `json:"status"`
-				Metadata string `json:"metadata,omitempty"`
-			}{
-				Username: string(username),
-				Password: string(password),
-				Status:   status.String(),
-				Metadata: string(metadata),
+		if batchSize > 1 {
+			batch = append(batch, migp.Credential{
+				Username: append([]byte{}, username...),
+				Password: append([]byte{}, password...),
 			})
+			if len(batch) >= batchSize {
+				flushBatch()
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if allMatches {
+			status, matches, err := client.QueryAll(ctx, username, password)
+			cancel()
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
-			fmt.Println(string(out))
+			printResult(username, password, status, nil, matches, showPassword)
+			continue
+		}
+		status, metadata, err := client.Query(ctx, username, password)
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		printResult(username, password, status, metadata, nil, showPassword)
+	}
+	flushBatch()
+}
+
+// match is the JSON representation of a matching bucket entry
+type match struct {
+	Type     string               `json:"type"`
+	Metadata string               `json:"metadata,omitempty"`
+	Breach   *migp.BreachMetadata `json:"breach,omitempty"`
+}
+
+// decodeMetadata splits bucket entry metadata into legacy opaque metadata,
+// which is printed as a string, and structured breach metadata
+func decodeMetadata(data []byte) (string, *migp.BreachMetadata) {
+	breach, err := migp.DecodeMetadata(data)
+	if err != nil {
+		log.Printf("WARN: unable to decode metadata: %v", err)
+		return "", nil
+	}
+	raw := string(breach.Raw)
+	breach.Raw = nil
+	if breach.Name == "" && breach.Date == "" && len(breach.DataClasses) == 0 && breach.SourceURL == "" && breach.Variation == "" {
+		return raw, nil
+	}
+	return raw, &breach
+}
+
+// printResult writes the result of a query to stdout as a JSON object
+func printResult(username, password []byte, status migp.BreachStatus, metadata []byte, matches []migp.BucketMatch, showPassword bool) {
+	if !showPassword {
+		password = nil
+	}
+	var outMatches []match
+	for _, m := range matches {
+		raw, breach := decodeMetadata(m.Metadata)
+		outMatches = append(outMatches, match{Type: m.Flag.String(), Metadata: raw, Breach: breach})
+	}
+	raw, breach := decodeMetadata(metadata)
+	out, err := json.Marshal(struct {
+		Username string               `json:"username"`
+		Password string               `json:"password,omitempty"`
+		Status   string               `json:"status"`
+		Metadata string               `json:"metadata,omitempty"`
+		Breach   *migp.BreachMetadata `json:"breach,omitempty"`
+		Matches  []match              `json:"matches,omitempty"`
+	}{
+		Username: string(username),
+		Password: string(password),
+		Status:   status.String(),
+		Metadata: raw,
+		Breach:   breach,
+		Matches:  outMatches,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	fmt.Println(string(out))
 }
@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// mutatoreval measures how many users' new passwords a mutator anticipates
+// from their breached passwords, at each number of variants, to choose the
+// -num-variants setting of the MIGP server.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cloudflare/migp-go/pkg/mutator"
+)
+
+func main() {
+	var inputFilename, budgetList string
+	var jsonOutput bool
+	var cfg mutator.Config
+
+	flag.StringVar(&inputFilename, "infile", "-", "input file of held-out password pairs in the format <breached password>\\t<new password> ('-' for stdin)")
+	flag.StringVar(&budgetList, "budgets", "1,2,3,5,9,20,50,100", "comma-separated numbers of variants to report the hit rate for")
+	flag.BoolVar(&jsonOutput, "json", false, "write the report as JSON")
+	flag.StringVar(&cfg.RulesFile, "rules", "", "file of the mangling rules generating the password variants (default: built-in RDas rules)")
+	flag.StringVar(&cfg.RulesFormat, "rules-format", mutator.RulesFormatRDas, "format of the rules file: rdas (JSON list of RDas rules) or hashcat (hashcat rule file)")
+	flag.BoolVar(&cfg.ByteCompatible, "byte-rules", false, "apply RDas rules to bytes rather than characters")
+	flag.BoolVar(&cfg.RulePairs, "rule-pairs", false, "also generate password variants combining two rules")
+	flag.StringVar(&cfg.PolicyFile, "policy", "", "JSON file of the password policy that variants must comply with")
+
+	flag.Parse()
+
+	var budgets []int
+	for _, s := range strings.Split(budgetList, ",") {
+		budget, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || budget <= 0 {
+			log.Fatalf("Invalid budget %q", s)
+		}
+		budgets = append(budgets, budget)
+	}
+	sort.Ints(budgets)
+
+	m, err := mutator.NewMutatorFromConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	evaluation, err := mutator.NewEvaluation(m, budgets[len(budgets)-1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var inputFile io.Reader = os.Stdin
+	if inputFilename != "-" {
+		file, err := os.Open(inputFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		inputFile = file
+	}
+	skipped, err := mutator.ReadPairs(inputFile, func(oldPassword, newPassword []byte) error {
+		evaluation.Add(oldPassword, newPassword)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if skipped > 0 {
+		log.Printf("WARN: skipped %d lines without a tab", skipped)
+	}
+
+	report := evaluation.Report(budgets)
+	if jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printReport(report)
+}
+
+// printReport writes the report to stdout as a table with a column per rule
+// type
+func printReport(report mutator.EvaluationReport) {
+	fmt.Printf("%d changed passwords, %d unchanged passwords\n\n", report.Pairs, report.Unchanged)
+
+	ruleTypes := make(map[string]bool)
+	for _, result := range report.Budgets {
+		for ruleType := range result.RuleTypes {
+			ruleTypes[ruleType] = true
+		}
+	}
+	var columns []string
+	for ruleType := range ruleTypes {
+		columns = append(columns, ruleType)
+	}
+	sort.Strings(columns)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "budget\thits\thit rate\t")
+	for _, ruleType := range columns {
+		fmt.Fprintf(w, "%s\t", ruleType)
+	}
+	fmt.Fprintln(w)
+	for _, result := range report.Budgets {
+		fmt.Fprintf(w, "%d\t%d\t%.2f%%\t", result.Budget, result.Hits, 100*result.HitRate)
+		for _, ruleType := range columns {
+			fmt.Fprintf(w, "%d\t", result.RuleTypes[ruleType])
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
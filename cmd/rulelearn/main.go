@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// rulelearn learns RDas mangling rules from a corpus of password pairs, and
+// writes them ranked by frequency as a rules file for the MIGP server.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/cloudflare/migp-go/pkg/mutator"
+)
+
+func main() {
+	var inputFilename, outputFilename string
+	var minCount, maxRules int
+
+	flag.StringVar(&inputFilename, "infile", "-", "input file of password pairs in the format <old password>\\t<new password> ('-' for stdin)")
+	flag.StringVar(&outputFilename, "out", "-", "output file of the learned rules, as a JSON list of RDas rules ('-' for stdout)")
+	flag.IntVar(&minCount, "min-count", 2, "minimum number of pairs that a rule must explain")
+	flag.IntVar(&maxRules, "max-rules", 0, "maximum number of rules to write (0 for all)")
+
+	flag.Parse()
+
+	var inputFile io.Reader = os.Stdin
+	if inputFilename != "-" {
+		file, err := os.Open(inputFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		inputFile = file
+	}
+
+	learner := mutator.NewRuleLearner()
+	skipped, err := mutator.ReadPairs(inputFile, func(oldPassword, newPassword []byte) error {
+		learner.Add(oldPassword, newPassword)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	pairs, explained := learner.Pairs()
+	if skipped > 0 {
+		log.Printf("WARN: skipped %d lines without a tab", skipped)
+	}
+
+	rules := learner.Rules(minCount)
+	if maxRules > 0 && len(rules) > maxRules {
+		rules = rules[:maxRules]
+	}
+	if len(rules) == 0 {
+		log.Fatalf("No rule explains at least %d of %d pairs", minCount, pairs)
+	}
+	log.Printf("Learned %d rules explaining %d of %d pairs", len(rules), explained, pairs)
+
+	data, err := json.MarshalIndent(rules, "", "    ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+	if outputFilename == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(outputFilename, data, 0644)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
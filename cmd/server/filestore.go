@@ -0,0 +1,380 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Record operations in the log of a fileStore
+const (
+	opPut      byte = 1
+	opAppend   byte = 2
+	opFinalize byte = 3
+)
+
+// recordHeaderSize is the size of the fixed record header: the operation, the
+// 2-byte ID length, and the 4-byte value length
+const recordHeaderSize = 7
+
+// fileStore is a durable bucket store backed by an append-only log file. Each
+// record has the following format:
+// <1-byte op>|<2-byte ID length>|<4-byte value length>|<ID>|<value>|<4-byte CRC-32>
+// where the CRC covers the rest of the record. Only the location of each value
+// is kept in memory, so reopening a store only requires a sequential scan of
+// the log. Records are not synced to disk individually; after a crash the log
+// is truncated to its last complete record, so the store reflects a prefix of
+// the operations. SetFinalized, Rebuild and Close sync the log.
+// Implements migp.Getter
+type fileStore struct {
+	path      string
+	file      *os.File
+	size      int64
+	index     map[string][]segment
+	finalized bool
+	lock      sync.RWMutex
+
+	// readOnly stores reject writes
+	readOnly bool
+}
+
+// errReadOnly is returned when writing to a read-only store
+var errReadOnly = errors.New("read-only bucket store")
+
+// segment locates part of a value in the log
+type segment struct {
+	offset int64
+	length int
+}
+
+// openFileStore opens the store at path, creating it if needed, and replays
+// its log. A corrupt or incomplete trailing record, e.g., from a crash during
+// a write, is discarded.
+func openFileStore(path string) (*fileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fs := &fileStore{
+		path:  path,
+		file:  file,
+		index: make(map[string][]segment),
+	}
+	if err := fs.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// openFileStoreReadOnly opens the existing store at path without modifying
+// it. A corrupt or incomplete trailing record is ignored rather than
+// discarded.
+func openFileStoreReadOnly(path string) (*fileStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fs := &fileStore{
+		path:     path,
+		file:     file,
+		index:    make(map[string][]segment),
+		readOnly: true,
+	}
+	if err := fs.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// replay rebuilds the in-memory index from the log
+func (fs *fileStore) replay() error {
+	info, err := fs.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(fs.file, 1<<20)
+	header := make([]byte, recordHeaderSize)
+	checksum := make([]byte, 4)
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return fs.truncate(offset, err)
+		}
+		op := header[0]
+		idLength := int(binary.BigEndian.Uint16(header[1:3]))
+		valueLength := int(binary.BigEndian.Uint32(header[3:7]))
+		if offset+recordHeaderSize+int64(idLength+valueLength)+4 > info.Size() {
+			return fs.truncate(offset, io.ErrUnexpectedEOF)
+		}
+
+		body := make([]byte, idLength+valueLength)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return fs.truncate(offset, err)
+		}
+		if _, err := io.ReadFull(reader, checksum); err != nil {
+			return fs.truncate(offset, err)
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(header)
+		crc.Write(body)
+		if crc.Sum32() != binary.BigEndian.Uint32(checksum) {
+			return fs.truncate(offset, errors.New("checksum mismatch"))
+		}
+
+		id := string(body[:idLength])
+		valueSegment := segment{offset + recordHeaderSize + int64(idLength), valueLength}
+		switch op {
+		case opPut:
+			fs.index[id] = []segment{valueSegment}
+		case opAppend:
+			fs.index[id] = append(fs.index[id], valueSegment)
+		case opFinalize:
+			fs.finalized = true
+		default:
+			return fs.truncate(offset, fmt.Errorf("unknown operation %d", op))
+		}
+		offset += recordHeaderSize + int64(len(body)) + 4
+	}
+
+	fs.size = offset
+	return nil
+}
+
+// truncate discards the log from offset onwards, or only ignores it for
+// read-only stores
+func (fs *fileStore) truncate(offset int64, cause error) error {
+	if cause == io.EOF {
+		cause = io.ErrUnexpectedEOF
+	}
+	fs.size = offset
+	if fs.readOnly {
+		log.Printf("Ignoring %s from offset %d: %v", fs.path, offset, cause)
+		return nil
+	}
+	log.Printf("Truncating %s at offset %d: %v", fs.path, offset, cause)
+	return fs.file.Truncate(offset)
+}
+
+// write appends a record to the log and returns the location of its value.
+// The caller must hold the write lock.
+func (fs *fileStore) write(op byte, id string, value []byte) (segment, error) {
+	if fs.readOnly {
+		return segment{}, errReadOnly
+	}
+	if len(id) > 1<<16-1 || uint64(len(value)) > 1<<32-1 {
+		return segment{}, errors.New("record too long")
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(id)+len(value)+4)
+	record[0] = op
+	binary.BigEndian.PutUint16(record[1:3], uint16(len(id)))
+	binary.BigEndian.PutUint32(record[3:7], uint32(len(value)))
+	record = append(record, id...)
+	record = append(record, value...)
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(record))
+	record = append(record, checksum...)
+
+	if _, err := fs.file.WriteAt(record, fs.size); err != nil {
+		// Drop any partially written record.
+		_ = fs.file.Truncate(fs.size)
+		return segment{}, err
+	}
+	valueSegment := segment{fs.size + recordHeaderSize + int64(len(id)), len(value)}
+	fs.size += int64(len(record))
+	return valueSegment, nil
+}
+
+// Put a value at key id and replace any existing value.
+func (fs *fileStore) Put(id string, value []byte) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	valueSegment, err := fs.write(opPut, id, value)
+	if err != nil {
+		return err
+	}
+	fs.index[id] = []segment{valueSegment}
+	return nil
+}
+
+// Append a value to any existing value at key id.
+func (fs *fileStore) Append(id string, value []byte) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	valueSegment, err := fs.write(opAppend, id, value)
+	if err != nil {
+		return err
+	}
+	fs.index[id] = append(fs.index[id], valueSegment)
+	return nil
+}
+
+// Get returns the value in the key identified by id.
+func (fs *fileStore) Get(id string) ([]byte, error) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.get(id)
+}
+
+// get reads the value in the key identified by id. The caller must hold the
+// lock.
+func (fs *fileStore) get(id string) ([]byte, error) {
+	segments, ok := fs.index[id]
+	if !ok {
+		return nil, nil
+	}
+	length := 0
+	for _, s := range segments {
+		length += s.length
+	}
+	value := make([]byte, length)
+	position := 0
+	for _, s := range segments {
+		if _, err := fs.file.ReadAt(value[position:position+s.length], s.offset); err != nil {
+			return nil, err
+		}
+		position += s.length
+	}
+	return value, nil
+}
+
+// Keys returns the identifiers of all keys with a value.
+func (fs *fileStore) Keys() []string {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	keys := make([]string, 0, len(fs.index))
+	for id := range fs.index {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+// Finalized reports whether the buckets were finalized.
+func (fs *fileStore) Finalized() bool {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.finalized
+}
+
+// SetFinalized records that the buckets were finalized, and syncs the log
+// so that the finalized buckets survive a crash.
+func (fs *fileStore) SetFinalized() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, err := fs.write(opFinalize, "", nil); err != nil {
+		return err
+	}
+	if err := fs.file.Sync(); err != nil {
+		return err
+	}
+	fs.finalized = true
+	return nil
+}
+
+// Rebuild replaces all values with those put by build and records that the
+// buckets were finalized. The new log is written to a temporary file, synced,
+// and renamed over the old one, so a crash during the rebuild leaves the old
+// log intact, and processes that opened the old log keep reading it. The old
+// values are served until the rebuild completes.
+func (fs *fileStore) Rebuild(build func(put func(id string, value []byte) error) error) error {
+	if fs.readOnly {
+		return errReadOnly
+	}
+
+	tmpPath := fs.path + ".tmp"
+	rebuilt := &fileStore{path: tmpPath, index: make(map[string][]segment)}
+	var err error
+	if rebuilt.file, err = os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		return err
+	}
+	defer func() {
+		// Clean up after a failed rebuild.
+		if rebuilt.file != nil {
+			rebuilt.file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err := build(rebuilt.Put); err != nil {
+		return err
+	}
+	if err := rebuilt.SetFinalized(); err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := os.Rename(tmpPath, fs.path); err != nil {
+		return err
+	}
+	// The open file handle now refers to the rebuilt log.
+	fs.file.Close()
+	fs.file, rebuilt.file = rebuilt.file, nil
+	fs.index = rebuilt.index
+	fs.size = rebuilt.size
+	fs.finalized = true
+	return nil
+}
+
+// Checkpoint syncs the log and returns its size, which Rollback can restore.
+// Implements ingest.CheckpointStore
+func (fs *fileStore) Checkpoint() (int64, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.readOnly {
+		return 0, errReadOnly
+	}
+	if err := fs.file.Sync(); err != nil {
+		return 0, err
+	}
+	return fs.size, nil
+}
+
+// Rollback discards the records written after the log had the given size,
+// and rebuilds the index from the remaining records.
+func (fs *fileStore) Rollback(position int64) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.readOnly {
+		return errReadOnly
+	}
+	if position < 0 || position > fs.size {
+		return fmt.Errorf("cannot roll back %s to offset %d beyond its size %d", fs.path, position, fs.size)
+	}
+	if err := fs.file.Truncate(position); err != nil {
+		return err
+	}
+	if _, err := fs.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fs.index = make(map[string][]segment)
+	fs.finalized = false
+	return fs.replay()
+}
+
+// Close syncs and closes the log.
+func (fs *fileStore) Close() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.readOnly {
+		return fs.file.Close()
+	}
+	if err := fs.file.Sync(); err != nil {
+		fs.file.Close()
+		return err
+	}
+	return fs.file.Close()
+}
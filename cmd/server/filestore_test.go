@@ -0,0 +1,487 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/ingest"
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// TestFileStore checks that values survive reopening, and that a rebuilt
+// store only holds the new values
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buckets.log")
+	fs, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Append("00001", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Append("00001", []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put("00002", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put("00002", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{"00001": []byte("abcdef"), "00002": []byte("new")}
+	check := func(fs *fileStore) {
+		t.Helper()
+		if len(fs.Keys()) != len(want) {
+			t.Errorf("want %d keys, got %d", len(want), len(fs.Keys()))
+		}
+		for id, value := range want {
+			got, err := fs.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Errorf("%s: want %q, got %q", id, value, got)
+			}
+		}
+	}
+
+	if fs, err = openFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+	if fs.Finalized() {
+		t.Errorf("store should not be finalized")
+	}
+	if err := fs.SetFinalized(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a read-only store serves the same values, and rejects writes
+	if fs, err = openFileStoreReadOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+	if !fs.Finalized() {
+		t.Errorf("store should be finalized")
+	}
+	if err := fs.Append("00001", []byte("ghi")); err != errReadOnly {
+		t.Errorf("want %v, got %v", errReadOnly, err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err = openFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	// a failed rebuild keeps the old values
+	failure := errors.New("build failed")
+	err = fs.Rebuild(func(put func(id string, value []byte) error) error {
+		if err := put("00003", []byte("partial")); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Errorf("want %v, got %v", failure, err)
+	}
+	check(fs)
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary log left after a failed rebuild: %v", err)
+	}
+
+	// a reader of the old log keeps its values after a rebuild
+	reader, err := openFileStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	want = map[string][]byte{"00003": []byte("rebuilt")}
+	err = fs.Rebuild(func(put func(id string, value []byte) error) error {
+		return put("00003", []byte("rebuilt"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+	if !fs.Finalized() {
+		t.Errorf("rebuilt store should be finalized")
+	}
+	if value, err := reader.Get("00001"); err != nil || string(value) != "abcdef" {
+		t.Errorf("old log changed under its reader: got %q, %v", value, err)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err = openFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	check(fs)
+	if !fs.Finalized() {
+		t.Errorf("rebuilt store should be finalized after reopening")
+	}
+}
+
+// TestFileStoreCrash checks that an incomplete or corrupt trailing record is
+// discarded when reopening the store
+func TestFileStoreCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buckets.log")
+	fs, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Append("00001", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	goodSize := fs.size
+	if err := fs.Append("00001", []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, corrupt := range [][]byte{
+		data[:len(data)-1],
+		append(append([]byte{}, data[:len(data)-2]...), data[len(data)-2]^1, data[len(data)-1]),
+		append(append([]byte{}, data...), opAppend, 0xff),
+	} {
+		if err := os.WriteFile(path, corrupt, 0600); err != nil {
+			t.Fatal(err)
+		}
+		fs, err := openFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := fs.Get("00001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantValue, wantSize := []byte("abc"), goodSize
+		if len(corrupt) > len(data) {
+			wantValue, wantSize = []byte("abcdef"), int64(len(data))
+		}
+		if !bytes.Equal(value, wantValue) {
+			t.Errorf("want %q, got %q", wantValue, value)
+		}
+		if fs.size != wantSize {
+			t.Errorf("want log size %d, got %d", wantSize, fs.size)
+		}
+
+		// the store can be appended to after recovery
+		if err := fs.Append("00001", []byte("ghi")); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if fs, err = openFileStore(path); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := fs.Get("00001"); !bytes.Equal(value, append(wantValue, "ghi"...)) {
+			t.Errorf("want %q, got %q", append(wantValue, "ghi"...), value)
+		}
+		fs.Close()
+	}
+}
+
+// TestFileStoreRollback checks that a store can be rolled back to a
+// checkpoint, including after reopening it
+func TestFileStoreRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ingest.log")
+	fs, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Append("00001", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	position, err := fs.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Append("00001", []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Append("00002", []byte("ghi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err = openFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err := fs.Rollback(fs.size + 1); err == nil {
+		t.Errorf("expected rolling back beyond the end of the log to fail")
+	}
+	if err := fs.Rollback(position); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := fs.Get("00001"); !bytes.Equal(value, []byte("abc")) {
+		t.Errorf("want %q, got %q", "abc", value)
+	}
+	if len(fs.Keys()) != 1 {
+		t.Errorf("want 1 key, got %d", len(fs.Keys()))
+	}
+	if err := fs.Append("00001", []byte("jkl")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := fs.Get("00001"); !bytes.Equal(value, []byte("abcjkl")) {
+		t.Errorf("want %q, got %q", "abcjkl", value)
+	}
+}
+
+// TestDBServer checks that a database can be extended by later ingestions,
+// and served read-only by another server
+func TestDBServer(t *testing.T) {
+	dir := t.TempDir()
+	cfg := migp.DefaultServerConfig()
+	cfg.Padding = migp.PaddingConfig{BucketEntries: 16}
+
+	credentials := [][2][]byte{
+		{[]byte("username1"), []byte("password1")},
+		{[]byte("username2"), []byte("password2")},
+	}
+	for _, credential := range credentials {
+		s, err := newDBServer(cfg, dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.insert(credential[0], credential[1], []byte("test metadata"), 9, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.finalize(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := newDBServer(cfg, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if !s.finalized() {
+		t.Fatal("reopened database should be finalized")
+	}
+	if err := s.insert([]byte("username3"), []byte("password3"), nil, 9, true); err == nil {
+		t.Error("expected insertion into a read-only database to fail")
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	for _, credential := range credentials {
+		status, _, err := migp.Query(cfg.Config, httpServer.URL+"/evaluate", credential[0], credential[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != migp.InBreach {
+			t.Errorf("status: want %s, got %s", migp.InBreach, status)
+		}
+	}
+	status, _, err := migp.Query(cfg.Config, httpServer.URL+"/evaluate", []byte("username3"), []byte("password3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != migp.NotInBreach {
+		t.Errorf("status: want %s, got %s", migp.NotInBreach, status)
+	}
+}
+
+// TestDBServerIngestResume checks that an ingestion that crashed after
+// ingesting its input but before finalizing the buckets is finalized without
+// ingesting the input again
+func TestDBServerIngestResume(t *testing.T) {
+	dir := t.TempDir()
+	cfg := migp.DefaultServerConfig()
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, []byte("username1:password1\nusername2:password2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := ingestFlags{
+		inputFilename:          inputFile,
+		format:                 "delimited",
+		numVariants:            2,
+		includeUsernameVariant: true,
+		workers:                2,
+	}
+	f.setDefaultCheckpoint(dir, cfg.KeyID)
+
+	// storeSize returns the total size of the inserted entries
+	storeSize := func(s *server) int {
+		store, err := s.ingestStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := 0
+		for _, id := range store.Keys() {
+			bucket, err := store.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size += len(bucket)
+		}
+		return size
+	}
+
+	// Run the pipeline to completion, then crash before finalizing.
+	s, err := newDBServer(cfg, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := s.ingestStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := ingest.NewPipeline(s.migpServer, store, ingest.Config{
+		NumVariants:            f.numVariants,
+		IncludeUsernameVariant: f.includeUsernameVariant,
+		CheckpointFile:         f.checkpointFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := os.Open(inputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	if _, err := pipeline.Run(context.Background(), input); err != nil {
+		t.Fatal(err)
+	}
+	ingested := storeSize(s)
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.checkpointFile); err != nil {
+		t.Fatalf("checkpoint was removed before finalizing: %v", err)
+	}
+
+	s, err = newDBServer(cfg, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := f.ingest(s); err != nil {
+		t.Fatal(err)
+	}
+	if size := storeSize(s); size != ingested {
+		t.Errorf("want %d bytes of entries, got %d", ingested, size)
+	}
+	if !s.finalized() {
+		t.Error("database was not finalized")
+	}
+	if _, err := os.Stat(f.checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("checkpoint was not removed after finalizing: %v", err)
+	}
+
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+	status, _, err := migp.Query(cfg.Config, httpServer.URL+"/evaluate", []byte("username2"), []byte("password2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != migp.InBreach {
+		t.Errorf("status: want %s, got %s", migp.InBreach, status)
+	}
+}
+
+// TestDBServerPreviousKey checks that previous key epochs are only served
+// from their finalized buckets
+func TestDBServerPreviousKey(t *testing.T) {
+	dir := t.TempDir()
+	oldCfg := migp.DefaultServerConfig()
+	s, err := newDBServer(oldCfg, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.insert([]byte("username1"), []byte("password1"), nil, 9, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	newCfg, err := oldCfg.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownCfg, err := newCfg.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = newDBServer(newCfg, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.addKey(unknownCfg); err == nil {
+		t.Error("expected adding a key without finalized buckets to fail")
+	}
+	if err := s.addKey(oldCfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.insert([]byte("username2"), []byte("password2"), nil, 9, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+	for _, test := range []struct {
+		cfg      migp.Config
+		username []byte
+		password []byte
+	}{
+		{oldCfg.Config, []byte("username1"), []byte("password1")},
+		{newCfg.Config, []byte("username2"), []byte("password2")},
+	} {
+		status, _, err := migp.Query(test.cfg, httpServer.URL+"/evaluate", test.username, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != migp.InBreach {
+			t.Errorf("status: want %s, got %s", migp.InBreach, status)
+		}
+	}
+
+	// in-memory servers have no buckets for previous key epochs
+	memServer, err := newServer(newCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memServer.addKey(oldCfg); err == nil {
+		t.Error("expected adding a key to an in-memory server to fail")
+	}
+}
@@ -5,12 +5,33 @@ package main
 
 import "sync"
 
+// bucketStore stores the buckets of a key epoch. Implements migp.Getter
+type bucketStore interface {
+	// Put a value at key id and replace any existing value.
+	Put(id string, value []byte) error
+	// Append a value to any existing value at key id.
+	Append(id string, value []byte) error
+	// Get returns the value in the key identified by id.
+	Get(id string) ([]byte, error)
+	// Keys returns the identifiers of all keys with a value.
+	Keys() []string
+	// Finalized reports whether the buckets were finalized.
+	Finalized() bool
+	// Rebuild replaces all values with those put by build and records
+	// that the buckets were finalized. The old values are kept if build
+	// fails.
+	Rebuild(build func(put func(id string, value []byte) error) error) error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
 // kvStore is a wrapper for a KV store. For now just use a simple dynamically
 // allocated in-memory go map This won't scale properly, but ok for testing.
 // Implements migp.Getter
 type kvStore struct {
-	store map[string][]byte
-	lock  sync.RWMutex
+	store     map[string][]byte
+	finalized bool
+	lock      sync.RWMutex
 }
 
 // newKVStore initializes a new bucket store. Just using a simple map for now.
@@ -36,9 +57,51 @@ func (kv *kvStore) Append(id string, value []byte) error {
 	return nil
 }
 
+// Keys returns the identifiers of all keys with a value.
+func (kv *kvStore) Keys() []string {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	keys := make([]string, 0, len(kv.store))
+	for id := range kv.store {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
 // Get returns the value in the key identified by id.
 func (kv *kvStore) Get(id string) ([]byte, error) {
 	kv.lock.RLock()
 	defer kv.lock.RUnlock()
 	return kv.store[id], nil
 }
+
+// Finalized reports whether the buckets were finalized.
+func (kv *kvStore) Finalized() bool {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	return kv.finalized
+}
+
+// Rebuild replaces all values with those put by build and records that the
+// buckets were finalized. The old values are served until the rebuild
+// completes.
+func (kv *kvStore) Rebuild(build func(put func(id string, value []byte) error) error) error {
+	store := make(map[string][]byte)
+	err := build(func(id string, value []byte) error {
+		store[id] = value
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.store = store
+	kv.finalized = true
+	return nil
+}
+
+// Close is a no-op for the in-memory store.
+func (kv *kvStore) Close() error {
+	return nil
+}
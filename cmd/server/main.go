@@ -4,49 +4,197 @@
 // server implements a MIGP server. It supports encrypting and uploading a
 // database of breach entries to buckets, and serving those buckets to clients
 // via the MIGP protocol.
+//
+// Usage:
+//
+//	server keygen [flags]   write a new server configuration
+//	server ingest [flags]   add breach entries to an on-disk database
+//	server serve [flags]    serve an existing on-disk database
+//	server [flags]          ingest breach entries into memory and serve them
+//
+// Run a subcommand with -help for its flags.
 
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/migp-go/pkg/ingest"
 	"github.com/cloudflare/migp-go/pkg/migp"
+	"github.com/cloudflare/migp-go/pkg/mutator"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "keygen":
+			runKeygen(os.Args[2:])
+			return
+		case "ingest":
+			runIngest(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		}
+	}
+	runAll(os.Args[1:])
+}
 
-	var configFile, inputFilename, metadata, listenAddr string
-	var dumpConfig, includeUsernameVariant bool
-	var numVariants int
-
-	flag.StringVar(&configFile, "config", "", "Server configuration file")
-	flag.StringVar(&listenAddr, "listen", "localhost:8080", "Server listen address")
-	flag.BoolVar(&dumpConfig, "dump-config", false, "Dump the server configuration to stdout and exit")
-	flag.StringVar(&inputFilename, "infile", "-", "input file of credentials to insert in the format <username>:<password> ('-' for stdin)")
-	flag.StringVar(&metadata, "metadata", "", "optional metadata string to store alongside breach entries")
-	flag.IntVar(&numVariants, "num-variants", 9, "number of password variants to include")
-	flag.BoolVar(&includeUsernameVariant, "username-variant", true, "include a username-only variant")
-
-	flag.Parse()
+// runKeygen writes a new server configuration, or the next key epoch of an
+// existing one
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	var outFilename, rotateFile string
+	var cfgFlags configFlags
+	fs.StringVar(&outFilename, "out", "-", "output file for the server configuration ('-' for stdout)")
+	fs.StringVar(&rotateFile, "rotate", "", "server configuration file to rotate: the new configuration keeps its parameters with a fresh key and the next key ID")
+	cfgFlags.register(fs)
+	_ = fs.Parse(args)
 
 	var cfg migp.ServerConfig
-	if configFile != "" {
-		data, err := os.ReadFile(configFile)
-		if err != nil {
+	var err error
+	if rotateFile != "" {
+		if cfg, err = readServerConfig(rotateFile); err != nil {
 			log.Fatal(err)
 		}
-		err = json.Unmarshal(data, &cfg)
-		if err != nil {
+		if cfg, err = cfg.Rotate(); err != nil {
 			log.Fatal(err)
 		}
+		cfgFlags.applyPadding(&cfg)
+	} else if cfg, err = cfgFlags.newConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := json.Marshal(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if outFilename == "-" {
+		_, err = os.Stdout.Write(data)
 	} else {
-		cfg = migp.DefaultServerConfig()
+		// The configuration holds the private key.
+		err = os.WriteFile(outFilename, data, 0600)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runIngest adds breach entries to an on-disk database, creating it if
+// needed, and finalizes the database for serving
+func runIngest(args []string) {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	var configFile, dbDir string
+	var inFlags ingestFlags
+	fs.StringVar(&configFile, "config", "", "server configuration file (required)")
+	fs.StringVar(&dbDir, "db", "", "directory of the bucket database to create or extend (required)")
+	inFlags.register(fs)
+	_ = fs.Parse(args)
+
+	if configFile == "" || dbDir == "" {
+		log.Fatal("ingest requires -config and -db")
+	}
+	cfg, err := readServerConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := newDBServer(cfg, dbDir, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	inFlags.setDefaultCheckpoint(dbDir, cfg.KeyID)
+	if err := inFlags.ingest(s); err != nil {
+		s.close()
+		log.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runServe serves an existing on-disk database without modifying it
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var configFile, previousConfigFiles, dbDir, listenAddr string
+	fs.StringVar(&configFile, "config", "", "server configuration file (required)")
+	fs.StringVar(&previousConfigFiles, "previous-configs", "", "comma-separated server configuration files for previous key epochs to keep serving, whose finalized buckets must be in the -db directory")
+	fs.StringVar(&dbDir, "db", "", "directory of the bucket database to serve (required)")
+	fs.StringVar(&listenAddr, "listen", "localhost:8080", "Server listen address")
+	_ = fs.Parse(args)
+
+	if configFile == "" || dbDir == "" {
+		log.Fatal("serve requires -config and -db")
+	}
+	cfg, err := readServerConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := newDBServer(cfg, dbDir, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !s.finalized() {
+		log.Fatalf("The database in %q was not finalized; run ingest first", dbDir)
+	}
+	if err := addPreviousKeys(s, previousConfigFiles); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Starting MIGP server")
+	serve(s, listenAddr)
+}
+
+// runAll ingests breach entries and serves them from a single process. This
+// is the behavior when no subcommand is given.
+func runAll(args []string) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	var configFile, previousConfigFiles, dbDir, listenAddr string
+	var dumpConfig bool
+	var cfgFlags configFlags
+	var inFlags ingestFlags
+	fs.StringVar(&configFile, "config", "", "Server configuration file")
+	fs.StringVar(&previousConfigFiles, "previous-configs", "", "comma-separated server configuration files for previous key epochs to keep serving, whose finalized buckets must be in the -db directory")
+	fs.StringVar(&dbDir, "db", "", "directory of the on-disk bucket database (default: keep buckets in memory). An existing finalized database is served without re-ingesting the input, and requires the -config it was built with")
+	fs.StringVar(&listenAddr, "listen", "localhost:8080", "Server listen address")
+	fs.BoolVar(&dumpConfig, "dump-config", false, "Dump the server configuration to stdout and exit")
+	cfgFlags.register(fs)
+	inFlags.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [keygen|ingest|serve] [flags]\n\nFlags without a subcommand:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if dbDir != "" && configFile == "" {
+		if entries, err := os.ReadDir(dbDir); err == nil && len(entries) > 0 {
+			log.Fatalf("The database in %q requires the configuration it was built with; set -config", dbDir)
+		}
+	}
+
+	var cfg migp.ServerConfig
+	var err error
+	if configFile != "" {
+		if cfg, err = readServerConfig(configFile); err != nil {
+			log.Fatal(err)
+		}
+		cfgFlags.applyPadding(&cfg)
+	} else if cfg, err = cfgFlags.newConfig(); err != nil {
+		log.Fatal(err)
 	}
 
 	if dumpConfig {
@@ -61,37 +209,373 @@ func main() {
 		return
 	}
 
-	s, err := newServer(cfg)
+	if previousConfigFiles != "" && dbDir == "" {
+		log.Fatal("-previous-configs requires the -db holding the finalized buckets of the previous key epochs")
+	}
+
+	var s *server
+	if dbDir != "" {
+		s, err = newDBServer(cfg, dbDir, false)
+	} else {
+		s, err = newServer(cfg)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	inputFile := os.Stdin
-	if inputFilename != "-" {
-		if inputFile, err = os.Open(inputFilename); err != nil {
-			log.Fatal(err)
+	if err := addPreviousKeys(s, previousConfigFiles); err != nil {
+		log.Fatal(err)
+	}
+
+	inFlags.setDefaultCheckpoint(dbDir, cfg.KeyID)
+	if s.finalized() {
+		log.Printf("Serving existing database in %q", dbDir)
+	} else if err := inFlags.ingest(s); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Starting MIGP server")
+	serve(s, listenAddr)
+}
+
+// configFlags holds the flags used to generate a new server configuration
+type configFlags struct {
+	verifiable                               bool
+	suiteName, slowHasherName, encryptorName string
+	canonicalizerName                        string
+	padding                                  migp.PaddingConfig
+}
+
+// register registers the configuration flags in the flag set
+func (f *configFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.verifiable, "verifiable", false, "use the verifiable OPRF mode when generating a new configuration")
+	fs.StringVar(&f.slowHasherName, "slow-hasher", "scrypt", "slow hasher to use when generating a new configuration (scrypt or argon2id)")
+	fs.StringVar(&f.encryptorName, "bucket-encryptor", "hkdf-sha256", "bucket encryptor to use when generating a new configuration (hkdf-sha256, aes256gcm, or chacha20poly1305)")
+	fs.StringVar(&f.suiteName, "suite", "p256", "OPRF suite to use when generating a new configuration (p256, p384, or p521)")
+	fs.StringVar(&f.canonicalizerName, "username-canonicalizer", usernameCanonicalizerName(migp.DefaultUsernameCanonicalizer), "username canonicalizer to use when generating a new configuration (null, email, nfkc, nfkc-email, or phone)")
+	fs.IntVar(&f.padding.BucketEntries, "pad-entries", 0, "pad buckets with dummy entries to a multiple of this number of entries (overrides the configuration)")
+	fs.IntVar(&f.padding.BucketBytes, "pad-bytes", 0, "pad buckets with dummy entries to a multiple of this number of bytes, which must be a multiple of the entry length and requires -pad-metadata (overrides the configuration)")
+	fs.IntVar(&f.padding.MetadataLength, "pad-metadata", 0, "pad entry metadata to a multiple of this number of bytes (overrides the configuration)")
+}
+
+// usernameCanonicalizers maps the names of the username canonicalizers to
+// their IDs
+var usernameCanonicalizers = map[string]uint16{
+	"null":       migp.UsernameCanonicalizerNull,
+	"email":      migp.UsernameCanonicalizerEmail,
+	"nfkc":       migp.UsernameCanonicalizerNFKC,
+	"nfkc-email": migp.UsernameCanonicalizerNFKCEmail,
+	"phone":      migp.UsernameCanonicalizerPhone,
+}
+
+// usernameCanonicalizerName returns the name of a username canonicalizer
+func usernameCanonicalizerName(id uint16) string {
+	for name, canonicalizerID := range usernameCanonicalizers {
+		if canonicalizerID == id {
+			return name
 		}
-		defer inputFile.Close()
 	}
+	return ""
+}
+
+// newConfig generates a new server configuration from the flags
+func (f *configFlags) newConfig() (migp.ServerConfig, error) {
+	baseCfg := migp.DefaultConfig()
+	suite, err := parseSuite(f.suiteName)
+	if err != nil {
+		return migp.ServerConfig{}, err
+	}
+	baseCfg.OPRFSuite = suite
+	switch f.slowHasherName {
+	case "scrypt":
+		baseCfg.SlowHasherID = migp.SlowHasherScrypt
+	case "argon2id":
+		baseCfg.SlowHasherID = migp.SlowHasherArgon2id
+	default:
+		return migp.ServerConfig{}, fmt.Errorf("unsupported slow hasher %q", f.slowHasherName)
+	}
+	// NewServerConfig sets the default parameters of the chosen slow hasher
+	baseCfg.SlowHasherParams = migp.SlowHasherParams{}
+	switch f.encryptorName {
+	case "hkdf-sha256":
+		baseCfg.BucketEncryptorID = migp.BucketEncryptorHKDFSHA256
+	case "aes256gcm":
+		baseCfg.BucketEncryptorID = migp.BucketEncryptorAES256GCM
+	case "chacha20poly1305":
+		baseCfg.BucketEncryptorID = migp.BucketEncryptorChaCha20Poly1305
+	default:
+		return migp.ServerConfig{}, fmt.Errorf("unsupported bucket encryptor %q", f.encryptorName)
+	}
+	canonicalizerID, ok := usernameCanonicalizers[f.canonicalizerName]
+	if !ok {
+		return migp.ServerConfig{}, fmt.Errorf("unsupported username canonicalizer %q", f.canonicalizerName)
+	}
+	baseCfg.UsernameCanonicalizerID = canonicalizerID
+	if f.verifiable {
+		baseCfg.OPRFMode = oprf.VerifiableMode
+	}
+	cfg, err := migp.NewServerConfig(baseCfg)
+	if err != nil {
+		return migp.ServerConfig{}, err
+	}
+	f.applyPadding(&cfg)
+	return cfg, nil
+}
+
+// applyPadding overrides the padding configuration with the padding flags
+// that were set
+func (f *configFlags) applyPadding(cfg *migp.ServerConfig) {
+	if f.padding.BucketEntries != 0 {
+		cfg.Padding.BucketEntries = f.padding.BucketEntries
+	}
+	if f.padding.BucketBytes != 0 {
+		cfg.Padding.BucketBytes = f.padding.BucketBytes
+	}
+	if f.padding.MetadataLength != 0 {
+		cfg.Padding.MetadataLength = f.padding.MetadataLength
+	}
+}
+
+// ingestFlags holds the flags controlling the ingestion of breach entries
+type ingestFlags struct {
+	inputFilename, metadata                        string
+	breachName, breachDate, dataClasses, sourceURL string
+	format, delimiter, columns, rejectsFilename    string
+	headerLines                                    int
+	rulesFilename, rulesFormat, policyFilename     string
+	byteRules, rulePairs                           bool
+	shuffleSeed                                    string
+	numVariants                                    int
+	includeUsernameVariant, describeVariants       bool
+	workers                                        int
+	checkpointFile                                 string
+	progressInterval                               time.Duration
+}
+
+// register registers the ingestion flags in the flag set
+func (f *ingestFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.inputFilename, "infile", "-", "input file of credentials to insert, one record per line ('-' for stdin)")
+	fs.StringVar(&f.format, "format", "delimited", "format of the input file (delimited, csv, or jsonl)")
+	fs.StringVar(&f.delimiter, "delimiter", "", "field delimiter of delimited or csv input, where \\t stands for a tab (default ':' for delimited, ',' for csv)")
+	fs.StringVar(&f.columns, "columns", "", "comma-separated names of the fields of delimited or csv input, empty to ignore a field (default \"username,password\"), or of the form <field>=<path> for jsonl input, where the path is dot-separated (default \"username=username,password=password\"). The username and password fields are required, and other fields may be referenced by the metadata flags")
+	fs.IntVar(&f.headerLines, "header-lines", 0, "number of header lines to skip at the start of the input file")
+	fs.StringVar(&f.rejectsFilename, "rejects", "", "file to append rejected input lines to, with their line number and the reason")
+	fs.StringVar(&f.metadata, "metadata", "", "optional metadata string to store alongside breach entries")
+	fs.StringVar(&f.breachName, "breach-name", "", "optional name of the breach to store alongside breach entries")
+	fs.StringVar(&f.breachDate, "breach-date", "", "optional date of the breach (YYYY-MM-DD)")
+	fs.StringVar(&f.dataClasses, "data-classes", "", "optional comma-separated list of data classes exposed in the breach")
+	fs.StringVar(&f.sourceURL, "source-url", "", "optional URL describing the breach. The metadata flags may reference input fields as {field}, e.g., -breach-name '{breach}'")
+	fs.IntVar(&f.numVariants, "num-variants", 9, "number of password variants to include")
+	fs.StringVar(&f.rulesFilename, "rules", "", "file of the mangling rules generating the password variants (default: built-in RDas rules)")
+	fs.StringVar(&f.rulesFormat, "rules-format", "rdas", "format of the rules file: rdas (JSON list of RDas rules) or hashcat (hashcat rule file)")
+	fs.BoolVar(&f.byteRules, "byte-rules", false, "apply RDas rules to bytes rather than characters, to generate the same variants as earlier versions for non-ASCII passwords")
+	fs.BoolVar(&f.rulePairs, "rule-pairs", false, "also generate password variants combining two rules, e.g., capitalizing the first letter and appending \"!\", interleaved with the variants of single rules")
+	fs.StringVar(&f.policyFilename, "policy", "", "JSON file of the password policy that variants must comply with, e.g., {\"minLength\": 8, \"maxLength\": 64, \"requiredClasses\": [\"digit\"], \"disallowed\": [\"password1\"]}, where classes are letter, lower, upper, digit, or symbol")
+	fs.BoolVar(&f.includeUsernameVariant, "username-variant", true, "include a username-only variant")
+	fs.BoolVar(&f.describeVariants, "describe-variants", false, "store a description of how each password variant differs from the breached password in its metadata, e.g., \"trailing digits added\" (RDas rules only)")
+	fs.StringVar(&f.shuffleSeed, "shuffle-seed", "", "secret seed to reproduce the permutation of bucket entries across builds (default: random permutation)")
+	fs.IntVar(&f.workers, "workers", runtime.NumCPU(), "number of breach entries to encrypt in parallel")
+	fs.StringVar(&f.checkpointFile, "checkpoint", "", "file recording the progress of the ingestion, to resume it after an interruption with the same input (default: ingest-<key ID>.checkpoint in the -db directory)")
+	fs.DurationVar(&f.progressInterval, "progress-interval", ingest.DefaultProgressInterval, "interval between progress reports")
+}
+
+// setDefaultCheckpoint sets the checkpoint file to its default location in
+// the database directory, unless set by a flag. Checkpoints are not
+// supported for in-memory databases.
+func (f *ingestFlags) setDefaultCheckpoint(dbDir string, keyID uint32) {
+	if f.checkpointFile == "" && dbDir != "" {
+		f.checkpointFile = filepath.Join(dbDir, fmt.Sprintf("ingest-%d.checkpoint", keyID))
+	}
+}
 
-	successCount, failureCount := 0, 0
-	log.Printf("Encrypting breach entries: %d successes, %d failures", successCount, failureCount)
-	scanner := bufio.NewScanner(inputFile)
-	for scanner.Scan() {
-		fields := bytes.SplitN(scanner.Bytes(), []byte(":"), 2)
-		if len(fields) < 2 {
-			failureCount += 1
-			continue
+// ingest inserts the breach entries from the input file and finalizes the
+// server's buckets
+func (f *ingestFlags) ingest(s *server) error {
+	parser, err := f.parser()
+	if err != nil {
+		return err
+	}
+	m, err := f.mutator()
+	if err != nil {
+		return err
+	}
+	s.mutator = m
+	if f.shuffleSeed != "" {
+		s.shuffleSeed = []byte(f.shuffleSeed)
+	}
+
+	store, err := s.ingestStore()
+	if err != nil {
+		return err
+	}
+	cfg := ingest.Config{
+		Workers:                f.workers,
+		Mutator:                m,
+		NumVariants:            f.numVariants,
+		IncludeUsernameVariant: f.includeUsernameVariant,
+		DescribeVariants:       f.describeVariants,
+		Parser:                 parser,
+		HeaderLines:            f.headerLines,
+		Metadata: ingest.MetadataTemplate{
+			Name:        f.breachName,
+			Date:        f.breachDate,
+			DataClasses: f.dataClasses,
+			SourceURL:   f.sourceURL,
+			Raw:         f.metadata,
+		},
+		CheckpointFile: f.checkpointFile,
+		Progress: func(progress ingest.Progress) {
+			log.Printf("Encrypting breach entries: %s", progress)
+		},
+		ProgressInterval: f.progressInterval,
+	}
+	if f.rejectsFilename != "" {
+		rejects, err := os.OpenFile(f.rejectsFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
 		}
-		username, password := fields[0], fields[1]
-		if err := s.insert(username, password, []byte(metadata), numVariants, includeUsernameVariant); err != nil {
-			failureCount += 1
-			continue
+		defer rejects.Close()
+		cfg.Rejects = rejects
+	}
+	pipeline, err := ingest.NewPipeline(s.migpServer, store, cfg)
+	if err != nil {
+		return err
+	}
+
+	var inputFile io.Reader = os.Stdin
+	if f.inputFilename != "-" {
+		file, err := os.Open(f.inputFilename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		inputFile = file
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if _, err := pipeline.Run(ctx, inputFile); err != nil {
+		if ctx.Err() != nil && f.checkpointFile != "" {
+			return fmt.Errorf("ingestion interrupted; run again with the same input to resume from %s", f.checkpointFile)
 		}
-		successCount += 1
-		log.Printf("\rEncrypting breach entries: %d successes, %d failures", successCount, failureCount)
+		return err
 	}
 
-	log.Printf("\nStarting MIGP server")
-	log.Fatal(http.ListenAndServe(listenAddr, s.handler()))
+	log.Printf("Padding buckets")
+	if err := s.finalize(); err != nil {
+		return err
+	}
+	// The checkpoint is only removed once the buckets are finalized, so
+	// that an interrupted finalization resumes without ingesting the input
+	// again.
+	return pipeline.RemoveCheckpoint()
+}
+
+// mutator returns the mutator configured by the flags
+func (f *ingestFlags) mutator() (mutator.Mutator, error) {
+	return mutator.NewMutatorFromConfig(mutator.Config{
+		RulesFile:      f.rulesFilename,
+		RulesFormat:    f.rulesFormat,
+		ByteCompatible: f.byteRules,
+		RulePairs:      f.rulePairs,
+		PolicyFile:     f.policyFilename,
+	})
+}
+
+// parser returns the parser for the input format
+func (f *ingestFlags) parser() (ingest.Parser, error) {
+	delimiter := strings.ReplaceAll(f.delimiter, `\t`, "\t")
+	var columns []string
+	if f.columns != "" {
+		columns = strings.Split(f.columns, ",")
+	}
+
+	switch f.format {
+	case "delimited":
+		if delimiter == "" {
+			delimiter = ":"
+		}
+		if columns == nil {
+			columns = ingest.DefaultColumns
+		}
+		return ingest.NewDelimitedParser(delimiter, columns)
+	case "csv":
+		if delimiter == "" {
+			delimiter = ","
+		}
+		comma := []rune(delimiter)
+		if len(comma) != 1 {
+			return nil, fmt.Errorf("csv delimiter %q must be a single character", delimiter)
+		}
+		if columns == nil {
+			columns = ingest.DefaultColumns
+		}
+		return ingest.NewCSVParser(comma[0], columns)
+	case "jsonl":
+		if columns == nil {
+			columns = []string{ingest.UsernameField + "=" + ingest.UsernameField, ingest.PasswordField + "=" + ingest.PasswordField}
+		}
+		paths := make(map[string]string)
+		for _, column := range columns {
+			field := strings.SplitN(column, "=", 2)
+			if len(field) < 2 {
+				return nil, fmt.Errorf("jsonl column %q is not of the form <field>=<path>", column)
+			}
+			paths[field[0]] = field[1]
+		}
+		return ingest.NewJSONParser(paths)
+	default:
+		return nil, fmt.Errorf("unsupported input format %q", f.format)
+	}
+}
+
+// addPreviousKeys adds the key epochs of the comma-separated configuration
+// files to the server
+func addPreviousKeys(s *server, previousConfigFiles string) error {
+	if previousConfigFiles == "" {
+		return nil
+	}
+	for _, filename := range strings.Split(previousConfigFiles, ",") {
+		previousCfg, err := readServerConfig(filename)
+		if err != nil {
+			return err
+		}
+		if err := s.addKey(previousCfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serve serves MIGP requests until the server fails. The bucket stores are
+// closed before exiting.
+func serve(s *server, listenAddr string) {
+	err := http.ListenAndServe(listenAddr, s.handler())
+	s.close()
+	log.Fatal(err)
+}
+
+// readServerConfig reads a JSON-encoded server configuration from a file
+func readServerConfig(filename string) (migp.ServerConfig, error) {
+	var cfg migp.ServerConfig
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// parseSuite returns the OPRF suite identifier for the given suite name
+func parseSuite(name string) (oprf.SuiteID, error) {
+	switch strings.ToLower(name) {
+	case "p256":
+		return oprf.OPRFP256, nil
+	case "p384":
+		return oprf.OPRFP384, nil
+	case "p521":
+		return oprf.OPRFP521, nil
+	default:
+		return 0, fmt.Errorf("unsupported OPRF suite %q", name)
+	}
 }
@@ -4,38 +4,314 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 
+	"github.com/cloudflare/migp-go/pkg/ingest"
 	"github.com/cloudflare/migp-go/pkg/migp"
 	"github.com/cloudflare/migp-go/pkg/mutator"
 )
 
-// newServer returns a new server initialized using the provided configuration
+// newServer returns a new server initialized using the provided configuration,
+// which stores buckets in memory
 func newServer(cfg migp.ServerConfig) (*server, error) {
+	return newServerWithStores(cfg, func(keyID uint32) (*epochStores, error) {
+		ingest, err := newKVStore()
+		if err != nil {
+			return nil, err
+		}
+		serve, err := newKVStore()
+		if err != nil {
+			return nil, err
+		}
+		return &epochStores{ingest: ingest, serve: serve}, nil
+	})
+}
+
+// newDBServer returns a new server initialized using the provided
+// configuration, which stores the buckets of each key epoch in files in the
+// given directory. A read-only server only opens the finalized buckets, and
+// cannot ingest new entries. The buckets of previous key epochs are always
+// opened read-only.
+func newDBServer(cfg migp.ServerConfig, dir string, readOnly bool) (*server, error) {
+	if !readOnly {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return newServerWithStores(cfg, func(keyID uint32) (*epochStores, error) {
+		servePath := filepath.Join(dir, fmt.Sprintf("buckets-%d.log", keyID))
+		if readOnly || keyID != cfg.KeyID {
+			serve, err := openFileStoreReadOnly(servePath)
+			if err != nil {
+				return nil, err
+			}
+			return &epochStores{serve: serve}, nil
+		}
+		ingest, err := openFileStore(filepath.Join(dir, fmt.Sprintf("ingest-%d.log", keyID)))
+		if err != nil {
+			return nil, err
+		}
+		serve, err := openFileStore(servePath)
+		if err != nil {
+			ingest.Close()
+			return nil, err
+		}
+		return &epochStores{ingest: ingest, serve: serve}, nil
+	})
+}
+
+// newServerWithStores returns a new server initialized using the provided
+// configuration, which opens the bucket stores of each key epoch with
+// openStores
+func newServerWithStores(cfg migp.ServerConfig, openStores func(keyID uint32) (*epochStores, error)) (*server, error) {
 	migpServer, err := migp.NewServer(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	kv, err := newKVStore()
+	stores, err := openStores(cfg.KeyID)
 	if err != nil {
 		return nil, err
 	}
 
 	return &server{
 		migpServer: migpServer,
-		kv:         kv,
+		stores:     map[uint32]*epochStores{cfg.KeyID: stores},
+		openStores: openStores,
 	}, nil
 }
 
-// server wraps a MIGP server and backing KV store
+// server wraps a MIGP server and the backing KV stores for each key epoch
 type server struct {
 	migpServer *migp.Server
-	kv         *kvStore
+	stores     map[uint32]*epochStores
+	openStores func(keyID uint32) (*epochStores, error)
+	// shuffleSeed makes the permutation of bucket entries reproducible.
+	// If nil, buckets are shuffled with crypto/rand.
+	shuffleSeed []byte
+	// mutator generates the password variants of inserted credentials. If
+	// nil, the built-in RDas rules are used.
+	mutator mutator.Mutator
+}
+
+// epochStores holds the bucket stores of a key epoch. Inserted entries are
+// appended to the ingest store in insertion order, and finalization rebuilds
+// the serve store from it with padded and shuffled buckets. Keeping the
+// unpadded entries allows extending a database, since dummy entries cannot
+// be removed from a padded bucket.
+type epochStores struct {
+	// ingest is nil for read-only servers
+	ingest bucketStore
+	serve  bucketStore
+
+	// bodyLengths caches a sample of the body lengths of the served
+	// entries, from which the dummy entries of empty buckets are drawn
+	bodyLengthsLock sync.Mutex
+	bodyLengths     []int
+}
+
+// bodyLengthSampleSize is the maximum number of served buckets whose body
+// lengths are sampled for padding empty buckets
+const bodyLengthSampleSize = 256
+
+// paddedStore serves the buckets of a finalized KV store. Buckets without
+// entries are padded on request rather than stored, so that requests for
+// arbitrary bucket IDs do not grow the store. Their padding is derived from
+// the key epoch and the bucket ID, so that repeated requests for an empty
+// bucket return the same bytes, like for any other bucket.
+type paddedStore struct {
+	keyID      uint32
+	stores     *epochStores
+	migpServer *migp.Server
+}
+
+// Get returns the padded bucket identified by id
+func (p paddedStore) Get(id string) ([]byte, error) {
+	bucket, err := p.stores.serve.Get(id)
+	if err != nil || len(bucket) > 0 {
+		return bucket, err
+	}
+	bodyLengths, err := p.stores.servedBodyLengths()
+	if err != nil {
+		return nil, err
+	}
+	return p.migpServer.PadEmptyBucket(p.keyID, id, bodyLengths)
+}
+
+// servedBodyLengths returns the body lengths of the entries of evenly spaced
+// served buckets, in the order of their IDs so that the sample does not
+// change when the database is reopened
+func (e *epochStores) servedBodyLengths() ([]int, error) {
+	e.bodyLengthsLock.Lock()
+	defer e.bodyLengthsLock.Unlock()
+	if e.bodyLengths != nil {
+		return e.bodyLengths, nil
+	}
+
+	ids := e.serve.Keys()
+	sort.Strings(ids)
+	step := 1
+	if len(ids) > bodyLengthSampleSize {
+		step = len(ids) / bodyLengthSampleSize
+	}
+	bodyLengths := []int{}
+	for i := 0; i < len(ids); i += step {
+		bucket, err := e.serve.Get(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		lengths, err := migp.BucketBodyLengths(bucket)
+		if err != nil {
+			return nil, err
+		}
+		bodyLengths = append(bodyLengths, lengths...)
+	}
+	e.bodyLengths = bodyLengths
+	return bodyLengths, nil
+}
+
+// resetBodyLengths discards the cached sample of body lengths after the
+// served buckets changed
+func (e *epochStores) resetBodyLengths() {
+	e.bodyLengthsLock.Lock()
+	defer e.bodyLengthsLock.Unlock()
+	e.bodyLengths = nil
+}
+
+// addKey adds a previous key epoch to the server so that clients configured
+// with that key can still be served. The epoch's buckets must have been
+// finalized, since serving empty buckets would report every credential as
+// not in the breach.
+func (s *server) addKey(cfg migp.ServerConfig) error {
+	stores, err := s.openStores(cfg.KeyID)
+	if err != nil {
+		return fmt.Errorf("cannot open the buckets of key ID %d: %v", cfg.KeyID, err)
+	}
+	if !stores.serve.Finalized() {
+		stores.close()
+		return fmt.Errorf("no finalized buckets for key ID %d", cfg.KeyID)
+	}
+	if err := s.migpServer.AddKey(cfg.KeyID, cfg.PrivateKey); err != nil {
+		stores.close()
+		return err
+	}
+	s.stores[cfg.KeyID] = stores
+	return nil
+}
+
+// close closes the bucket stores of all key epochs
+func (s *server) close() error {
+	var firstErr error
+	for _, stores := range s.stores {
+		if err := stores.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// close closes the bucket stores of the key epoch
+func (e *epochStores) close() error {
+	var firstErr error
+	for _, kv := range []bucketStore{e.ingest, e.serve} {
+		if kv == nil {
+			continue
+		}
+		if err := kv.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// epoch returns the KV stores holding the buckets for the given key epoch
+func (s *server) epoch(keyID uint32) (*epochStores, error) {
+	stores, ok := s.stores[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %d", keyID)
+	}
+	return stores, nil
+}
+
+// getter returns the migp.Getter serving the buckets for the given key
+// epoch. Until the epoch is finalized, the inserted entries are served
+// without padding.
+func (s *server) getter(keyID uint32) (migp.Getter, error) {
+	stores, err := s.epoch(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if stores.serve.Finalized() {
+		return paddedStore{keyID: keyID, stores: stores, migpServer: s.migpServer}, nil
+	}
+	if stores.ingest != nil {
+		return stores.ingest, nil
+	}
+	return stores.serve, nil
+}
+
+// finalize rebuilds the served buckets of each key epoch from the inserted
+// entries. Each bucket is padded according to the server's padding
+// configuration, then its entries are shuffled so that their order does not
+// reveal which entries were inserted together. The previously served buckets
+// are replaced only once all buckets were rebuilt. Entries inserted
+// afterwards are only served once finalize is called again.
+func (s *server) finalize() error {
+	for keyID, stores := range s.stores {
+		if stores.ingest == nil {
+			if keyID != s.migpServer.CurrentKeyID() {
+				// previous key epochs are served as finalized
+				continue
+			}
+			return errors.New("cannot finalize a read-only database")
+		}
+		err := stores.serve.Rebuild(func(put func(id string, value []byte) error) error {
+			for _, id := range stores.ingest.Keys() {
+				bucket, err := stores.ingest.Get(id)
+				if err != nil {
+					return err
+				}
+				padded, err := s.migpServer.PadBucket(bucket)
+				if err != nil {
+					return err
+				}
+				rnd := rand.Reader
+				if s.shuffleSeed != nil {
+					rnd = migp.NewSeededReader(s.shuffleSeed, id)
+				}
+				shuffled, err := migp.ShuffleBucket(padded, rnd)
+				if err != nil {
+					return err
+				}
+				if err := put(id, shuffled); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stores.resetBodyLengths()
+	}
+	return nil
+}
+
+// finalized reports whether the buckets of the current key epoch were
+// finalized
+func (s *server) finalized() bool {
+	stores, err := s.epoch(s.migpServer.CurrentKeyID())
+	return err == nil && stores.serve.Finalized()
 }
 
 // handler handles client requests
@@ -43,46 +319,44 @@ func (s *server) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleIndex)
 	mux.HandleFunc("/evaluate", s.handleEvaluate)
+	mux.HandleFunc("/evaluate-batch", s.handleEvaluateBatch)
 	mux.HandleFunc("/config", s.handleConfig)
 	return mux
 }
 
+// ingestStore returns the store receiving the inserted entries of the
+// current key epoch
+func (s *server) ingestStore() (bucketStore, error) {
+	stores, err := s.epoch(s.migpServer.CurrentKeyID())
+	if err != nil {
+		return nil, err
+	}
+	if stores.ingest == nil {
+		return nil, errors.New("cannot insert entries into a read-only database")
+	}
+	return stores.ingest, nil
+}
+
 // insert encrypts a credential pair and stores it in the configured KV store
 func (s *server) insert(username, password, metadata []byte, numVariants int, includeUsernameVariant bool) error {
-
-	bucketIDHex := migp.BucketIDToHex(s.migpServer.BucketID(username))
-	newEntry, err := s.migpServer.EncryptBucketEntry(username, password, migp.MetadataBreachedPassword, metadata)
+	kv, err := s.ingestStore()
 	if err != nil {
 		return err
 	}
-	err = s.kv.Append(bucketIDHex, newEntry)
+	m := s.mutator
+	if m == nil {
+		m = mutator.NewRDasMutator()
+	}
+	entries, err := ingest.Entries(s.migpServer, m, username, password, metadata, numVariants, includeUsernameVariant, false)
 	if err != nil {
 		return err
 	}
-
-	passwordVariants := mutator.NewRDasMutator().Mutate(password, numVariants)
-	for _, variant := range passwordVariants {
-		newEntry, err = s.migpServer.EncryptBucketEntry(username, variant, migp.MetadataSimilarPassword, metadata)
-		if err != nil {
-			return err
-		}
-		err = s.kv.Append(bucketIDHex, newEntry)
-		if err != nil {
-			return err
-		}
-	}
-
-	if includeUsernameVariant {
-		newEntry, err = s.migpServer.EncryptBucketEntry(username, nil, migp.MetadataBreachedUsername, metadata)
-		if err != nil {
-			return err
-		}
-		err = s.kv.Append(bucketIDHex, newEntry)
-		if err != nil {
+	bucketIDHex := migp.BucketIDToHex(s.migpServer.BucketID(username))
+	for _, entry := range entries {
+		if err := kv.Append(bucketIDHex, entry); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
@@ -116,7 +390,14 @@ func (s *server) handleEvaluate(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
 
-	migpResponse, err := s.migpServer.HandleRequest(request, s.kv)
+	kv, err := s.getter(request.KeyID)
+	if err != nil {
+		log.Println("Request for unknown key:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	migpResponse, err := s.migpServer.HandleRequest(request, kv)
 	if err != nil {
 		log.Println("HandleRequest failed:", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -135,3 +416,46 @@ func (s *server) handleEvaluate(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
+
+// handleEvaluateBatch serves a batch request from a MIGP client
+func (s *server) handleEvaluateBatch(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Println("Request body reading failed:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var request migp.ClientBatchRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		log.Println("Request body unmarshal failed:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	kv, err := s.getter(request.KeyID)
+	if err != nil {
+		log.Println("Request for unknown key:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	migpResponse, err := s.migpServer.HandleBatchRequest(request, kv)
+	if err != nil {
+		log.Println("HandleBatchRequest failed:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	respBody, err := migpResponse.MarshalBinary()
+	if err != nil {
+		log.Println("Response serialization failed:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(respBody); err != nil {
+		log.Println("Writing response failed:", err)
+	}
+}
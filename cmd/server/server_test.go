@@ -5,6 +5,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"net/http/httptest"
 	"testing"
 
@@ -57,3 +58,150 @@ func TestServer(t *testing.T) {
 		t.Fatalf("metadata: want %s, got %s", testMetadata, string(metadata))
 	}
 }
+
+// TestServerBatch checks that the batch endpoint returns results for every
+// credential in the batch
+func TestServerBatch(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	testMetadata := []byte("test metadata")
+	if err := s.insert([]byte("username1"), []byte("password1"), testMetadata, 9, true); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := []migp.Credential{
+		{Username: []byte("username1"), Password: []byte("password1")},
+		{Username: []byte("username1"), Password: nil},
+		{Username: []byte("username2"), Password: []byte("password1")},
+	}
+	expected := []migp.BreachStatus{migp.InBreach, migp.UsernameInBreach, migp.NotInBreach}
+
+	results, err := migp.QueryBatch(migp.DefaultConfig(), httpServer.URL+"/evaluate-batch", credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Errorf("status %d: want %s, got %s", i, expected[i], result.Status)
+		}
+	}
+}
+
+// TestServerPadding checks that finalized buckets are padded, including
+// buckets without entries, and that queries still succeed
+func TestServerPadding(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.Padding = migp.PaddingConfig{BucketEntries: 16, MetadataLength: 32}
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	if err := s.insert([]byte("username1"), []byte("password1"), []byte("test metadata"), 9, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.finalize(); err != nil {
+		t.Fatal(err)
+	}
+	status, metadata, err := migp.Query(cfg.Config, httpServer.URL+"/evaluate", []byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	breach, err := migp.DecodeMetadata(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != migp.InBreach || string(breach.Raw) != "test metadata" {
+		t.Errorf("got %s '%s'", status, breach.Raw)
+	}
+
+	getter, err := s.getter(cfg.KeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyID := migp.BucketIDToHex(s.migpServer.BucketID([]byte("username2")))
+	first, err := getter.Get(emptyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := getter.Get(emptyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) == 0 || !bytes.Equal(first, second) {
+		t.Errorf("empty bucket not padded consistently")
+	}
+	// the dummy entries of the empty bucket have the lengths of served
+	// entries
+	servedLengths, err := s.stores[cfg.KeyID].servedBodyLengths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyLengths, err := migp.BucketBodyLengths(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range emptyLengths {
+		found := false
+		for _, served := range servedLengths {
+			found = found || length == served
+		}
+		if !found {
+			t.Errorf("dummy body length %d not among the served lengths %v", length, servedLengths)
+		}
+	}
+	if stores := s.stores[cfg.KeyID]; len(stores.serve.Keys()) != 1 {
+		t.Errorf("want only the inserted bucket to be stored, got %d buckets", len(stores.serve.Keys()))
+	}
+
+	status, _, err = migp.Query(cfg.Config, httpServer.URL+"/evaluate", []byte("username2"), []byte("password2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != migp.NotInBreach {
+		t.Errorf("status: want %s, got %s", migp.NotInBreach, status)
+	}
+
+	// entries inserted after finalization are served once finalized again
+	if err := s.insert([]byte("username2"), []byte("password2"), nil, 9, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, wantStatus := range []migp.BreachStatus{migp.NotInBreach, migp.InBreach} {
+		status, _, err = migp.Query(cfg.Config, httpServer.URL+"/evaluate", []byte("username2"), []byte("password2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != wantStatus {
+			t.Errorf("status: want %s, got %s", wantStatus, status)
+		}
+		if err := s.finalize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestConfigFlagsDefaults checks that the configuration generated with the
+// default flags uses the library's default username canonicalizer
+func TestConfigFlagsDefaults(t *testing.T) {
+	var f configFlags
+	f.register(flag.NewFlagSet("test", flag.ContinueOnError))
+	cfg, err := f.newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UsernameCanonicalizerID != migp.DefaultUsernameCanonicalizer {
+		t.Errorf("want username canonicalizer %d, got %d", migp.DefaultUsernameCanonicalizer, cfg.UsernameCanonicalizerID)
+	}
+	for name, id := range usernameCanonicalizers {
+		if got := usernameCanonicalizerName(id); got != name {
+			t.Errorf("want name %q for username canonicalizer %d, got %q", name, id, got)
+		}
+	}
+}
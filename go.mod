@@ -6,4 +6,5 @@ require (
 	github.com/cloudflare/circl v1.1.1-0.20211202201456-cd788e30354b
 	github.com/spaolacci/murmur3 v1.1.0
 	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/text v0.3.7
 )
@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ingest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// checkpoint records the progress of an ingestion. The digest of the
+// ingested part of the input identifies the input when resuming.
+type checkpoint struct {
+	InputOffset   int64  `json:"inputOffset"`
+	InputLines    int64  `json:"inputLines"`
+	InputDigest   []byte `json:"inputDigest"`
+	StorePosition int64  `json:"storePosition"`
+	Records       int64  `json:"records"`
+	Failures      int64  `json:"failures"`
+}
+
+// tracker tracks the ingested part of the input. It is only used by the
+// committer, which ingests lines in input order.
+type tracker struct {
+	digest      hash.Hash
+	offset      int64
+	lines       int64
+	records     int64
+	failures    int64
+	totalBytes  int64
+	startOffset int64
+	startCount  int64
+	start       time.Time
+}
+
+// newTracker returns a tracker for the input. The input size is known if it
+// is a regular file.
+func newTracker(input io.Reader) *tracker {
+	t := &tracker{digest: sha256.New(), start: time.Now()}
+	if file, ok := input.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			t.totalBytes = info.Size()
+		}
+	}
+	return t
+}
+
+// commit records that a line of the input was ingested
+func (t *tracker) commit(line []byte, skipped, failed bool) {
+	t.digest.Write(line)
+	t.offset += int64(len(line))
+	t.lines++
+	if failed {
+		t.failures++
+	} else if !skipped {
+		t.records++
+	}
+}
+
+// resume skips the part of the input ingested before the checkpoint, if any,
+// and rolls back the entries appended to the store after it
+func (p *Pipeline) resume(input io.Reader, t *tracker) error {
+	if p.cfg.CheckpointFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.cfg.CheckpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("invalid checkpoint %s: %v", p.cfg.CheckpointFile, err)
+	}
+
+	if n, err := io.CopyN(t.digest, input, c.InputOffset); err == io.EOF || n < c.InputOffset {
+		return fmt.Errorf("input is shorter than the checkpointed offset %d", c.InputOffset)
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(t.digest.Sum(nil), c.InputDigest) {
+		return errors.New("input does not match the checkpoint")
+	}
+	if err := p.store.(CheckpointStore).Rollback(c.StorePosition); err != nil {
+		return err
+	}
+
+	t.offset, t.lines, t.records, t.failures = c.InputOffset, c.InputLines, c.Records, c.Failures
+	t.startOffset, t.startCount = t.offset, t.records+t.failures
+	return nil
+}
+
+// checkpoint makes the appended entries durable, then atomically replaces
+// the checkpoint file
+func (p *Pipeline) checkpoint(t *tracker) error {
+	if p.cfg.CheckpointFile == "" {
+		return nil
+	}
+	position, err := p.store.(CheckpointStore).Checkpoint()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(checkpoint{
+		InputOffset:   t.offset,
+		InputLines:    t.lines,
+		InputDigest:   t.digest.Sum(nil),
+		StorePosition: position,
+		Records:       t.records,
+		Failures:      t.failures,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpFile := p.cfg.CheckpointFile + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, p.cfg.CheckpointFile)
+}
+
+// RemoveCheckpoint removes the checkpoint file of a completed ingestion. It
+// must only be called once the ingested entries are committed: running the
+// pipeline again afterwards ingests the whole input again.
+func (p *Pipeline) RemoveCheckpoint() error {
+	if p.cfg.CheckpointFile == "" {
+		return nil
+	}
+	if err := os.Remove(p.cfg.CheckpointFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,427 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package ingest encrypts breach entries into MIGP buckets. Encrypting an
+// entry runs the server's slow hash, so a Pipeline spreads the work over a
+// pool of workers, and periodically records its position in the input in a
+// checkpoint file so that an interrupted ingestion can be resumed.
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+	"github.com/cloudflare/migp-go/pkg/mutator"
+)
+
+// Default values of the pipeline configuration
+const (
+	DefaultNumVariants        = 9
+	DefaultCheckpointInterval = time.Minute
+	DefaultProgressInterval   = 10 * time.Second
+)
+
+// Store receives the encrypted bucket entries
+type Store interface {
+	// Append a value to any existing value at key id.
+	Append(id string, value []byte) error
+}
+
+// CheckpointStore is a Store that can discard the values appended after a
+// checkpoint. It is required to resume an interrupted ingestion.
+type CheckpointStore interface {
+	Store
+	// Checkpoint makes the appended values durable, and returns the
+	// current position of the store.
+	Checkpoint() (int64, error)
+	// Rollback discards the values appended after the given position.
+	Rollback(position int64) error
+}
+
+// Config configures an ingestion pipeline
+type Config struct {
+	// Workers is the number of entries encrypted in parallel. If zero,
+	// runtime.NumCPU() is used.
+	Workers int
+	// NumVariants is the number of password variants inserted along with
+	// each credential.
+	NumVariants int
+	// IncludeUsernameVariant inserts a username-only entry for each
+	// credential.
+	IncludeUsernameVariant bool
+	// Mutator generates the password variants. If nil, an RDasMutator is
+	// used.
+	Mutator mutator.Mutator
+	// DescribeVariants stores a description of how each password variant
+	// differs from the breached password in the variant's metadata, e.g.,
+	// "trailing digits added". The mutator must be a ProvenanceMutator.
+	DescribeVariants bool
+
+	// Parser splits the lines of the input into fields. If nil, lines are
+	// parsed as <username>:<password>.
+	Parser Parser
+	// HeaderLines is the number of lines at the start of the input that
+	// are skipped, e.g., a CSV header.
+	HeaderLines int
+	// Metadata builds the metadata stored alongside the breach entries of
+	// each record.
+	Metadata MetadataTemplate
+	// Rejects, if not nil, receives the rejected lines of the input, with
+	// their line number and the reason for rejecting them, as
+	// <line number>\t<reason>\t<line>. Lines rejected after the last
+	// checkpoint of an interrupted ingestion are written again when
+	// resuming.
+	Rejects io.Writer
+
+	// CheckpointFile is the file recording the progress of the ingestion.
+	// If empty, an interrupted ingestion cannot be resumed. Otherwise, the
+	// store must be a CheckpointStore.
+	CheckpointFile string
+	// CheckpointInterval is the time between checkpoints. If zero,
+	// DefaultCheckpointInterval is used.
+	CheckpointInterval time.Duration
+
+	// Progress, if not nil, is called periodically and once the input is
+	// exhausted.
+	Progress func(Progress)
+	// ProgressInterval is the time between progress reports. If zero,
+	// DefaultProgressInterval is used.
+	ProgressInterval time.Duration
+}
+
+// DefaultConfig returns the default pipeline configuration, which matches
+// the entries inserted by the MIGP demo server
+func DefaultConfig() Config {
+	return Config{
+		NumVariants:            DefaultNumVariants,
+		IncludeUsernameVariant: true,
+	}
+}
+
+// Entries returns the bucket entries inserted for a credential: the exact
+// credential, up to numVariants password variants generated by m, and, if
+// includeUsernameVariant is set, a username-only entry. All entries belong
+// to the bucket of the username. If describeVariants is set, m must be a
+// mutator.ProvenanceMutator, and the metadata of each variant describes how
+// it differs from the password.
+func Entries(s *migp.Server, m mutator.Mutator, username, password, metadata []byte, numVariants int, includeUsernameVariant, describeVariants bool) ([][]byte, error) {
+	entry, err := s.EncryptBucketEntry(username, password, migp.MetadataBreachedPassword, metadata)
+	if err != nil {
+		return nil, err
+	}
+	entries := [][]byte{entry}
+
+	if describeVariants {
+		pm, ok := m.(mutator.ProvenanceMutator)
+		if !ok {
+			return nil, errors.New("mutator does not report the provenance of variants")
+		}
+		breach, err := migp.DecodeMetadata(metadata)
+		if err != nil {
+			return nil, err
+		}
+		for _, variant := range pm.MutateWithProvenance(password, numVariants) {
+			breach.Variation = variant.Rule.Describe()
+			variantMetadata, err := migp.EncodeMetadata(breach)
+			if err != nil {
+				return nil, err
+			}
+			entry, err = s.EncryptBucketEntry(username, variant.Password, migp.MetadataSimilarPassword, variantMetadata)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		for _, variant := range m.Mutate(password, numVariants) {
+			entry, err = s.EncryptBucketEntry(username, variant, migp.MetadataSimilarPassword, metadata)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if includeUsernameVariant {
+		entry, err = s.EncryptBucketEntry(username, nil, migp.MetadataBreachedUsername, metadata)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Pipeline encrypts the credentials of an input and appends the resulting
+// entries to a store
+type Pipeline struct {
+	server *migp.Server
+	store  Store
+	cfg    Config
+	// metadata is the encoded metadata of all records if the metadata
+	// template is static
+	metadata []byte
+}
+
+// NewPipeline returns a new pipeline appending the entries encrypted by the
+// server to the store
+func NewPipeline(s *migp.Server, store Store, cfg Config) (*Pipeline, error) {
+	if cfg.Workers < 0 || cfg.NumVariants < 0 || cfg.HeaderLines < 0 || cfg.CheckpointInterval < 0 || cfg.ProgressInterval < 0 {
+		return nil, errors.New("negative pipeline parameter")
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = runtime.NumCPU()
+	}
+	if cfg.Mutator == nil {
+		cfg.Mutator = mutator.NewRDasMutator()
+	}
+	if _, ok := cfg.Mutator.(mutator.ProvenanceMutator); cfg.DescribeVariants && !ok {
+		return nil, errors.New("describing variants requires a mutator reporting their provenance")
+	}
+	if cfg.Parser == nil {
+		parser, err := NewDelimitedParser(":", DefaultColumns)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Parser = parser
+	}
+	if cfg.CheckpointInterval == 0 {
+		cfg.CheckpointInterval = DefaultCheckpointInterval
+	}
+	if cfg.ProgressInterval == 0 {
+		cfg.ProgressInterval = DefaultProgressInterval
+	}
+	if _, ok := store.(CheckpointStore); cfg.CheckpointFile != "" && !ok {
+		return nil, errors.New("checkpoints require a store supporting rollback")
+	}
+	p := &Pipeline{server: s, store: store, cfg: cfg}
+	if cfg.Metadata.Static() {
+		metadata, err := cfg.Metadata.Expand(nil)
+		if err != nil {
+			return nil, err
+		}
+		p.metadata = metadata
+	}
+	return p, nil
+}
+
+// job is a line read from the input
+type job struct {
+	line     []byte
+	number   int64
+	bucketID string
+	entries  [][]byte
+	// err is set if the line is rejected
+	err error
+	// processed is set once the job is complete, and skipped if the line
+	// holds no record
+	processed bool
+	skipped   bool
+	done      chan struct{}
+}
+
+// Run ingests the records of the input, one per line. Header lines and empty
+// lines are skipped. Malformed lines, and records that cannot be encrypted,
+// are rejected and counted as failures. Entries are appended to the store in
+// the order of the input regardless of the number of workers.
+//
+// If the checkpoint file exists, the ingestion resumes after the last
+// checkpointed line: the input must be the same as in the interrupted run,
+// and the entries appended after the checkpoint are rolled back. Run
+// checkpoints before returning, including once the input is exhausted, but
+// does not remove the checkpoint file: call RemoveCheckpoint once the
+// ingested entries are committed, e.g., the store is finalized, so that a
+// crash before then is resumed without ingesting the input again.
+func (p *Pipeline) Run(ctx context.Context, input io.Reader) (Progress, error) {
+	tracker := newTracker(input)
+	reader := bufio.NewReaderSize(input, 1<<16)
+	if err := p.resume(reader, tracker); err != nil {
+		return tracker.progress(), err
+	}
+	if err := p.checkpoint(tracker); err != nil {
+		return tracker.progress(), err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Jobs are sent to the workers and, in input order, to the committer.
+	// The number of jobs in flight is bounded by the capacity of the
+	// committer's queue.
+	jobs := make(chan *job)
+	queue := make(chan *job, 4*p.cfg.Workers)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		readErr <- p.read(runCtx, reader, tracker.lines, jobs, queue)
+	}()
+	var workers sync.WaitGroup
+	for i := 0; i < p.cfg.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				p.encrypt(j)
+				close(j.done)
+			}
+		}()
+	}
+
+	err := p.commit(runCtx, queue, tracker)
+	cancel()
+	for range queue {
+	}
+	workers.Wait()
+	if err == nil {
+		err = <-readErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if checkpointErr := p.checkpoint(tracker); checkpointErr != nil {
+		if err == nil {
+			return tracker.progress(), checkpointErr
+		}
+		return tracker.progress(), fmt.Errorf("%v (checkpoint failed: %v)", err, checkpointErr)
+	}
+	if err != nil {
+		return tracker.progress(), err
+	}
+
+	progress := tracker.progress()
+	if p.cfg.Progress != nil {
+		p.cfg.Progress(progress)
+	}
+	return progress, nil
+}
+
+// read sends the lines of the input to the workers and the committer until
+// the input is exhausted or ctx is canceled
+func (p *Pipeline) read(ctx context.Context, reader *bufio.Reader, lines int64, jobs, queue chan<- *job) error {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) > 0 {
+			lines++
+			j := &job{line: line, number: lines, done: make(chan struct{})}
+			select {
+			case queue <- j:
+			case <-ctx.Done():
+				return nil
+			}
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				close(j.done)
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// encrypt parses the line of a job and encrypts its entries
+func (p *Pipeline) encrypt(j *job) {
+	defer func() { j.processed = true }()
+	line := trimLine(j.line)
+	if j.number <= int64(p.cfg.HeaderLines) || len(bytes.TrimSpace(line)) == 0 {
+		j.skipped = true
+		return
+	}
+	fields, err := p.cfg.Parser.Parse(line)
+	if err != nil {
+		j.err = err
+		return
+	}
+	username, ok := fields[UsernameField]
+	if !ok {
+		j.err = errors.New("missing username")
+		return
+	}
+	password, ok := fields[PasswordField]
+	if !ok {
+		j.err = errors.New("missing password")
+		return
+	}
+	metadata := p.metadata
+	if metadata == nil {
+		if metadata, err = p.cfg.Metadata.Expand(fields); err != nil {
+			j.err = err
+			return
+		}
+	}
+	entries, err := Entries(p.server, p.cfg.Mutator, []byte(username), []byte(password), metadata, p.cfg.NumVariants, p.cfg.IncludeUsernameVariant, p.cfg.DescribeVariants)
+	if err != nil {
+		j.err = err
+		return
+	}
+	j.bucketID = migp.BucketIDToHex(p.server.BucketID([]byte(username)))
+	j.entries = entries
+}
+
+// trimLine removes the line ending from a line
+func trimLine(line []byte) []byte {
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+}
+
+// commit appends the entries of the jobs to the store in input order,
+// checkpointing and reporting progress periodically. It stops at the first
+// job that was not completed when ctx is canceled.
+func (p *Pipeline) commit(ctx context.Context, queue <-chan *job, tracker *tracker) error {
+	checkpointTicker := time.NewTicker(p.cfg.CheckpointInterval)
+	defer checkpointTicker.Stop()
+	progressTicker := time.NewTicker(p.cfg.ProgressInterval)
+	defer progressTicker.Stop()
+
+	for j := range queue {
+		select {
+		case <-j.done:
+		case <-ctx.Done():
+			return nil
+		}
+		if !j.processed {
+			// The job was abandoned when ctx was canceled.
+			return nil
+		}
+		for _, entry := range j.entries {
+			if err := p.store.Append(j.bucketID, entry); err != nil {
+				return err
+			}
+		}
+		if j.err != nil && p.cfg.Rejects != nil {
+			if _, err := fmt.Fprintf(p.cfg.Rejects, "%d\t%v\t%s\n", j.number, j.err, trimLine(j.line)); err != nil {
+				return err
+			}
+		}
+		tracker.commit(j.line, j.skipped, j.err != nil)
+
+		select {
+		case <-checkpointTicker.C:
+			if err := p.checkpoint(tracker); err != nil {
+				return err
+			}
+		default:
+		}
+		select {
+		case <-progressTicker.C:
+			if p.cfg.Progress != nil {
+				p.cfg.Progress(tracker.progress())
+			}
+		default:
+		}
+	}
+	return nil
+}
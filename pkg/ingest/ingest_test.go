@@ -0,0 +1,346 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+	"github.com/cloudflare/migp-go/pkg/mutator"
+)
+
+// memStore is an in-memory CheckpointStore recording appended values in
+// order
+type memStore struct {
+	ids    []string
+	values [][]byte
+}
+
+func (m *memStore) Append(id string, value []byte) error {
+	m.ids = append(m.ids, id)
+	m.values = append(m.values, value)
+	return nil
+}
+
+func (m *memStore) Checkpoint() (int64, error) {
+	return int64(len(m.values)), nil
+}
+
+func (m *memStore) Rollback(position int64) error {
+	if position > int64(len(m.values)) {
+		return errors.New("invalid position")
+	}
+	m.ids, m.values = m.ids[:position], m.values[:position]
+	return nil
+}
+
+// failingReader returns an error after reading n bytes
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("read failed")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+const testInput = "username1:password1\nmalformed\nusername2:password2\r\nusername3:password3\nusername4:password4"
+
+// sequentialStore returns the entries of testInput inserted one at a time
+func sequentialStore(t *testing.T, s *migp.Server, cfg Config) *memStore {
+	metadata, err := cfg.Metadata.Expand(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := new(memStore)
+	for _, line := range strings.Split(testInput, "\n") {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\r"), ":", 2)
+		if len(fields) < 2 {
+			continue
+		}
+		entries, err := Entries(s, mutator.NewRDasMutator(), []byte(fields[0]), []byte(fields[1]), metadata, cfg.NumVariants, cfg.IncludeUsernameVariant, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			store.Append(migp.BucketIDToHex(s.BucketID([]byte(fields[0]))), entry)
+		}
+	}
+	return store
+}
+
+// checkStore checks that the store holds the wanted entries in order
+func checkStore(t *testing.T, want, got *memStore) {
+	t.Helper()
+	if len(want.values) != len(got.values) {
+		t.Fatalf("want %d entries, got %d", len(want.values), len(got.values))
+	}
+	for i := range want.values {
+		if want.ids[i] != got.ids[i] || !bytes.Equal(want.values[i], got.values[i]) {
+			t.Fatalf("entry %d differs from sequential ingestion", i)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	s, err := migp.NewServer(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Workers: 4, NumVariants: 2, IncludeUsernameVariant: true, Metadata: MetadataTemplate{Raw: "metadata"}}
+	want := sequentialStore(t, s, cfg)
+
+	var reports []Progress
+	cfg.Progress = func(p Progress) { reports = append(reports, p) }
+	store := new(memStore)
+	pipeline, err := NewPipeline(s, store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, err := pipeline.Run(context.Background(), strings.NewReader(testInput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, want, store)
+	if progress.Records != 4 || progress.Failures != 1 || progress.BytesRead != int64(len(testInput)) {
+		t.Errorf("unexpected progress: %+v", progress)
+	}
+	if len(reports) == 0 || reports[len(reports)-1] != progress {
+		t.Errorf("final progress was not reported")
+	}
+
+	if _, err := NewPipeline(s, struct{ Store }{store}, Config{CheckpointFile: "checkpoint"}); err == nil {
+		t.Errorf("expected checkpoints without rollback support to fail")
+	}
+}
+
+func TestPipelineRejects(t *testing.T) {
+	s, err := migp.NewServer(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := NewCSVParser(',', []string{"username", "password", "breach"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejects strings.Builder
+	store := new(memStore)
+	pipeline, err := NewPipeline(s, store, Config{
+		Workers:     2,
+		Parser:      parser,
+		HeaderLines: 1,
+		Metadata:    MetadataTemplate{Name: "{breach}"},
+		Rejects:     &rejects,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "username,password,breach\nusername1,password1,First\n\nusername2\nusername3,\"password3\nusername4,password4,Second\n"
+	progress, err := pipeline.Run(context.Background(), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Records != 2 || progress.Failures != 2 {
+		t.Errorf("unexpected progress: %+v", progress)
+	}
+	wantRejects := "4\texpected 3 fields, got 1\tusername2\n5\t"
+	if !strings.HasPrefix(rejects.String(), wantRejects) || !strings.HasSuffix(rejects.String(), "\tusername3,\"password3\n") {
+		t.Errorf("unexpected rejects %q", rejects.String())
+	}
+
+	// each record has its own metadata
+	want := new(memStore)
+	for _, record := range [][3]string{{"username1", "password1", "First"}, {"username4", "password4", "Second"}} {
+		metadata, err := migp.EncodeMetadata(migp.BreachMetadata{Name: record[2]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := Entries(s, mutator.NewRDasMutator(), []byte(record[0]), []byte(record[1]), metadata, 0, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want.Append(migp.BucketIDToHex(s.BucketID([]byte(record[0]))), entries[0])
+	}
+	checkStore(t, want, store)
+}
+
+func TestPipelineResume(t *testing.T) {
+	s, err := migp.NewServer(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpointFile := filepath.Join(t.TempDir(), "ingest.checkpoint")
+	cfg := Config{Workers: 3, NumVariants: 2, CheckpointFile: checkpointFile}
+	want := sequentialStore(t, s, cfg)
+
+	// Interrupt the ingestion within the third line, then append entries
+	// after the checkpoint as if the process crashed while appending.
+	store := new(memStore)
+	pipeline, err := NewPipeline(s, store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted := &failingReader{strings.NewReader(testInput), strings.Index(testInput, "username2") + 3}
+	progress, err := pipeline.Run(context.Background(), interrupted)
+	if err == nil {
+		t.Fatal("expected the interrupted ingestion to fail")
+	}
+	if progress.Records != 1 || progress.Failures != 1 {
+		t.Errorf("unexpected progress: %+v", progress)
+	}
+	if _, err := os.Stat(checkpointFile); err != nil {
+		t.Fatalf("checkpoint was not written: %v", err)
+	}
+	store.Append("00000", []byte("partial"))
+
+	// Resuming with a different input fails
+	if _, err := pipeline.Run(context.Background(), strings.NewReader("username1:password2\n")); err == nil {
+		t.Errorf("expected resuming with a different input to fail")
+	}
+
+	// Cancellation checkpoints the ingested lines
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pipeline.Run(ctx, strings.NewReader(testInput)); err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+
+	progress, err = pipeline.Run(context.Background(), strings.NewReader(testInput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, want, store)
+	if progress.Records != 4 || progress.Failures != 1 {
+		t.Errorf("unexpected progress: %+v", progress)
+	}
+
+	// The completed ingestion stays checkpointed until the checkpoint is
+	// removed, so running it again, e.g., after a crash before the store was
+	// finalized, ingests nothing.
+	if _, err := os.Stat(checkpointFile); err != nil {
+		t.Fatalf("checkpoint of the completed ingestion was removed: %v", err)
+	}
+	if _, err := pipeline.Run(context.Background(), strings.NewReader(testInput)); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, want, store)
+	if err := pipeline.RemoveCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("checkpoint was not removed: %v", err)
+	}
+}
+
+// Get returns the concatenated values appended at key id
+func (m *memStore) Get(id string) ([]byte, error) {
+	var bucket []byte
+	for i := range m.ids {
+		if m.ids[i] == id {
+			bucket = append(bucket, m.values[i]...)
+		}
+	}
+	return bucket, nil
+}
+
+// TestEntriesDescribeVariants tests that the metadata of password variants
+// describes how they differ from the breached password
+func TestEntriesDescribeVariants(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	s, err := migp.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mutator.NewRDasMutatorFromRules([]mutator.RDasRule{
+		{RuleType: "c", Position: 0},
+		{RuleType: "i", Position: -1, String1: "12"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := migp.EncodeMetadata(migp.BreachMetadata{Name: "Example Breach"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := []byte("username")
+	entries, err := Entries(s, m, username, []byte("password"), metadata, 2, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := new(memStore)
+	for _, entry := range entries {
+		store.Append(migp.BucketIDToHex(s.BucketID(username)), entry)
+	}
+
+	client, err := migp.NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		password  string
+		status    migp.BreachStatus
+		variation string
+	}{
+		{"password", migp.InBreach, ""},
+		{"Password", migp.SimilarInBreach, "capitalization differs"},
+		{"password12", migp.SimilarInBreach, "trailing digits added"},
+	} {
+		request, finalize, err := client.Request(username, []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := s.HandleRequest(request, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, data, err := finalize.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		breach, err := migp.DecodeMetadata(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status || breach.Name != "Example Breach" || breach.Variation != test.variation {
+			t.Errorf("%s: want %s %q, got %s %+v", test.password, test.status, test.variation, status, breach)
+		}
+	}
+
+	hashcat, err := mutator.NewHashcatMutatorFromRules([]string{"c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPipeline(s, new(memStore), Config{Mutator: hashcat, DescribeVariants: true}); err == nil {
+		t.Errorf("expected describing variants without provenance to fail")
+	}
+}
+
+func TestProgressString(t *testing.T) {
+	for _, test := range []struct {
+		progress Progress
+		want     string
+	}{
+		{Progress{Records: 10, Failures: 2, Rate: 1.5}, "10 records, 2 failures, 1.5 records/s"},
+		{Progress{Records: 10, BytesRead: 25, TotalBytes: 100, Rate: 2, ETA: 90e9}, "10 records, 0 failures, 2.0 records/s, 25.0% of input, ETA 1m30s"},
+	} {
+		if got := test.progress.String(); got != test.want {
+			t.Errorf("want %q, got %q", test.want, got)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ingest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Names of the fields holding the credential of a record
+const (
+	UsernameField = "username"
+	PasswordField = "password"
+)
+
+// Parser splits a line of the input into named fields. The username and
+// password of a record are in the UsernameField and PasswordField fields,
+// and other fields may be referenced by metadata templates. Parsers must be
+// safe for concurrent use.
+type Parser interface {
+	Parse(line []byte) (map[string]string, error)
+}
+
+// DefaultColumns are the columns of a <username>:<password> combolist
+var DefaultColumns = []string{UsernameField, PasswordField}
+
+// DelimitedParser parses lines of fields separated by a delimiter, e.g., a
+// combolist. The last column holds the rest of the line, so that it may
+// contain the delimiter.
+type DelimitedParser struct {
+	delimiter []byte
+	columns   []string
+}
+
+// NewDelimitedParser returns a parser for lines of fields separated by
+// delimiter. The fields are named after the columns in order, and columns
+// with an empty name are ignored.
+func NewDelimitedParser(delimiter string, columns []string) (*DelimitedParser, error) {
+	if delimiter == "" {
+		return nil, errors.New("empty delimiter")
+	}
+	if err := checkColumns(columns); err != nil {
+		return nil, err
+	}
+	return &DelimitedParser{delimiter: []byte(delimiter), columns: columns}, nil
+}
+
+// Parse splits the line into fields
+func (p *DelimitedParser) Parse(line []byte) (map[string]string, error) {
+	values := bytes.SplitN(line, p.delimiter, len(p.columns))
+	if len(values) < len(p.columns) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(p.columns), len(values))
+	}
+	fields := make(map[string]string, len(p.columns))
+	for i, column := range p.columns {
+		if column != "" {
+			fields[column] = string(values[i])
+		}
+	}
+	return fields, nil
+}
+
+// CSVParser parses lines of comma-separated values as defined in RFC 4180.
+// Quoted fields cannot span lines.
+type CSVParser struct {
+	comma   rune
+	columns []string
+}
+
+// NewCSVParser returns a parser for lines of values separated by comma. The
+// fields are named after the columns in order, and columns with an empty
+// name are ignored. Additional values are ignored.
+func NewCSVParser(comma rune, columns []string) (*CSVParser, error) {
+	if comma == '"' || comma == '\r' || comma == '\n' {
+		return nil, fmt.Errorf("invalid CSV separator %q", comma)
+	}
+	if err := checkColumns(columns); err != nil {
+		return nil, err
+	}
+	return &CSVParser{comma: comma, columns: columns}, nil
+}
+
+// Parse splits the line into fields
+func (p *CSVParser) Parse(line []byte) (map[string]string, error) {
+	reader := csv.NewReader(bytes.NewReader(line))
+	reader.Comma = p.comma
+	reader.FieldsPerRecord = -1
+	values, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < len(p.columns) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(p.columns), len(values))
+	}
+	fields := make(map[string]string, len(p.columns))
+	for i, column := range p.columns {
+		if column != "" {
+			fields[column] = values[i]
+		}
+	}
+	return fields, nil
+}
+
+// JSONParser parses lines holding a JSON object, i.e., JSON Lines
+type JSONParser struct {
+	paths map[string][]string
+}
+
+// NewJSONParser returns a parser for JSON objects. Each field is read from
+// the value at the given dot-separated path, e.g., "breach.name". Numbers
+// and booleans are converted to strings, and arrays are joined with commas.
+// Fields with a missing or null value are omitted.
+func NewJSONParser(paths map[string]string) (*JSONParser, error) {
+	p := &JSONParser{paths: make(map[string][]string, len(paths))}
+	for field, path := range paths {
+		if field == "" || path == "" {
+			return nil, fmt.Errorf("invalid JSON field mapping %q=%q", field, path)
+		}
+		p.paths[field] = strings.Split(path, ".")
+	}
+	if p.paths[UsernameField] == nil || p.paths[PasswordField] == nil {
+		return nil, fmt.Errorf("fields must include %q and %q", UsernameField, PasswordField)
+	}
+	return p, nil
+}
+
+// Parse reads the fields from the JSON object
+func (p *JSONParser) Parse(line []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(p.paths))
+	for field, path := range p.paths {
+		var value interface{} = object
+		for _, key := range path {
+			if parent, ok := value.(map[string]interface{}); ok {
+				value = parent[key]
+			} else {
+				value = nil
+			}
+		}
+		if value == nil {
+			continue
+		}
+		s, err := jsonString(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", field, err)
+		}
+		fields[field] = s
+	}
+	return fields, nil
+}
+
+// jsonString converts a JSON scalar or array of scalars to a string
+func jsonString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		elements := make([]string, len(v))
+		for i, element := range v {
+			if _, ok := element.([]interface{}); ok {
+				return "", errors.New("nested arrays are not supported")
+			}
+			s, err := jsonString(element)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = s
+		}
+		return strings.Join(elements, ","), nil
+	default:
+		return "", errors.New("objects are not supported")
+	}
+}
+
+// checkColumns checks that the columns include the username and password
+// and have distinct names
+func checkColumns(columns []string) error {
+	seen := make(map[string]bool)
+	for _, column := range columns {
+		if column != "" && seen[column] {
+			return fmt.Errorf("duplicate column %q", column)
+		}
+		seen[column] = true
+	}
+	if !seen[UsernameField] || !seen[PasswordField] {
+		return fmt.Errorf("columns must include %q and %q", UsernameField, PasswordField)
+	}
+	return nil
+}
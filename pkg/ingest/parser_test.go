@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ingest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsers(t *testing.T) {
+	combolist, err := NewDelimitedParser(":", DefaultColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tabs, err := NewDelimitedParser("\t", []string{"breach", "", "username", "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvParser, err := NewCSVParser(';', []string{"username", "password", "breach"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonParser, err := NewJSONParser(map[string]string{
+		"username": "email",
+		"password": "credentials.password",
+		"breach":   "source.name",
+		"classes":  "source.classes",
+		"year":     "source.year",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		parser Parser
+		line   string
+		want   map[string]string
+	}{
+		{combolist, "user:pass:word", map[string]string{"username": "user", "password": "pass:word"}},
+		{combolist, "user:", map[string]string{"username": "user", "password": ""}},
+		{combolist, "user", nil},
+		{tabs, "breach\tignored\tuser\tpass\tword", map[string]string{"breach": "breach", "username": "user", "password": "pass\tword"}},
+		{tabs, "breach\tuser\tpass", nil},
+		{csvParser, `user;"pa;""ss";breach;extra`, map[string]string{"username": "user", "password": `pa;"ss`, "breach": "breach"}},
+		{csvParser, `user;"pass`, nil},
+		{csvParser, `user;pass`, nil},
+		{jsonParser, `{"email": "user", "credentials": {"password": "pass"}, "source": {"name": "breach", "classes": ["a", "b"], "year": 2021}}`,
+			map[string]string{"username": "user", "password": "pass", "breach": "breach", "classes": "a,b", "year": "2021"}},
+		{jsonParser, `{"email": "user", "credentials": {"password": "pass"}, "source": null}`, map[string]string{"username": "user", "password": "pass"}},
+		{jsonParser, `{"email": "user", "credentials": {"password": {"nested": 1}}}`, nil},
+		{jsonParser, `{"email": "user"`, nil},
+	} {
+		fields, err := test.parser.Parse([]byte(test.line))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected parsing to fail", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+		} else if !reflect.DeepEqual(fields, test.want) {
+			t.Errorf("%q: want %v, got %v", test.line, test.want, fields)
+		}
+	}
+
+	if _, err := NewDelimitedParser(":", []string{"username", "email"}); err == nil {
+		t.Errorf("expected columns without a password to fail")
+	}
+	if _, err := NewCSVParser(',', []string{"username", "password", "username"}); err == nil {
+		t.Errorf("expected duplicate columns to fail")
+	}
+	if _, err := NewJSONParser(map[string]string{"username": "email"}); err == nil {
+		t.Errorf("expected fields without a password to fail")
+	}
+	if _, err := NewCSVParser('"', DefaultColumns); err == nil {
+		t.Errorf("expected an invalid separator to fail")
+	}
+}
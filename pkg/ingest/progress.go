@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ingest
+
+import (
+	"fmt"
+	"time"
+)
+
+// Progress reports the progress of an ingestion. Counts include the part of
+// the input ingested before resuming, while the rate and ETA only depend on
+// the current run.
+type Progress struct {
+	// Records is the number of credentials ingested.
+	Records int64
+	// Failures is the number of lines skipped because they are malformed
+	// or could not be encrypted.
+	Failures int64
+	// BytesRead is the number of bytes of the input ingested.
+	BytesRead int64
+	// TotalBytes is the size of the input, or zero if unknown.
+	TotalBytes int64
+	// Elapsed is the duration of the current run.
+	Elapsed time.Duration
+	// Rate is the number of lines ingested per second.
+	Rate float64
+	// ETA is the estimated time until the input is exhausted, or zero if
+	// unknown.
+	ETA time.Duration
+}
+
+// progress returns the current progress of the ingestion
+func (t *tracker) progress() Progress {
+	p := Progress{
+		Records:    t.records,
+		Failures:   t.failures,
+		BytesRead:  t.offset,
+		TotalBytes: t.totalBytes,
+		Elapsed:    time.Since(t.start),
+	}
+	seconds := p.Elapsed.Seconds()
+	if seconds <= 0 {
+		return p
+	}
+	p.Rate = float64(t.records+t.failures-t.startCount) / seconds
+	if byteRate := float64(t.offset-t.startOffset) / seconds; byteRate > 0 && t.totalBytes > t.offset {
+		p.ETA = time.Duration(float64(t.totalBytes-t.offset) / byteRate * float64(time.Second))
+	}
+	return p
+}
+
+// String returns a one-line summary of the progress
+func (p Progress) String() string {
+	s := fmt.Sprintf("%d records, %d failures, %.1f records/s", p.Records, p.Failures, p.Rate)
+	if p.TotalBytes > 0 {
+		s += fmt.Sprintf(", %.1f%% of input", 100*float64(p.BytesRead)/float64(p.TotalBytes))
+	}
+	if p.ETA > 0 {
+		s += fmt.Sprintf(", ETA %s", p.ETA.Round(time.Second))
+	}
+	return s
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// MetadataTemplate builds the breach metadata of a record. Its values may
+// reference the fields of the record as {field}, and "{{" and "}}" stand
+// for literal braces. DataClasses is a comma-separated list.
+type MetadataTemplate struct {
+	Name        string
+	Date        string
+	DataClasses string
+	SourceURL   string
+	Raw         string
+}
+
+// Static reports whether the template does not reference any field, in
+// which case all records have the same metadata
+func (t MetadataTemplate) Static() bool {
+	for _, value := range t.values() {
+		if strings.ContainsAny(value, "{}") {
+			return false
+		}
+	}
+	return true
+}
+
+// Expand returns the encoded metadata of a record with the given fields
+func (t MetadataTemplate) Expand(fields map[string]string) ([]byte, error) {
+	values := t.values()
+	for i := range values {
+		value, err := expand(values[i], fields)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	metadata := migp.BreachMetadata{
+		Name:      values[0],
+		Date:      values[1],
+		SourceURL: values[3],
+		Raw:       []byte(values[4]),
+	}
+	if values[2] != "" {
+		metadata.DataClasses = strings.Split(values[2], ",")
+	}
+	return migp.EncodeMetadata(metadata)
+}
+
+// values returns the values of the template in the order of its fields
+func (t MetadataTemplate) values() []string {
+	return []string{t.Name, t.Date, t.DataClasses, t.SourceURL, t.Raw}
+}
+
+// expand replaces the field references in s with the values of the fields
+func expand(s string, fields map[string]string) (string, error) {
+	var b strings.Builder
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "{}")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+		if strings.HasPrefix(s, "{{") || strings.HasPrefix(s, "}}") {
+			b.WriteByte(s[0])
+			s = s[2:]
+			continue
+		}
+		if s[0] == '}' {
+			return "", errors.New("unmatched '}' in metadata template")
+		}
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", errors.New("unterminated field reference in metadata template")
+		}
+		value, ok := fields[s[1:end]]
+		if !ok {
+			return "", fmt.Errorf("missing field %q", s[1:end])
+		}
+		b.WriteString(value)
+		s = s[end+1:]
+	}
+	return b.String(), nil
+}
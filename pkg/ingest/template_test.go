@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ingest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+func TestMetadataTemplate(t *testing.T) {
+	fields := map[string]string{"breach": "Example", "year": "2021", "classes": "email,password"}
+	template := MetadataTemplate{
+		Name:        "{breach} {{{year}}}",
+		Date:        "{year}-01-01",
+		DataClasses: "{classes}",
+		SourceURL:   "https://example.com",
+	}
+	if template.Static() {
+		t.Errorf("template referencing fields should not be static")
+	}
+	encoded, err := template.Expand(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := migp.DecodeMetadata(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := migp.BreachMetadata{
+		Name:        "Example {2021}",
+		Date:        "2021-01-01",
+		DataClasses: []string{"email", "password"},
+		SourceURL:   "https://example.com",
+	}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("want %+v, got %+v", want, metadata)
+	}
+
+	// a static template with only raw metadata keeps the legacy encoding
+	static := MetadataTemplate{Raw: "raw metadata"}
+	if !static.Static() {
+		t.Errorf("template without field references should be static")
+	}
+	if encoded, err := static.Expand(nil); err != nil || string(encoded) != "raw metadata" {
+		t.Errorf("want %q, got %q (%v)", "raw metadata", encoded, err)
+	}
+
+	for _, invalid := range []MetadataTemplate{
+		{Name: "{missing}"},
+		{Name: "{breach"},
+		{Name: "breach}"},
+		{Date: "{breach}"},
+	} {
+		if _, err := invalid.Expand(fields); err == nil {
+			t.Errorf("%+v: expected expansion to fail", invalid)
+		}
+	}
+}
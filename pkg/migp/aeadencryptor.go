@@ -0,0 +1,199 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	BucketEncryptorAES256GCM        uint16 = 0x0002
+	BucketEncryptorChaCha20Poly1305 uint16 = 0x0003
+
+	// aeadKeySize is the size of the derived MAC and AEAD keys in bytes
+	aeadKeySize = 32
+)
+
+var (
+	DeriveAEADHeaderKeySalt = []byte("MIGP derive AEAD header key")
+	DeriveAEADBodyKeySalt   = []byte("MIGP derive AEAD body key")
+
+	// ErrIntegrity is returned when a bucket entry fails authentication,
+	// which means it was corrupted or tampered with.
+	ErrIntegrity = errors.New("bucket entry failed integrity check")
+)
+
+// aeadBucketEncryptor implements BucketEncryptor with an HMAC-SHA256
+// authenticated header and an AEAD-encrypted body
+type aeadBucketEncryptor struct {
+	id      uint16
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewAES256GCMBucketEncryptor returns a BucketEncryptor that authenticates the
+// entry header with HMAC-SHA256 and encrypts the body with AES-256-GCM
+func NewAES256GCMBucketEncryptor() aeadBucketEncryptor {
+	return aeadBucketEncryptor{
+		id: BucketEncryptorAES256GCM,
+		newAEAD: func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		},
+	}
+}
+
+// NewChaCha20Poly1305BucketEncryptor returns a BucketEncryptor that
+// authenticates the entry header with HMAC-SHA256 and encrypts the body with
+// ChaCha20-Poly1305
+func NewChaCha20Poly1305BucketEncryptor() aeadBucketEncryptor {
+	return aeadBucketEncryptor{
+		id:      BucketEncryptorChaCha20Poly1305,
+		newAEAD: chacha20poly1305.New,
+	}
+}
+
+// ID returns the aeadBucketEncryptor identifier
+func (h aeadBucketEncryptor) ID() uint16 {
+	return h.id
+}
+
+// Encrypt encrypts the input (metadataFlag || metadata) using the input secret.
+// The header keeps the layout of the other bucket encryptors, but its key
+// check is a MAC over the encrypted flag and the body length, so that both
+// are authenticated. The body is sealed with the AEAD under a random nonce,
+// with the header as associated data so that it cannot be moved to another
+// entry's header. Output format:
+//
+//	HMAC(<headerKey>, <encrypted flag> | <4-byte body length>)[:20] | XOR(<1-byte flag>, <flagPad>) | <4-byte body length> | <nonce> | AEAD(<body>, <header>)
+func (h aeadBucketEncryptor) Encrypt(secret []byte, flag MetadataType, body []byte) ([]byte, error) {
+	return h.encryptWithRand(secret, flag, body, rand.Reader)
+}
+
+// encryptWithRand is like Encrypt, but draws the nonce from rnd
+func (h aeadBucketEncryptor) encryptWithRand(secret []byte, flag MetadataType, body []byte, rnd io.Reader) ([]byte, error) {
+	macKey, flagPad, err := h.deriveHeaderKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := h.deriveAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyLength := aead.NonceSize() + len(body) + aead.Overhead()
+	if uint64(bodyLength) > 1<<32-1 {
+		return nil, errors.New("bucket entry body too long")
+	}
+
+	ciphertext := make([]byte, HeaderSize+aead.NonceSize(), HeaderSize+bodyLength)
+	ciphertext[CtxtKeyCheckSize] = byte(flag) ^ flagPad
+	binary.BigEndian.PutUint32(ciphertext[CtxtKeyCheckSize+1:HeaderSize], uint32(bodyLength))
+	copy(ciphertext, headerMAC(macKey, ciphertext[CtxtKeyCheckSize:HeaderSize]))
+
+	nonce := ciphertext[HeaderSize:]
+	if _, err := io.ReadFull(rnd, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(ciphertext, nonce, body, ciphertext[:HeaderSize]), nil
+}
+
+// DecryptHeader checks the header MAC using the input secret and decrypts the
+// metadata flag. The key check fails both when the entry was encrypted under a
+// different secret and when the flag or body length were modified.
+func (h aeadBucketEncryptor) DecryptHeader(secret []byte, ciphertext []byte) (bool, MetadataType, int, error) {
+	// key check bytes + 1-byte flag + 4-byte metadata length
+	if len(ciphertext) < HeaderSize {
+		return false, 0, 0, errors.New("ciphertext of insufficient length to parse header")
+	}
+
+	macKey, flagPad, err := h.deriveHeaderKeys(secret)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	keyCheck := hmac.Equal(headerMAC(macKey, ciphertext[CtxtKeyCheckSize:HeaderSize]), ciphertext[:CtxtKeyCheckSize])
+	flag := MetadataType(ciphertext[CtxtKeyCheckSize] ^ flagPad)
+
+	// body length is in plaintext
+	bodyLength := int(binary.BigEndian.Uint32(ciphertext[CtxtKeyCheckSize+1 : HeaderSize]))
+
+	return keyCheck, flag, bodyLength, nil
+}
+
+// DecryptBody opens an AEAD-encrypted body without associated data. Since
+// Encrypt binds each body to its entry header, bodies of bucket entries fail
+// authentication here and must be opened with DecryptBodyWithHeader.
+func (h aeadBucketEncryptor) DecryptBody(secret []byte, ciphertext []byte) ([]byte, error) {
+	return h.DecryptBodyWithHeader(secret, nil, ciphertext)
+}
+
+// DecryptBodyWithHeader opens the AEAD-encrypted entry body using the input
+// secret and the entry header, returning ErrIntegrity if authentication fails
+func (h aeadBucketEncryptor) DecryptBodyWithHeader(secret []byte, header []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := h.deriveAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrIntegrity
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	return body, nil
+}
+
+// deriveHeaderKeys derives the header MAC key and the pad encrypting the flag
+func (h aeadBucketEncryptor) deriveHeaderKeys(secret []byte) ([]byte, byte, error) {
+	keys, err := h.deriveKey(secret, DeriveAEADHeaderKeySalt, aeadKeySize+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	return keys[:aeadKeySize], keys[aeadKeySize], nil
+}
+
+// deriveAEAD derives the body key and returns the corresponding AEAD
+func (h aeadBucketEncryptor) deriveAEAD(secret []byte) (cipher.AEAD, error) {
+	key, err := h.deriveKey(secret, DeriveAEADBodyKeySalt, aeadKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return h.newAEAD(key)
+}
+
+// deriveKey derives key material from the secret with HKDF-SHA256, binding it
+// to the encryptor ID so that the two AEADs never share keys
+func (h aeadBucketEncryptor) deriveKey(secret, salt []byte, length int) ([]byte, error) {
+	info := make([]byte, 2)
+	binary.BigEndian.PutUint16(info, h.id)
+	key := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// headerMAC computes the truncated HMAC-SHA256 of the encrypted flag and body
+// length, which serves as the key check of an AEAD bucket entry
+func headerMAC(key, header []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	return mac.Sum(nil)[:CtxtKeyCheckSize]
+}
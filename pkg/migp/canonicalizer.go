@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// UsernameCanonicalizerNull uses usernames as is
+	UsernameCanonicalizerNull uint16 = 0x0000
+	// UsernameCanonicalizerEmail trims surrounding whitespace and lowercases
+	// usernames, e.g., email addresses
+	UsernameCanonicalizerEmail uint16 = 0x0001
+	// UsernameCanonicalizerNFKC applies Unicode NFKC normalization
+	UsernameCanonicalizerNFKC uint16 = 0x0002
+	// UsernameCanonicalizerNFKCEmail applies Unicode NFKC normalization,
+	// then email canonicalization
+	UsernameCanonicalizerNFKCEmail uint16 = 0x0003
+	// UsernameCanonicalizerPhone normalizes international phone numbers to
+	// the E.164 format, and applies NFKC and email canonicalization to other
+	// usernames
+	UsernameCanonicalizerPhone uint16 = 0x0004
+)
+
+// maxE164Digits is the maximum number of digits of an E.164 phone number
+const maxE164Digits = 15
+
+// UsernameCanonicalizer maps the different spellings of a username to the
+// same canonical form before it is hashed into a bucket ID and bucket entry
+// key. Clients and servers must use the same canonicalizer.
+type UsernameCanonicalizer interface {
+	ID() uint16
+	Canonicalize([]byte) []byte
+}
+
+// canonicalizer implements UsernameCanonicalizer with a function
+type canonicalizer struct {
+	id           uint16
+	canonicalize func([]byte) []byte
+}
+
+// ID returns the identifier of this canonicalizer
+func (c canonicalizer) ID() uint16 {
+	return c.id
+}
+
+// Canonicalize returns the canonical form of a username
+func (c canonicalizer) Canonicalize(username []byte) []byte {
+	return c.canonicalize(username)
+}
+
+// NewUsernameCanonicalizer returns a username canonicalizer given its ID
+func NewUsernameCanonicalizer(id uint16) (UsernameCanonicalizer, error) {
+	switch id {
+	case UsernameCanonicalizerNull:
+		return canonicalizer{id, func(username []byte) []byte { return username }}, nil
+	case UsernameCanonicalizerEmail:
+		return canonicalizer{id, canonicalizeEmail}, nil
+	case UsernameCanonicalizerNFKC:
+		return canonicalizer{id, norm.NFKC.Bytes}, nil
+	case UsernameCanonicalizerNFKCEmail:
+		return canonicalizer{id, func(username []byte) []byte {
+			return canonicalizeEmail(norm.NFKC.Bytes(username))
+		}}, nil
+	case UsernameCanonicalizerPhone:
+		return canonicalizer{id, func(username []byte) []byte {
+			username = norm.NFKC.Bytes(username)
+			if phone, ok := canonicalizePhone(username); ok {
+				return phone
+			}
+			return canonicalizeEmail(username)
+		}}, nil
+	default:
+		return nil, errors.New("unsupported username canonicalizer")
+	}
+}
+
+// canonicalizeEmail trims surrounding whitespace and lowercases a username
+func canonicalizeEmail(username []byte) []byte {
+	return bytes.ToLower(bytes.TrimSpace(username))
+}
+
+// canonicalizePhone returns the E.164 form, +<digits>, of an international
+// phone number, i.e., a number starting with + or 00 followed by the country
+// code. Spaces, dashes, dots and parentheses are allowed between digits.
+// ok is false if the username is not such a phone number.
+func canonicalizePhone(username []byte) (phone []byte, ok bool) {
+	username = bytes.TrimSpace(username)
+	switch {
+	case bytes.HasPrefix(username, []byte("+")):
+		username = username[1:]
+	case bytes.HasPrefix(username, []byte("00")):
+		username = username[2:]
+	default:
+		return nil, false
+	}
+
+	phone = []byte{'+'}
+	for _, c := range username {
+		switch {
+		case c >= '0' && c <= '9':
+			phone = append(phone, c)
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return nil, false
+		}
+	}
+	// Country codes do not start with 0.
+	if len(phone) < 2 || len(phone)-1 > maxE164Digits || phone[1] == '0' {
+		return nil, false
+	}
+	return phone, true
+}
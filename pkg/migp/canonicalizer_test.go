@@ -0,0 +1,50 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"testing"
+)
+
+func TestUsernameCanonicalizers(t *testing.T) {
+	for _, test := range []struct {
+		id       uint16
+		username string
+		want     string
+	}{
+		{UsernameCanonicalizerNull, " Alice@Example.com", " Alice@Example.com"},
+		{UsernameCanonicalizerEmail, " Alice@Example.com\t", "alice@example.com"},
+		{UsernameCanonicalizerEmail, "ＡＬＩＣＥ", "ａｌｉｃｅ"},
+		{UsernameCanonicalizerNFKC, "ＡＬＩＣＥ", "ALICE"},
+		{UsernameCanonicalizerNFKC, "é", "é"},
+		{UsernameCanonicalizerNFKCEmail, " ＡＬＩＣＥ@Example.com", "alice@example.com"},
+		{UsernameCanonicalizerPhone, "+1 (555) 123-4567", "+15551234567"},
+		{UsernameCanonicalizerPhone, "0044 20.7946.0018", "+442079460018"},
+		{UsernameCanonicalizerPhone, "＋３３ ６１２３４５６７８", "+33612345678"},
+		{UsernameCanonicalizerPhone, "555-1234", "555-1234"},
+		{UsernameCanonicalizerPhone, "+0123", "+0123"},
+		{UsernameCanonicalizerPhone, "+1234567890123456", "+1234567890123456"},
+		{UsernameCanonicalizerPhone, "+1 555 CALL", "+1 555 call"},
+		{UsernameCanonicalizerPhone, "Alice@Example.com", "alice@example.com"},
+	} {
+		c, err := NewUsernameCanonicalizer(test.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ID() != test.id {
+			t.Errorf("want ID %d, got %d", test.id, c.ID())
+		}
+		got := string(c.Canonicalize([]byte(test.username)))
+		if got != test.want {
+			t.Errorf("canonicalizer %d: %q: want %q, got %q", test.id, test.username, test.want, got)
+		}
+		if again := string(c.Canonicalize([]byte(got))); again != got {
+			t.Errorf("canonicalizer %d: %q is not canonical: got %q", test.id, got, again)
+		}
+	}
+
+	if _, err := NewUsernameCanonicalizer(0xffff); err == nil {
+		t.Errorf("expected an unsupported canonicalizer to fail")
+	}
+}
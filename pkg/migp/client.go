@@ -4,12 +4,9 @@
 package migp
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 
 	"github.com/cloudflare/circl/oprf"
 )
@@ -21,14 +18,18 @@ type Client struct {
 	bucketHasher    BucketHasher
 	bucketEncryptor BucketEncryptor
 	slowHasher      SlowHasher
+	canonicalizer   UsernameCanonicalizer
 	oprfClient      *oprf.Client
 	oprfSuite       oprf.SuiteID
+	oprfMode        oprf.Mode
+	keyID           uint32
 }
 
 // ClientRequest carries the information the server needs to perform an
 // evaluation
 type ClientRequest struct {
 	Version      uint32 `json:"version"`
+	KeyID        uint32 `json:"keyID"`
 	BucketID     string `json:"bucketID"`
 	BlindElement []byte `json:"blindElement"`
 }
@@ -41,6 +42,44 @@ type ClientRequestContext struct {
 	oprfRequest *oprf.ClientRequest
 }
 
+// BucketMatch is a bucket entry whose key check matched the queried
+// credential, along with its decrypted metadata.
+type BucketMatch struct {
+	Flag     MetadataType
+	Metadata []byte
+}
+
+// Credential is a (username, password) pair to be checked in a batch query.
+type Credential struct {
+	Username []byte
+	Password []byte
+}
+
+// ClientBatchRequest carries the information the server needs to evaluate a
+// batch of credentials in a single round trip. BucketIDs[i] is the bucket for
+// the credential blinded in BlindElements[i].
+type ClientBatchRequest struct {
+	Version       uint32   `json:"version"`
+	KeyID         uint32   `json:"keyID"`
+	BucketIDs     []string `json:"bucketIDs"`
+	BlindElements [][]byte `json:"blindElements"`
+}
+
+// ClientBatchRequestContext wraps the context needed to process a MIGP batch
+// response.
+type ClientBatchRequestContext struct {
+	client      Client
+	bucketIDs   []string
+	oprfRequest *oprf.ClientRequest
+}
+
+// BatchResult holds the breach status and associated metadata (if available)
+// for a single credential in a batch query.
+type BatchResult struct {
+	Status   BreachStatus
+	Metadata []byte
+}
+
 func NewClient(cfg Config) (*Client, error) {
 	var err error
 
@@ -53,7 +92,7 @@ func NewClient(cfg Config) (*Client, error) {
 		return nil, err
 	}
 
-	c.slowHasher, err = NewSlowHasher(cfg.SlowHasherID)
+	c.slowHasher, err = NewSlowHasherWithParams(cfg.SlowHasherID, cfg.SlowHasherParams)
 	if err != nil {
 		return nil, err
 	}
@@ -63,8 +102,15 @@ func NewClient(cfg Config) (*Client, error) {
 		return nil, err
 	}
 
+	c.canonicalizer, err = NewUsernameCanonicalizer(cfg.UsernameCanonicalizerID)
+	if err != nil {
+		return nil, err
+	}
+
 	c.oprfSuite = cfg.OPRFSuite
-	c.oprfClient, err = oprf.NewClient(c.oprfSuite)
+	c.oprfMode = cfg.OPRFMode
+	c.keyID = cfg.KeyID
+	c.oprfClient, err = newOPRFClient(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -73,15 +119,30 @@ func NewClient(cfg Config) (*Client, error) {
 
 // BucketID returns the bucket ID for the given username
 func (c *Client) BucketID(username []byte) uint32 {
+	return c.bucketID(c.canonicalizer.Canonicalize(username))
+}
+
+// bucketID returns the bucket ID for the given canonical username
+func (c *Client) bucketID(username []byte) uint32 {
 	return bucketHashToID(c.bucketHasher.Hash(username), c.bucketIDBitSize)
 }
 
 // Request generates a client request byte string and a ClientRequest struct,
 // given a username and password
 func (c Client) Request(username, password []byte) (ClientRequest, ClientRequestContext, error) {
-	input := c.slowHasher.Hash(serializeUsernamePassword(username, password))
+	return c.RequestContext(context.Background(), username, password)
+}
+
+// RequestContext is like Request, but returns early with the context error
+// if the context is done before the slow hash of the credential completes.
+func (c Client) RequestContext(ctx context.Context, username, password []byte) (ClientRequest, ClientRequestContext, error) {
+	username = c.canonicalizer.Canonicalize(username)
+	inputs, err := slowHashContext(ctx, c.slowHasher, [][]byte{serializeUsernamePassword(username, password)})
+	if err != nil {
+		return ClientRequest{}, ClientRequestContext{}, err
+	}
 
-	oprfRequest, err := c.oprfClient.Request([][]byte{input})
+	oprfRequest, err := c.oprfClient.Request(inputs)
 	if err != nil {
 		return ClientRequest{}, ClientRequestContext{}, err
 	}
@@ -92,54 +153,124 @@ func (c Client) Request(username, password []byte) (ClientRequest, ClientRequest
 
 	request := ClientRequest{
 		Version:      uint32(c.version),
-		BucketID:     BucketIDToHex(c.BucketID(username)),
+		KeyID:        c.keyID,
+		BucketID:     BucketIDToHex(c.bucketID(username)),
 		BlindElement: blindedElements[0],
 	}
-	context := ClientRequestContext{
+	requestContext := ClientRequestContext{
 		client:      c,
 		oprfRequest: oprfRequest,
 	}
 
-	return request, context, nil
+	return request, requestContext, nil
 }
 
 // Finalize parses a response message from server, completes the computation of
 // the OPRF value, determines if it is in the received bucket, and decrypts the
 // associated ciphertext
 func (ctx ClientRequestContext) Finalize(response ServerResponse) (BreachStatus, []byte, error) {
-	if uint16(response.Version) != ctx.client.version {
-		return NotInBreach, nil, errors.New("wrong version in reply")
+	secret, err := ctx.oprfOutput(response)
+	if err != nil {
+		return NotInBreach, nil, err
 	}
+	return ctx.client.searchBucket(secret, response.BucketContents)
+}
 
-	oprfOutput, err := ctx.client.oprfClient.Finalize(ctx.oprfRequest, &oprf.Evaluation{
-		Elements: []oprf.SerializedElement{response.EvaluatedElement},
-	}, OprfInfo)
+// FinalizeAll is like Finalize, but scans the whole bucket and returns every
+// matching entry rather than stopping at the first one. The overall status is
+// the one with the highest Severity among the matches, so it does not depend
+// on the order of entries in the bucket. Every entry header is checked even
+// after a match, so the time taken does not reveal where the match was.
+func (ctx ClientRequestContext) FinalizeAll(response ServerResponse) (BreachStatus, []BucketMatch, error) {
+	secret, err := ctx.oprfOutput(response)
 	if err != nil {
 		return NotInBreach, nil, err
 	}
+
+	matches, err := ctx.client.scanBucket(secret, response.BucketContents)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+
+	status := NotInBreach
+	for _, match := range matches {
+		if matchStatus := match.Flag.ToBreachStatus(); matchStatus.Severity() > status.Severity() {
+			status = matchStatus
+		}
+	}
+	return status, matches, nil
+}
+
+// oprfOutput checks the response version and completes the computation of
+// the OPRF value, which is the secret used to find and decrypt bucket entries
+func (ctx ClientRequestContext) oprfOutput(response ServerResponse) ([]byte, error) {
+	if uint16(response.Version) != ctx.client.version {
+		return nil, errors.New("wrong version in reply")
+	}
+
+	evaluation, err := ctx.client.evaluation([]oprf.SerializedElement{response.EvaluatedElement}, response.Proof)
+	if err != nil {
+		return nil, err
+	}
+	oprfOutput, err := ctx.client.oprfClient.Finalize(ctx.oprfRequest, evaluation, OprfInfo)
+	if err != nil {
+		return nil, err
+	}
 	if len(oprfOutput) < 1 {
-		return NotInBreach, nil, errors.New("invalid Finalize response")
+		return nil, errors.New("invalid Finalize response")
 	}
-	secret := oprfOutput[0]
+	return oprfOutput[0], nil
+}
 
+// evaluation assembles the OPRF evaluation received from the server. In
+// verifiable mode the proof is required, and is checked against the server
+// public key by the OPRF client when finalizing.
+func (c *Client) evaluation(elements []oprf.SerializedElement, proof []byte) (*oprf.Evaluation, error) {
+	evaluation := &oprf.Evaluation{Elements: elements}
+	if c.oprfMode == oprf.VerifiableMode {
+		if len(proof) == 0 {
+			return nil, errors.New("missing proof in verifiable mode")
+		}
+		var err error
+		if evaluation.Proof, err = deserializeProof(c.oprfSuite, proof); err != nil {
+			return nil, err
+		}
+	}
+	return evaluation, nil
+}
+
+// ParseResponse unmarshals a binary server response produced by
+// ServerResponse.MarshalBinary, using the OPRF suite and mode of the client.
+func (c *Client) ParseResponse(data []byte) (ServerResponse, error) {
+	var response ServerResponse
+	if err := response.UnmarshalBinaryConfig(Config{OPRFSuite: c.oprfSuite, OPRFMode: c.oprfMode}, data); err != nil {
+		return ServerResponse{}, err
+	}
+	return response, nil
+}
+
+// searchBucket scans the bucket entries for one whose key check matches the
+// given OPRF output, and returns its breach status and decrypted metadata
+func (c *Client) searchBucket(secret, bucketContents []byte) (BreachStatus, []byte, error) {
 	offset := 0
 
 	for {
-		if (offset + HeaderSize) > len(response.BucketContents) {
+		if (offset + HeaderSize) > len(bucketContents) {
 			// Note(caw): we could return an error here, but bail out to the default case
 			break
 		}
 
-		valid, flag, bodyLength, err := ctx.client.bucketEncryptor.DecryptHeader(secret, response.BucketContents[offset:])
+		valid, flag, bodyLength, err := c.bucketEncryptor.DecryptHeader(secret, bucketContents[offset:])
 		if err != nil {
 			return NotInBreach, nil, err
 		}
+		header := bucketContents[offset : offset+HeaderSize]
 		offset += HeaderSize
-		if offset+bodyLength > len(response.BucketContents) {
+		if offset+bodyLength > len(bucketContents) {
 			return NotInBreach, nil, errors.New("parsing error in bucket")
 		}
 		if valid {
-			metadata, err := ctx.client.bucketEncryptor.DecryptBody(secret, response.BucketContents[offset:offset+bodyLength])
+			metadata, err := decryptBody(c.bucketEncryptor, secret, header, bucketContents[offset:offset+bodyLength])
 			if err != nil {
 				return NotInBreach, nil, err
 			}
@@ -153,46 +284,140 @@ func (ctx ClientRequestContext) Finalize(response ServerResponse) (BreachStatus,
 	return NotInBreach, nil, nil
 }
 
-// Query submits a MIGP query to the target MIGP server.
-func Query(cfg Config, targetURL string, username, password []byte) (BreachStatus, []byte, error) {
-	client, err := NewClient(cfg)
-	if err != nil {
-		return 0, nil, err
+// scanBucket checks every entry in the bucket against the given OPRF output,
+// and returns all matching entries other than dummies, in bucket order
+func (c *Client) scanBucket(secret, bucketContents []byte) ([]BucketMatch, error) {
+	var matches []BucketMatch
+	offset := 0
+
+	for (offset + HeaderSize) <= len(bucketContents) {
+		valid, flag, bodyLength, err := c.bucketEncryptor.DecryptHeader(secret, bucketContents[offset:])
+		if err != nil {
+			return nil, err
+		}
+		header := bucketContents[offset : offset+HeaderSize]
+		offset += HeaderSize
+		if offset+bodyLength > len(bucketContents) {
+			return nil, errors.New("parsing error in bucket")
+		}
+		if valid && flag != MetadataDummy {
+			metadata, err := decryptBody(c.bucketEncryptor, secret, header, bucketContents[offset:offset+bodyLength])
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, BucketMatch{Flag: flag, Metadata: metadata})
+		}
+
+		// Continue to the next entry regardless of a match
+		offset += bodyLength
 	}
 
-	migpRequest, context, err := client.Request(username, password)
-	if err != nil {
-		return 0, nil, err
+	return matches, nil
+}
+
+// RequestBatch generates a batch request for the given credentials. All
+// credentials are blinded in a single OPRF request, and the results are
+// returned by ClientBatchRequestContext.Finalize in the same order.
+func (c Client) RequestBatch(credentials []Credential) (ClientBatchRequest, ClientBatchRequestContext, error) {
+	return c.RequestBatchContext(context.Background(), credentials)
+}
+
+// RequestBatchContext is like RequestBatch, but stops hashing credentials
+// and returns the context error as soon as the context is done.
+func (c Client) RequestBatchContext(ctx context.Context, credentials []Credential) (ClientBatchRequest, ClientBatchRequestContext, error) {
+	if len(credentials) == 0 {
+		return ClientBatchRequest{}, ClientBatchRequestContext{}, errors.New("empty batch")
 	}
 
-	serializedRequestPayload, err := json.Marshal(migpRequest)
+	serialized := make([][]byte, len(credentials))
+	bucketIDs := make([]string, len(credentials))
+	for i, cred := range credentials {
+		username := c.canonicalizer.Canonicalize(cred.Username)
+		serialized[i] = serializeUsernamePassword(username, cred.Password)
+		bucketIDs[i] = BucketIDToHex(c.bucketID(username))
+	}
+	inputs, err := slowHashContext(ctx, c.slowHasher, serialized)
 	if err != nil {
-		return 0, nil, err
+		return ClientBatchRequest{}, ClientBatchRequestContext{}, err
 	}
 
-	request, err := http.NewRequest("POST", targetURL, bytes.NewBuffer(serializedRequestPayload))
+	oprfRequest, err := c.oprfClient.Request(inputs)
 	if err != nil {
-		return 0, nil, err
+		return ClientBatchRequest{}, ClientBatchRequestContext{}, err
+	}
+	blindedElements := oprfRequest.BlindedElements()
+	if len(blindedElements) != len(credentials) {
+		return ClientBatchRequest{}, ClientBatchRequestContext{}, errors.New("invalid BlindedElements response")
 	}
-	request.Header.Set("Content-Type", "application/json")
 
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return 0, nil, err
+	request := ClientBatchRequest{
+		Version:       uint32(c.version),
+		KeyID:         c.keyID,
+		BucketIDs:     bucketIDs,
+		BlindElements: blindedElements,
 	}
-	if response.StatusCode != http.StatusOK {
-		return 0, nil, fmt.Errorf("Request failed with status code %d", response.StatusCode)
+	requestContext := ClientBatchRequestContext{
+		client:      c,
+		bucketIDs:   bucketIDs,
+		oprfRequest: oprfRequest,
+	}
+
+	return request, requestContext, nil
+}
+
+// Finalize parses a batch response from the server, completes the OPRF
+// computation for every credential in the batch, and searches the
+// corresponding bucket for each of them. Results are returned in request order.
+func (ctx ClientBatchRequestContext) Finalize(response ServerBatchResponse) ([]BatchResult, error) {
+	if uint16(response.Version) != ctx.client.version {
+		return nil, errors.New("wrong version in reply")
+	}
+	if len(response.EvaluatedElements) != len(ctx.bucketIDs) {
+		return nil, errors.New("wrong number of evaluated elements in reply")
 	}
-	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
+
+	evaluation, err := ctx.client.evaluation(response.EvaluatedElements, response.Proof)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
+	}
+	oprfOutput, err := ctx.client.oprfClient.Finalize(ctx.oprfRequest, evaluation, OprfInfo)
+	if err != nil {
+		return nil, err
+	}
+	if len(oprfOutput) != len(ctx.bucketIDs) {
+		return nil, errors.New("invalid Finalize response")
 	}
 
-	var responsePayload ServerResponse
-	if err := responsePayload.UnmarshalBinary(body); err != nil {
+	results := make([]BatchResult, len(ctx.bucketIDs))
+	for i, bucketID := range ctx.bucketIDs {
+		bucketContents, ok := response.Buckets[bucketID]
+		if !ok {
+			return nil, fmt.Errorf("bucket %s missing from reply", bucketID)
+		}
+		status, metadata, err := ctx.client.searchBucket(oprfOutput[i], bucketContents)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = BatchResult{Status: status, Metadata: metadata}
+	}
+	return results, nil
+}
+
+// Query submits a MIGP query to the target MIGP server.
+func Query(cfg Config, targetURL string, username, password []byte) (BreachStatus, []byte, error) {
+	client, err := NewQueryClient(cfg, QueryClientConfig{})
+	if err != nil {
 		return 0, nil, err
 	}
+	return client.queryURL(context.Background(), targetURL, username, password)
+}
 
-	return context.Finalize(responsePayload)
+// QueryBatch submits a batch of credentials to the target MIGP server's batch
+// endpoint in a single round trip.
+func QueryBatch(cfg Config, targetURL string, credentials []Credential) ([]BatchResult, error) {
+	client, err := NewQueryClient(cfg, QueryClientConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return client.queryBatchURL(context.Background(), targetURL, credentials)
 }
@@ -5,7 +5,10 @@ package migp
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
+
+	"github.com/cloudflare/circl/oprf"
 )
 
 // KVMock is a simple KV store implementation
@@ -110,3 +113,611 @@ func TestQuery(t *testing.T) {
 			password, result, NotInBreach)
 	}
 }
+
+// TestQueryBatch checks that a batch query returns the same results as
+// individual queries, including when several credentials share a bucket
+func TestQueryBatch(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := new(KVMock)
+	kv.store = make(map[string][]byte)
+	inserted := []struct {
+		username, password []byte
+		flag               MetadataType
+		metadata           []byte
+	}{
+		{[]byte("alice"), []byte("password1"), MetadataBreachedPassword, []byte("breach A")},
+		{[]byte("alice"), []byte("Password1"), MetadataSimilarPassword, []byte("breach A")},
+		{[]byte("bob"), []byte("hunter2"), MetadataBreachedPassword, []byte("breach B")},
+	}
+	for _, entry := range inserted {
+		bucketIDHex := BucketIDToHex(server.BucketID(entry.username))
+		newEntry, err := server.EncryptBucketEntry(entry.username, entry.password, entry.flag, entry.metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv.store[bucketIDHex] = append(kv.store[bucketIDHex], newEntry...)
+	}
+
+	client, err := NewClient(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := []Credential{
+		{[]byte("alice"), []byte("password1")},
+		{[]byte("alice"), []byte("Password1")},
+		{[]byte("alice"), []byte("other")},
+		{[]byte("bob"), []byte("hunter2")},
+		{[]byte("carol"), []byte("hunter2")},
+	}
+	expected := []BatchResult{
+		{InBreach, []byte("breach A")},
+		{SimilarInBreach, []byte("breach A")},
+		{NotInBreach, nil},
+		{InBreach, []byte("breach B")},
+		{NotInBreach, nil},
+	}
+
+	request, clientFinalize, err := client.RequestBatch(credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := server.HandleBatchRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Buckets) != 3 {
+		t.Errorf("want %d distinct buckets in response, got %d", 3, len(response.Buckets))
+	}
+
+	data, err := response.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ServerBatchResponse
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := clientFinalize.Finalize(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("want %d results, got %d", len(expected), len(results))
+	}
+	for i, result := range results {
+		if result.Status != expected[i].Status || !bytes.Equal(result.Metadata, expected[i].Metadata) {
+			t.Errorf("result %d incorrect. Got %s '%s' (expected: %s '%s')",
+				i, result.Status, result.Metadata, expected[i].Status, expected[i].Metadata)
+		}
+	}
+
+	// batches over the maximum size are rejected
+	request.BlindElements = make([][]byte, MaxBatchSize+1)
+	request.BucketIDs = make([]string, MaxBatchSize+1)
+	if _, err := server.HandleBatchRequest(request, kv); err == nil {
+		t.Error("oversized batch accepted")
+	}
+}
+
+// TestQueryVerifiable checks that queries succeed in verifiable mode, and that
+// responses are rejected when they do not verify against the pinned key
+func TestQueryVerifiable(t *testing.T) {
+	username, password, metadata := []byte("username"), []byte("password"), []byte("metadata")
+
+	newVerifiableServer := func() *Server {
+		cfg := DefaultServerConfig()
+		cfg.OPRFMode = oprf.VerifiableMode
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server
+	}
+	server := newVerifiableServer()
+	otherServer := newVerifiableServer()
+
+	kv := new(KVMock)
+	kv.store = make(map[string][]byte)
+	newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.store[BucketIDToHex(server.BucketID(username))] = newEntry
+
+	clientConfig := server.Config().Config
+	if len(clientConfig.PublicKey) == 0 {
+		t.Fatal("public key missing from verifiable server config")
+	}
+	client, err := NewClient(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, clientFinalize, err := client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := server.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := response.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := client.ParseResponse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, md, err := clientFinalize.Finalize(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != InBreach || !bytes.Equal(md, metadata) {
+		t.Errorf("got %s '%s' (expected: %s '%s')", status, md, InBreach, metadata)
+	}
+
+	// a server evaluating under a different key is detected
+	request, clientFinalize, err = client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = otherServer.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := clientFinalize.Finalize(response); err == nil {
+		t.Error("response under a different key accepted")
+	}
+
+	// a response without a proof is rejected
+	request, clientFinalize, err = client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = server.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Proof = nil
+	if _, _, err := clientFinalize.Finalize(response); err == nil {
+		t.Error("response without proof accepted")
+	}
+
+	// batch responses carry a single proof for all elements
+	batchRequest, batchFinalize, err := client.RequestBatch([]Credential{{username, password}, {username, nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchResponse, err := otherServer.HandleBatchRequest(batchRequest, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batchFinalize.Finalize(batchResponse); err == nil {
+		t.Error("batch response under a different key accepted")
+	}
+}
+
+// TestQuerySuites runs single and batch queries end to end, through the
+// binary response encoding, for every supported OPRF suite and mode
+func TestQuerySuites(t *testing.T) {
+	username, password, metadata := []byte("username"), []byte("password"), []byte("metadata")
+
+	for _, suite := range SupportedOPRFSuites {
+		for _, mode := range []oprf.Mode{oprf.BaseMode, oprf.VerifiableMode} {
+			cfg := DefaultConfig()
+			cfg.OPRFSuite = suite
+			cfg.OPRFMode = mode
+			serverCfg, err := NewServerConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := NewServer(serverCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): newEntry}}
+
+			client, err := NewClient(server.Config().Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			request, clientFinalize, err := client.Request(username, password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := server.HandleRequest(request, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := response.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := client.ParseResponse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, md, err := clientFinalize.Finalize(parsed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != InBreach || !bytes.Equal(md, metadata) {
+				t.Errorf("suite 0x%04x mode %d: got %s '%s' (expected: %s '%s')", suite, mode, status, md, InBreach, metadata)
+			}
+
+			batchRequest, batchFinalize, err := client.RequestBatch([]Credential{{username, password}, {username, nil}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			batchResponse, err := server.HandleBatchRequest(batchRequest, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = batchResponse.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var parsedBatch ServerBatchResponse
+			if err := parsedBatch.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			results, err := batchFinalize.Finalize(parsedBatch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if results[0].Status != InBreach || results[1].Status != NotInBreach {
+				t.Errorf("suite 0x%04x mode %d: got batch statuses %s, %s", suite, mode, results[0].Status, results[1].Status)
+			}
+		}
+	}
+
+	// unsupported suites are rejected up front
+	cfg := DefaultConfig()
+	cfg.OPRFSuite = 0x0001
+	if _, err := NewServerConfig(cfg); err == nil {
+		t.Error("server config generated for unsupported suite")
+	}
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("client created for unsupported suite")
+	}
+	var response ServerResponse
+	if err := response.UnmarshalBinaryConfig(cfg, make([]byte, 64)); err == nil {
+		t.Error("response parsed for unsupported suite")
+	}
+}
+
+// TestQueryArgon2id checks that clients and servers agree on the Argon2id
+// parameters carried in the configuration
+func TestQueryArgon2id(t *testing.T) {
+	username, password := []byte("username"), []byte("password")
+
+	cfg := DefaultConfig()
+	cfg.SlowHasherID = SlowHasherArgon2id
+	cfg.SlowHasherParams = SlowHasherParams{Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 2}
+	serverCfg, err := NewServerConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): newEntry}}
+
+	clientCfg := server.Config().Config
+	if clientCfg.SlowHasherParams != cfg.SlowHasherParams {
+		t.Fatalf("advertised parameters: want %+v, got %+v", cfg.SlowHasherParams, clientCfg.SlowHasherParams)
+	}
+
+	for _, test := range []struct {
+		params SlowHasherParams
+		status BreachStatus
+	}{
+		{clientCfg.SlowHasherParams, InBreach},
+		{SlowHasherParams{Argon2Time: 2, Argon2Memory: 1024, Argon2Threads: 2}, NotInBreach},
+	} {
+		clientCfg.SlowHasherParams = test.params
+		client, err := NewClient(clientCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, clientFinalize, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := server.HandleRequest(request, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, err := clientFinalize.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status {
+			t.Errorf("params %+v: want %s, got %s", test.params, test.status, status)
+		}
+	}
+}
+
+// TestQueryAEAD runs queries end to end with the AEAD bucket encryptors, and
+// checks that a tampered bucket entry yields an integrity error
+func TestQueryAEAD(t *testing.T) {
+	username, password, metadata := []byte("username"), []byte("password"), []byte("metadata")
+
+	for _, id := range []uint16{BucketEncryptorAES256GCM, BucketEncryptorChaCha20Poly1305} {
+		cfg := DefaultConfig()
+		cfg.BucketEncryptorID = id
+		serverCfg, err := NewServerConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := NewServer(serverCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucketIDHex := BucketIDToHex(server.BucketID(username))
+		kv := &KVMock{store: map[string][]byte{bucketIDHex: newEntry}}
+
+		client, err := NewClient(server.Config().Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request, clientFinalize, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := func() (BreachStatus, []byte, error) {
+			response, err := server.HandleRequest(request, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return clientFinalize.Finalize(response)
+		}
+
+		status, md, err := query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != InBreach || !bytes.Equal(md, metadata) {
+			t.Errorf("encryptor %d: got %s '%s' (expected: %s '%s')", id, status, md, InBreach, metadata)
+		}
+
+		response, err := server.HandleRequest(request, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, matches, err := clientFinalize.FinalizeAll(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != InBreach || len(matches) != 1 || !bytes.Equal(matches[0].Metadata, metadata) {
+			t.Errorf("encryptor %d: FinalizeAll got %s with %d matches", id, status, len(matches))
+		}
+
+		tampered := append([]byte{}, newEntry...)
+		tampered[len(tampered)-1] ^= 1
+		kv.store[bucketIDHex] = tampered
+		if _, _, err := query(); err != ErrIntegrity {
+			t.Errorf("encryptor %d: want %v, got %v", id, ErrIntegrity, err)
+		}
+	}
+}
+
+// TestFinalizeAll checks that every matching entry is returned, and that the
+// overall status does not depend on the order of entries in the bucket
+func TestFinalizeAll(t *testing.T) {
+	username, password := []byte("username"), []byte("password")
+
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []struct {
+		username, password []byte
+		flag               MetadataType
+		metadata           []byte
+	}{
+		{username, password, MetadataSimilarPassword, []byte("breach A")},
+		{username, []byte("other"), MetadataBreachedPassword, []byte("breach B")},
+		{username, password, MetadataBreachedPassword, []byte("breach C")},
+		{username, nil, MetadataBreachedUsername, []byte("breach D")},
+	}
+	var bucket []byte
+	for _, entry := range entries {
+		newEntry, err := server.EncryptBucketEntry(entry.username, entry.password, entry.flag, entry.metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket = append(bucket, newEntry...)
+	}
+	kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): bucket}}
+
+	client, err := NewClient(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, clientFinalize, err := client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := server.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Finalize stops at the first match
+	status, metadata, err := clientFinalize.Finalize(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != SimilarInBreach || !bytes.Equal(metadata, []byte("breach A")) {
+		t.Errorf("Finalize: got %s '%s'", status, metadata)
+	}
+
+	status, matches, err := clientFinalize.FinalizeAll(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != InBreach {
+		t.Errorf("FinalizeAll: want %s, got %s", InBreach, status)
+	}
+	expected := []BucketMatch{
+		{MetadataSimilarPassword, []byte("breach A")},
+		{MetadataBreachedPassword, []byte("breach C")},
+	}
+	if len(matches) != len(expected) {
+		t.Fatalf("want %d matches, got %d", len(expected), len(matches))
+	}
+	for i, match := range matches {
+		if match.Flag != expected[i].Flag || !bytes.Equal(match.Metadata, expected[i].Metadata) {
+			t.Errorf("match %d: got %s '%s' (expected: %s '%s')", i, match.Flag, match.Metadata, expected[i].Flag, expected[i].Metadata)
+		}
+	}
+
+	// a credential without matches is not in breach
+	request, clientFinalize, err = client.Request(username, []byte("not inserted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = server.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, matches, err = clientFinalize.FinalizeAll(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != NotInBreach || len(matches) != 0 {
+		t.Errorf("want %s with no matches, got %s with %d matches", NotInBreach, status, len(matches))
+	}
+}
+
+// TestQueryMetadata checks that structured breach metadata survives
+// encryption and decryption of a bucket entry
+func TestQueryMetadata(t *testing.T) {
+	username, password := []byte("username"), []byte("password")
+	metadata := BreachMetadata{
+		Name:        "Example Breach",
+		Date:        "2021-12-01",
+		DataClasses: []string{"email addresses", "passwords"},
+	}
+
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEntry, err := server.EncryptBucketEntryWithMetadata(username, password, MetadataBreachedPassword, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): newEntry}}
+
+	client, err := NewClient(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, clientFinalize, err := client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := server.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, data, err := clientFinalize.Finalize(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := DecodeMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != InBreach || !reflect.DeepEqual(result, metadata) {
+		t.Errorf("got %s %+v (expected: %s %+v)", status, result, InBreach, metadata)
+	}
+}
+
+func TestQueryCanonicalUsername(t *testing.T) {
+	password := []byte("password")
+	for _, test := range []struct {
+		canonicalizer uint16
+		want          BreachStatus
+	}{
+		{UsernameCanonicalizerNull, NotInBreach},
+		{UsernameCanonicalizerNFKCEmail, InBreach},
+	} {
+		cfg := DefaultServerConfig()
+		cfg.UsernameCanonicalizerID = test.canonicalizer
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		username := []byte("alice@example.com")
+		newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): newEntry}}
+
+		client, err := NewClient(server.Config().Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, spelling := range []string{" Alice@Example.COM", "ａｌｉｃｅ@example.com"} {
+			request, clientFinalize, err := client.Request([]byte(spelling), password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := server.HandleRequest(request, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, _, err := clientFinalize.Finalize(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != test.want {
+				t.Errorf("canonicalizer %d: %q: got %s (expected: %s)", test.canonicalizer, spelling, status, test.want)
+			}
+
+			batchRequest, batchFinalize, err := client.RequestBatch([]Credential{{Username: []byte(spelling), Password: password}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			batchResponse, err := server.HandleBatchRequest(batchRequest, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := batchFinalize.Finalize(batchResponse)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if results[0].Status != test.want {
+				t.Errorf("canonicalizer %d: %q: batch got %s (expected: %s)", test.canonicalizer, spelling, results[0].Status, test.want)
+			}
+		}
+	}
+}
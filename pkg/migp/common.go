@@ -6,6 +6,8 @@ package migp
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 
 	"github.com/cloudflare/circl/oprf"
 )
@@ -25,6 +27,11 @@ const (
 	DefaultSlowHasher      = SlowHasherScrypt
 	DefaultBucketEncryptor = BucketEncryptorHKDFSHA256
 	DefaultOPRFSuite       = uint16(oprf.OPRFP256)
+	DefaultOPRFMode        = oprf.BaseMode
+
+	// DefaultUsernameCanonicalizer uses usernames as is, which is
+	// compatible with configurations predating username canonicalization
+	DefaultUsernameCanonicalizer = UsernameCanonicalizerNull
 
 	// CtxtKeyCheckSize is the size of key check string in bytes. We use this
 	// to check if a given bucket entry header matches the derived key.
@@ -38,16 +45,32 @@ const (
 
 var (
 	OprfInfo = []byte("MIGP oprf info")
+
+	// SupportedOPRFSuites lists the OPRF suites that can be used in Config.
+	SupportedOPRFSuites = []oprf.SuiteID{oprf.OPRFP256, oprf.OPRFP384, oprf.OPRFP521}
 )
 
 // Config contains MIGP configuration used both clients and servers.
 type Config struct {
-	Version           uint16       `json:"version"`
-	BucketIDBitSize   int          `json:"bucketIDBitSize"`
-	BucketHasherID    uint16       `json:"bucketHasher"`
-	SlowHasherID      uint16       `json:"slowHasher"`
-	BucketEncryptorID uint16       `json:"bucketEncryptor"`
-	OPRFSuite         oprf.SuiteID `json:"oprfSuite"`
+	Version           uint16           `json:"version"`
+	BucketIDBitSize   int              `json:"bucketIDBitSize"`
+	BucketHasherID    uint16           `json:"bucketHasher"`
+	SlowHasherID      uint16           `json:"slowHasher"`
+	SlowHasherParams  SlowHasherParams `json:"slowHasherParams"`
+	BucketEncryptorID uint16           `json:"bucketEncryptor"`
+	OPRFSuite         oprf.SuiteID     `json:"oprfSuite"`
+	OPRFMode          oprf.Mode        `json:"oprfMode"`
+	// UsernameCanonicalizerID identifies how usernames are canonicalized
+	// before computing bucket IDs and bucket entry keys.
+	UsernameCanonicalizerID uint16 `json:"usernameCanonicalizer"`
+	// KeyID identifies the OPRF key epoch. Clients send it with each
+	// request so that servers can keep answering for previous keys while
+	// a key rotation is in progress.
+	KeyID uint32 `json:"keyID"`
+	// PublicKey is the serialized OPRF public key of the server. It is only
+	// set in verifiable mode, where clients use it to check the server's
+	// evaluation proofs.
+	PublicKey []byte `json:"publicKey,omitempty"`
 }
 
 // DefaultConfig returns a new default configuration
@@ -57,8 +80,12 @@ func DefaultConfig() Config {
 		BucketHasherID:    DefaultBucketHasher,
 		BucketEncryptorID: DefaultBucketEncryptor,
 		SlowHasherID:      DefaultSlowHasher,
+		SlowHasherParams:  SlowHasherParams{}.withDefaults(DefaultSlowHasher),
 		OPRFSuite:         DefaultOPRFSuite,
+		OPRFMode:          DefaultOPRFMode,
 		BucketIDBitSize:   DefaultBucketIDBitSize,
+
+		UsernameCanonicalizerID: DefaultUsernameCanonicalizer,
 	}
 }
 
@@ -149,6 +176,23 @@ func (bs BreachStatus) String() string {
 	}
 }
 
+// Severity returns the rank of a breach status when several bucket entries
+// match a credential: InBreach takes precedence over SimilarInBreach, which
+// takes precedence over UsernameInBreach, which takes precedence over
+// NotInBreach.
+func (bs BreachStatus) Severity() int {
+	switch bs {
+	case InBreach:
+		return 3
+	case SimilarInBreach:
+		return 2
+	case UsernameInBreach:
+		return 1
+	default:
+		return 0
+	}
+}
+
 // serializeUsernamePassword generates a byte string consisting of username and
 // password.  We use a simple prefix-free length-based encoding of the username
 // and password, where lengths are encoded as 16-bit big-endian unsigned
@@ -182,3 +226,89 @@ func BucketIDToHex(bucketID uint32) string {
 	binary.BigEndian.PutUint32(b[0:], bucketID)
 	return hex.EncodeToString(b)
 }
+
+// oprfSizes returns the serialized element and scalar lengths for the given
+// OPRF suite, failing for suites that are not supported
+func oprfSizes(suite oprf.SuiteID) (elementLength, scalarLength int, err error) {
+	sizes, err := oprf.GetSizes(suite)
+	if err != nil {
+		return 0, 0, err
+	}
+	// GetSizes reports zero sizes rather than an error for unknown suites.
+	if sizes.SerializedElementLength == 0 || sizes.SerializedScalarLength == 0 {
+		return 0, 0, fmt.Errorf("unsupported OPRF suite 0x%04x", suite)
+	}
+	return int(sizes.SerializedElementLength), int(sizes.SerializedScalarLength), nil
+}
+
+// serializeProof encodes an OPRF evaluation proof as the concatenation of its
+// two scalars. A nil proof is encoded as an empty byte string.
+func serializeProof(proof *oprf.Proof) []byte {
+	if proof == nil {
+		return nil
+	}
+	buf := make([]byte, 0, len(proof.C)+len(proof.S))
+	buf = append(buf, proof.C...)
+	return append(buf, proof.S...)
+}
+
+// deserializeProof decodes an OPRF evaluation proof produced by serializeProof
+func deserializeProof(suite oprf.SuiteID, data []byte) (*oprf.Proof, error) {
+	_, scalarLength, err := oprfSizes(suite)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 2*scalarLength {
+		return nil, errors.New("invalid proof length")
+	}
+	return &oprf.Proof{
+		C: append([]byte{}, data[:scalarLength]...),
+		S: append([]byte{}, data[scalarLength:]...),
+	}, nil
+}
+
+// proofLength returns the length of a serialized evaluation proof for the
+// given configuration, which is zero in base mode
+func proofLength(cfg Config) (int, error) {
+	if cfg.OPRFMode != oprf.VerifiableMode {
+		return 0, nil
+	}
+	_, scalarLength, err := oprfSizes(cfg.OPRFSuite)
+	if err != nil {
+		return 0, err
+	}
+	return 2 * scalarLength, nil
+}
+
+// newOPRFClient returns an OPRF client for the suite and mode in the given
+// configuration. In verifiable mode, the configuration must carry the server
+// public key against which evaluation proofs are checked.
+func newOPRFClient(cfg Config) (*oprf.Client, error) {
+	switch cfg.OPRFMode {
+	case oprf.BaseMode:
+		return oprf.NewClient(cfg.OPRFSuite)
+	case oprf.VerifiableMode:
+		if len(cfg.PublicKey) == 0 {
+			return nil, errors.New("verifiable mode requires a server public key")
+		}
+		publicKey := new(oprf.PublicKey)
+		if err := publicKey.Deserialize(cfg.OPRFSuite, cfg.PublicKey); err != nil {
+			return nil, err
+		}
+		return oprf.NewVerifiableClient(cfg.OPRFSuite, publicKey)
+	default:
+		return nil, errors.New("unsupported OPRF mode")
+	}
+}
+
+// newOPRFServer returns an OPRF server for the given suite and mode
+func newOPRFServer(suite oprf.SuiteID, mode oprf.Mode, privateKey *oprf.PrivateKey) (*oprf.Server, error) {
+	switch mode {
+	case oprf.BaseMode:
+		return oprf.NewServer(suite, privateKey)
+	case oprf.VerifiableMode:
+		return oprf.NewVerifiableServer(suite, privateKey)
+	default:
+		return nil, errors.New("unsupported OPRF mode")
+	}
+}
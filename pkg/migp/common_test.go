@@ -57,3 +57,12 @@ func TestBucketIDToHex(t *testing.T) {
 		}
 	}
 }
+
+func TestBreachStatusSeverity(t *testing.T) {
+	ordered := []BreachStatus{NotInBreach, UsernameInBreach, SimilarInBreach, InBreach}
+	for i := 1; i < len(ordered); i++ {
+		if ordered[i].Severity() <= ordered[i-1].Severity() {
+			t.Errorf("%s should take precedence over %s", ordered[i], ordered[i-1])
+		}
+	}
+}
@@ -29,6 +29,24 @@ type BucketEncryptor interface {
 	DecryptBody(secret []byte, ciphertext []byte) (body []byte, err error)
 }
 
+// HeaderBoundBucketEncryptor is implemented by bucket encryptors that bind the
+// body of an entry to its header, so that a body cannot be moved under the
+// header of another entry. The body of such an entry is decrypted with
+// DecryptBodyWithHeader, given the header that precedes it.
+type HeaderBoundBucketEncryptor interface {
+	BucketEncryptor
+	DecryptBodyWithHeader(secret []byte, header []byte, ciphertext []byte) (body []byte, err error)
+}
+
+// decryptBody decrypts the body of an entry with its header, if the bucket
+// encryptor binds them
+func decryptBody(encryptor BucketEncryptor, secret, header, ciphertext []byte) ([]byte, error) {
+	if bound, ok := encryptor.(HeaderBoundBucketEncryptor); ok {
+		return bound.DecryptBodyWithHeader(secret, header, ciphertext)
+	}
+	return encryptor.DecryptBody(secret, ciphertext)
+}
+
 // hkdfSHA256BucketEncryptor implements BucketEncryptor using HKDF-SHA256
 type hkdfSHA256BucketEncryptor struct{}
 
@@ -144,6 +162,10 @@ func NewBucketEncryptor(id uint16) (BucketEncryptor, error) {
 	switch id {
 	case BucketEncryptorHKDFSHA256:
 		return NewHKDFSHA256BucketEncryptor(), nil
+	case BucketEncryptorAES256GCM:
+		return NewAES256GCMBucketEncryptor(), nil
+	case BucketEncryptorChaCha20Poly1305:
+		return NewChaCha20Poly1305BucketEncryptor(), nil
 	default:
 		return nil, errors.New("unsupported bucket encryptor")
 	}
@@ -119,3 +119,95 @@ func BenchmarkHKDFSHA256Encryptor(b *testing.B) {
 		}
 	}
 }
+
+// TestAEADEncryptors checks that the AEAD bucket encryptors round trip, and
+// that tampering with any part of an entry is detected
+func TestAEADEncryptors(t *testing.T) {
+	secret := []byte("secret")
+	metadata := []byte("my favorite breach")
+
+	for _, id := range []uint16{BucketEncryptorAES256GCM, BucketEncryptorChaCha20Poly1305} {
+		encryptor, err := NewBucketEncryptor(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encryptor.ID() != id {
+			t.Errorf("want ID %d, got %d", id, encryptor.ID())
+		}
+
+		ciphertext, err := encryptor.Encrypt(secret, MetadataSimilarPassword, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid, flag, bodyLength, err := encryptor.DecryptHeader(secret, ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid || flag != MetadataSimilarPassword || HeaderSize+bodyLength != len(ciphertext) {
+			t.Fatalf("encryptor %d: header decryption failed: %v %d %d", id, valid, flag, bodyLength)
+		}
+		bound, ok := encryptor.(HeaderBoundBucketEncryptor)
+		if !ok {
+			t.Fatalf("encryptor %d does not bind bodies to their header", id)
+		}
+		body, err := bound.DecryptBodyWithHeader(secret, ciphertext[:HeaderSize], ciphertext[HeaderSize:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, metadata) {
+			t.Errorf("encryptor %d: want body '%s', got '%s'", id, metadata, body)
+		}
+
+		// a different secret fails the key check
+		if valid, _, _, _ := encryptor.DecryptHeader([]byte("other secret"), ciphertext); valid {
+			t.Errorf("encryptor %d: header valid under wrong secret", id)
+		}
+
+		// tampering with the flag, the body length, or the body is detected
+		for _, i := range []int{CtxtKeyCheckSize, HeaderSize - 1} {
+			tampered := append([]byte{}, ciphertext...)
+			tampered[i] ^= 1
+			if valid, _, _, _ := encryptor.DecryptHeader(secret, tampered); valid {
+				t.Errorf("encryptor %d: header valid after tampering with byte %d", id, i)
+			}
+		}
+		for _, i := range []int{HeaderSize, len(ciphertext) - 1} {
+			tampered := append([]byte{}, ciphertext...)
+			tampered[i] ^= 1
+			if _, err := bound.DecryptBodyWithHeader(secret, tampered[:HeaderSize], tampered[HeaderSize:]); err != ErrIntegrity {
+				t.Errorf("encryptor %d: want %v after tampering with byte %d, got %v", id, ErrIntegrity, i, err)
+			}
+		}
+		if _, err := bound.DecryptBodyWithHeader(secret, ciphertext[:HeaderSize], ciphertext[HeaderSize:HeaderSize+4]); err != ErrIntegrity {
+			t.Errorf("encryptor %d: want %v for truncated body, got %v", id, ErrIntegrity, err)
+		}
+
+		// a body is bound to its own header, even if another entry's
+		// header has the same body length
+		other, err := encryptor.Encrypt(secret, MetadataBreachedPassword, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bound.DecryptBodyWithHeader(secret, other[:HeaderSize], ciphertext[HeaderSize:]); err != ErrIntegrity {
+			t.Errorf("encryptor %d: want %v for a body under another header, got %v", id, ErrIntegrity, err)
+		}
+		if _, err := encryptor.DecryptBody(secret, ciphertext[HeaderSize:]); err != ErrIntegrity {
+			t.Errorf("encryptor %d: want %v for a body without its header, got %v", id, ErrIntegrity, err)
+		}
+	}
+}
+
+// BenchmarkAES256GCMEncryptor runs benchmark tests for the AES-256-GCM bucket encryptor
+func BenchmarkAES256GCMEncryptor(b *testing.B) {
+	secret := []byte{32}
+	metadataFlag := MetadataDummy
+	metadata := []byte{32}
+
+	encryptor := NewAES256GCMBucketEncryptor()
+	for i := 0; i < b.N; i++ {
+		_, err := encryptor.Encrypt(secret, metadataFlag, metadata)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
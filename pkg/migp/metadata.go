@@ -0,0 +1,230 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// MetadataVersion is the version of the structured metadata encoding.
+	MetadataVersion = 1
+
+	// MetadataDateLayout is the layout of BreachMetadata.Date.
+	MetadataDateLayout = "2006-01-02"
+)
+
+// Tags of the fields of the structured metadata encoding. Decoders skip tags
+// they do not recognize, so new fields can be added without a version bump.
+const (
+	metadataTagName      uint8 = 0x01
+	metadataTagDate      uint8 = 0x02
+	metadataTagDataClass uint8 = 0x03
+	metadataTagSourceURL uint8 = 0x04
+	metadataTagRaw       uint8 = 0x05
+	metadataTagPadding   uint8 = 0x06
+	metadataTagVariation uint8 = 0x07
+)
+
+// MetadataMagic prefixes structured metadata, distinguishing it from legacy
+// opaque metadata. It starts with a zero byte, which is not expected at the
+// start of free-form metadata strings.
+var MetadataMagic = []byte{0x00, 'M', 'D'}
+
+// BreachMetadata describes the breach that a bucket entry originates from.
+type BreachMetadata struct {
+	// Name is the name of the breach.
+	Name string `json:"name,omitempty"`
+	// Date is the date of the breach in the MetadataDateLayout format.
+	Date string `json:"date,omitempty"`
+	// DataClasses lists the kinds of data exposed in the breach, e.g.,
+	// "email addresses" or "passwords".
+	DataClasses []string `json:"dataClasses,omitempty"`
+	// SourceURL points to a description of the breach.
+	SourceURL string `json:"sourceURL,omitempty"`
+	// Variation describes how a similar password differs from the breached
+	// password, e.g., "capitalization differs", without revealing either.
+	Variation string `json:"variation,omitempty"`
+	// Raw holds free-form metadata. Legacy opaque metadata decodes to a
+	// BreachMetadata with only Raw set.
+	Raw []byte `json:"raw,omitempty"`
+}
+
+// structured reports whether any of the typed fields are set
+func (m *BreachMetadata) structured() bool {
+	return m.Name != "" || m.Date != "" || len(m.DataClasses) > 0 || m.SourceURL != "" || m.Variation != ""
+}
+
+// MarshalBinary encodes the metadata in the following binary format:
+// <magic>|<1-byte version>|(<1-byte tag>|<uvarint length>|<value>)*
+// where data classes are encoded as one field each, and the date is encoded
+// as a varint number of days since the Unix epoch. Metadata holding only Raw
+// bytes is encoded as the raw bytes themselves so that it remains readable
+// by clients that predate structured metadata.
+func (m *BreachMetadata) MarshalBinary() ([]byte, error) {
+	if !m.structured() {
+		return append([]byte{}, m.Raw...), nil
+	}
+	return m.marshalStructured()
+}
+
+// marshalStructured encodes the metadata in the structured format, even if
+// only Raw is set
+func (m *BreachMetadata) marshalStructured() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	buffer.Write(MetadataMagic)
+	buffer.WriteByte(MetadataVersion)
+
+	if m.Name != "" {
+		writeMetadataField(buffer, metadataTagName, []byte(m.Name))
+	}
+	if m.Date != "" {
+		date, err := time.Parse(MetadataDateLayout, m.Date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid breach date %q: %v", m.Date, err)
+		}
+		days := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutVarint(days, date.Unix()/(24*60*60))
+		writeMetadataField(buffer, metadataTagDate, days[:n])
+	}
+	for _, dataClass := range m.DataClasses {
+		writeMetadataField(buffer, metadataTagDataClass, []byte(dataClass))
+	}
+	if m.SourceURL != "" {
+		writeMetadataField(buffer, metadataTagSourceURL, []byte(m.SourceURL))
+	}
+	if m.Variation != "" {
+		writeMetadataField(buffer, metadataTagVariation, []byte(m.Variation))
+	}
+	if len(m.Raw) > 0 {
+		writeMetadataField(buffer, metadataTagRaw, m.Raw)
+	}
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary decodes metadata produced by MarshalBinary. Data without
+// the MetadataMagic prefix is treated as legacy opaque metadata and stored in
+// Raw.
+func (m *BreachMetadata) UnmarshalBinary(data []byte) error {
+	*m = BreachMetadata{}
+	if !bytes.HasPrefix(data, MetadataMagic) {
+		if len(data) > 0 {
+			m.Raw = append([]byte{}, data...)
+		}
+		return nil
+	}
+
+	data = data[len(MetadataMagic):]
+	if len(data) < 1 {
+		return errors.New("metadata of insufficient length to parse version")
+	}
+	if data[0] != MetadataVersion {
+		return fmt.Errorf("unsupported metadata version: %d", data[0])
+	}
+	data = data[1:]
+
+	for len(data) > 0 {
+		tag := data[0]
+		length, n := binary.Uvarint(data[1:])
+		if n <= 0 || length > uint64(len(data)-1-n) {
+			return errors.New("metadata field of invalid length")
+		}
+		value := data[1+n : 1+n+int(length)]
+		data = data[1+n+int(length):]
+
+		switch tag {
+		case metadataTagName:
+			m.Name = string(value)
+		case metadataTagDate:
+			days, n := binary.Varint(value)
+			if n <= 0 || n != len(value) {
+				return errors.New("invalid metadata date")
+			}
+			m.Date = time.Unix(days*24*60*60, 0).UTC().Format(MetadataDateLayout)
+		case metadataTagDataClass:
+			m.DataClasses = append(m.DataClasses, string(value))
+		case metadataTagSourceURL:
+			m.SourceURL = string(value)
+		case metadataTagVariation:
+			m.Variation = string(value)
+		case metadataTagRaw:
+			m.Raw = append([]byte{}, value...)
+		case metadataTagPadding:
+			// padding carries no information
+		}
+	}
+	return nil
+}
+
+// EncodeMetadata returns the binary encoding of the breach metadata, for
+// use as bucket entry metadata.
+func EncodeMetadata(m BreachMetadata) ([]byte, error) {
+	return m.MarshalBinary()
+}
+
+// DecodeMetadata decodes bucket entry metadata returned by a query, whether
+// it is structured or legacy opaque metadata.
+func DecodeMetadata(data []byte) (BreachMetadata, error) {
+	var m BreachMetadata
+	err := m.UnmarshalBinary(data)
+	return m, err
+}
+
+// padMetadata pads encoded metadata to the next multiple of lengthClass bytes
+// by adding a padding field, so that the length of a bucket entry does not
+// reveal the length of its metadata. Legacy opaque metadata is first
+// converted to structured metadata, as it has no room for padding.
+func padMetadata(metadata []byte, lengthClass int) ([]byte, error) {
+	if lengthClass <= 0 {
+		return metadata, nil
+	}
+	if !bytes.HasPrefix(metadata, MetadataMagic) {
+		m := BreachMetadata{Raw: metadata}
+		var err error
+		if metadata, err = m.marshalStructured(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The padding field takes at least two bytes: the tag and a zero length.
+	target := (len(metadata) + 2 + lengthClass - 1) / lengthClass * lengthClass
+	for {
+		fieldLength := target - len(metadata)
+		// Find the padding length whose field, including the tag and
+		// uvarint length prefix, exactly fills the gap. Some gaps
+		// cannot be filled because of the varint encoding, in which case
+		// the next length class is used.
+		for prefixLength := 1; prefixLength <= binary.MaxVarintLen64; prefixLength++ {
+			padLength := fieldLength - 1 - prefixLength
+			if padLength < 0 {
+				break
+			}
+			if uvarintLength(uint64(padLength)) == prefixLength {
+				buffer := bytes.NewBuffer(append([]byte{}, metadata...))
+				writeMetadataField(buffer, metadataTagPadding, make([]byte, padLength))
+				return buffer.Bytes(), nil
+			}
+		}
+		target += lengthClass
+	}
+}
+
+// uvarintLength returns the length of the uvarint encoding of x
+func uvarintLength(x uint64) int {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(buf, x)
+}
+
+// writeMetadataField writes a tag-length-value metadata field to the buffer
+func writeMetadataField(buffer *bytes.Buffer, tag uint8, value []byte) {
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(value)))
+	buffer.WriteByte(tag)
+	buffer.Write(length[:n])
+	buffer.Write(value)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMetadataSerialization(t *testing.T) {
+	tests := []BreachMetadata{
+		{},
+		{Raw: []byte("legacy metadata")},
+		{Name: "Example Breach"},
+		{
+			Name:        "Example Breach",
+			Date:        "2021-12-01",
+			DataClasses: []string{"email addresses", "passwords"},
+			SourceURL:   "https://example.com/breach",
+			Raw:         []byte{0x00, 0x01, 0x02},
+		},
+		{Date: "1969-07-20"},
+		{Variation: "capitalization differs", Raw: []byte("legacy metadata")},
+	}
+	for i, test := range tests {
+		data, err := EncodeMetadata(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := DecodeMetadata(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result, test) {
+			t.Errorf("failed test %d: want %+v, got %+v", i, test, result)
+		}
+	}
+}
+
+func TestMetadataLegacy(t *testing.T) {
+	// metadata holding only raw bytes is stored as-is
+	raw := []byte("legacy metadata")
+	data, err := EncodeMetadata(BreachMetadata{Raw: raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, raw) {
+		t.Errorf("want %v, got %v", raw, data)
+	}
+
+	// unknown fields are skipped
+	data = append(append([]byte{}, MetadataMagic...), MetadataVersion, 0x7f, 0x02, 0xaa, 0xbb, metadataTagName, 0x01, 'a')
+	result, err := DecodeMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Name != "a" {
+		t.Errorf("want name %q, got %q", "a", result.Name)
+	}
+}
+
+func TestMetadataErrors(t *testing.T) {
+	if _, err := EncodeMetadata(BreachMetadata{Date: "December 1st"}); err == nil {
+		t.Errorf("expected an invalid date to fail")
+	}
+
+	header := append(append([]byte{}, MetadataMagic...), MetadataVersion)
+	tests := [][]byte{
+		MetadataMagic,
+		append(append([]byte{}, MetadataMagic...), MetadataVersion+1),
+		append(append([]byte{}, header...), metadataTagName, 0x05, 'a'),
+		append(append([]byte{}, header...), metadataTagName),
+		append(append([]byte{}, header...), metadataTagDate, 0x00),
+	}
+	for i, test := range tests {
+		if _, err := DecodeMetadata(test); err == nil {
+			t.Errorf("failed test %d: expected decoding %v to fail", i, test)
+		}
+	}
+}
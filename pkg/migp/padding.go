@@ -0,0 +1,278 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// dummySecretSize is the size of the random secrets under which dummy entries
+// are encrypted. No client can derive these secrets, so dummy entries never
+// match a query.
+const dummySecretSize = 32
+
+// EmptyBucketPaddingSalt separates the keys deriving the padding of empty
+// buckets from other uses of the OPRF private key.
+var EmptyBucketPaddingSalt = []byte("MIGP empty bucket padding")
+
+// PaddingConfig configures how a server hides the number of entries in its
+// buckets and the length of their metadata. The zero value disables padding.
+type PaddingConfig struct {
+	// BucketEntries is the minimum number of entries in a bucket. Buckets
+	// with more entries are padded to the next multiple of BucketEntries.
+	BucketEntries int `json:"bucketEntries,omitempty"`
+	// BucketBytes is the size class of buckets in bytes. Buckets are
+	// padded to the next multiple of BucketBytes, after any padding to
+	// BucketEntries. Byte classes are only exact if all entries have the
+	// same length, so BucketBytes requires a MetadataLength that holds the
+	// metadata of every entry, and must be a multiple of the entry length.
+	BucketBytes int `json:"bucketBytes,omitempty"`
+	// MetadataLength is the length class of entry metadata in bytes.
+	// Metadata is padded to the next multiple of MetadataLength before
+	// encryption. Padded metadata is always structured, so clients should
+	// read it with DecodeMetadata.
+	MetadataLength int `json:"metadataLength,omitempty"`
+}
+
+// validate checks that the padding configuration is well-formed
+func (c PaddingConfig) validate() error {
+	if c.BucketEntries < 0 || c.BucketBytes < 0 || c.MetadataLength < 0 {
+		return errors.New("padding parameters must not be negative")
+	}
+	return nil
+}
+
+// setPadding validates the padding configuration against the server's bucket
+// encryptor and sets it
+func (s *Server) setPadding(cfg PaddingConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.BucketBytes > 0 {
+		if cfg.MetadataLength == 0 {
+			return errors.New("padding to bucket bytes requires a metadata length")
+		}
+		emptyMetadata, err := padMetadata(nil, cfg.MetadataLength)
+		if err != nil {
+			return err
+		}
+		if len(emptyMetadata) != cfg.MetadataLength {
+			return fmt.Errorf("metadata length %d is too short to hold padded metadata", cfg.MetadataLength)
+		}
+		overhead, err := s.bodyOverhead()
+		if err != nil {
+			return err
+		}
+		entryLength := HeaderSize + overhead + cfg.MetadataLength
+		if cfg.BucketBytes%entryLength != 0 {
+			return fmt.Errorf("bucket bytes must be a multiple of the entry length %d", entryLength)
+		}
+	}
+	s.padding = cfg
+	return nil
+}
+
+// PadBucket finalizes a bucket by appending dummy entries, according to the
+// server's padding configuration. Dummy entries are encrypted under random
+// secrets and have body lengths drawn from the real entries of the bucket, so
+// they cannot be told apart from real entries without the matching
+// credentials. An empty bucket is padded like any other, with dummy entries
+// holding padded empty metadata; use PadEmptyBucket to serve buckets that
+// were never stored. A bucket must only be padded once, after all of its
+// entries have been added.
+func (s *Server) PadBucket(bucket []byte) ([]byte, error) {
+	return s.padBucket(bucket, nil, rand.Reader)
+}
+
+// PadEmptyBucket returns the padding of an empty bucket under the given key
+// epoch. Its dummy entries are derived from the epoch's private key and the
+// bucket ID, so the bucket is the same on every request, like a stored one.
+// Their body lengths are drawn from bodyLengths, which should be sampled from
+// the stored buckets with BucketBodyLengths so that empty buckets do not stand
+// out. If bodyLengths is empty, dummy entries hold padded empty metadata.
+func (s *Server) PadEmptyBucket(keyID uint32, bucketID string, bodyLengths []int) ([]byte, error) {
+	key, err := s.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := key.privateKey.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(EmptyBucketPaddingSalt)
+	h.Write(privateKey)
+	h.Write([]byte(bucketID))
+	return s.padBucket(nil, bodyLengths, newKeystreamReader(h.Sum(nil)))
+}
+
+// padBucket implements PadBucket, drawing dummy entries from rnd. The body
+// lengths of dummy entries are drawn from the real entries of the bucket or,
+// if it is empty, from emptyBodyLengths.
+func (s *Server) padBucket(bucket []byte, emptyBodyLengths []int, rnd io.Reader) ([]byte, error) {
+	if s.padding.BucketEntries == 0 && s.padding.BucketBytes == 0 {
+		return bucket, nil
+	}
+
+	bodyLengths, err := BucketBodyLengths(bucket)
+	if err != nil {
+		return nil, err
+	}
+	numEntries := len(bodyLengths)
+	overhead, err := s.bodyOverhead()
+	if err != nil {
+		return nil, err
+	}
+	if numEntries == 0 {
+		bodyLengths = emptyBodyLengths
+	}
+	if len(bodyLengths) == 0 {
+		emptyMetadata, err := padMetadata(nil, s.padding.MetadataLength)
+		if err != nil {
+			return nil, err
+		}
+		bodyLengths = []int{overhead + len(emptyMetadata)}
+	}
+	for _, bodyLength := range bodyLengths {
+		if bodyLength < overhead {
+			return nil, errors.New("bucket entry body shorter than encryption overhead")
+		}
+		if s.padding.BucketBytes > 0 && bodyLength != overhead+s.padding.MetadataLength {
+			return nil, errors.New("bucket entry length does not match the metadata length")
+		}
+	}
+
+	padded := append([]byte{}, bucket...)
+
+	if s.padding.BucketEntries > 0 {
+		target := s.padding.BucketEntries
+		if numEntries > target {
+			target = (numEntries + target - 1) / target * target
+		}
+		for ; numEntries < target; numEntries++ {
+			bodyLength, err := randomElement(bodyLengths, rnd)
+			if err != nil {
+				return nil, err
+			}
+			if padded, err = s.appendDummyEntry(padded, bodyLength-overhead, rnd); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if s.padding.BucketBytes > 0 {
+		// All entries have the same length, which divides the class, so
+		// the padded bucket fills the class exactly.
+		class := s.padding.BucketBytes
+		target := (len(padded) + class - 1) / class * class
+		if target == 0 {
+			target = class
+		}
+		for len(padded) < target {
+			if padded, err = s.appendDummyEntry(padded, s.padding.MetadataLength, rnd); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return padded, nil
+}
+
+// appendDummyEntry appends a dummy entry holding zeroed metadata of the given
+// length, encrypted under a secret drawn from rnd
+func (s *Server) appendDummyEntry(bucket []byte, metadataLength int, rnd io.Reader) ([]byte, error) {
+	secret := make([]byte, dummySecretSize)
+	if _, err := io.ReadFull(rnd, secret); err != nil {
+		return nil, err
+	}
+	var entry []byte
+	var err error
+	if encryptor, ok := s.bucketEncryptor.(randomizedBucketEncryptor); ok {
+		entry, err = encryptor.encryptWithRand(secret, MetadataDummy, make([]byte, metadataLength), rnd)
+	} else {
+		entry, err = s.bucketEncryptor.Encrypt(secret, MetadataDummy, make([]byte, metadataLength))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(bucket, entry...), nil
+}
+
+// randomizedBucketEncryptor is implemented by bucket encryptors whose
+// ciphertexts depend on randomness other than the secret, so that dummy
+// entries can be derived deterministically
+type randomizedBucketEncryptor interface {
+	encryptWithRand(secret []byte, flag MetadataType, body []byte, rnd io.Reader) ([]byte, error)
+}
+
+// bodyOverhead returns the number of bytes the bucket encryptor adds to the
+// metadata in the body of an entry
+func (s *Server) bodyOverhead() (int, error) {
+	entry, err := s.bucketEncryptor.Encrypt(make([]byte, dummySecretSize), MetadataDummy, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(entry) - HeaderSize, nil
+}
+
+// BucketBodyLengths returns the body length of each entry in the bucket,
+// which is stored in plaintext in the entry header
+func BucketBodyLengths(bucket []byte) ([]int, error) {
+	var bodyLengths []int
+	for offset := 0; offset < len(bucket); {
+		if offset+HeaderSize > len(bucket) {
+			return nil, errors.New("parsing error in bucket")
+		}
+		bodyLength := int(binary.BigEndian.Uint32(bucket[offset+CtxtKeyCheckSize+1 : offset+HeaderSize]))
+		offset += HeaderSize + bodyLength
+		if offset > len(bucket) {
+			return nil, errors.New("parsing error in bucket")
+		}
+		bodyLengths = append(bodyLengths, bodyLength)
+	}
+	return bodyLengths, nil
+}
+
+// randomElement returns a uniformly random element of a non-empty slice,
+// drawn from rnd
+func randomElement(values []int, rnd io.Reader) (int, error) {
+	i, err := rand.Int(rnd, big.NewInt(int64(len(values))))
+	if err != nil {
+		return 0, err
+	}
+	return values[i.Int64()], nil
+}
+
+// newKeystreamReader returns a deterministic stream of random bytes, the
+// ChaCha20 keystream under the given 32-byte key
+func newKeystreamReader(key []byte) io.Reader {
+	cipher, err := chacha20.NewUnauthenticatedCipher(key, make([]byte, chacha20.NonceSize))
+	if err != nil {
+		// The key and nonce have valid sizes.
+		panic(err)
+	}
+	return &keystreamReader{cipher: cipher}
+}
+
+// keystreamReader reads the keystream of a stream cipher
+type keystreamReader struct {
+	cipher *chacha20.Cipher
+}
+
+// Read fills p with the next bytes of the keystream
+func (r *keystreamReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.cipher.XORKeyStream(p, p)
+	return len(p), nil
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPadMetadata(t *testing.T) {
+	for _, lengthClass := range []int{1, 16, 64, 130} {
+		for _, metadata := range [][]byte{
+			nil,
+			[]byte("legacy metadata"),
+			bytes.Repeat([]byte{'a'}, 200),
+		} {
+			padded, err := padMetadata(metadata, lengthClass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(padded)%lengthClass != 0 {
+				t.Errorf("class %d: padded length %d is not a multiple of the class", lengthClass, len(padded))
+			}
+			result, err := DecodeMetadata(padded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result.Raw, metadata) {
+				t.Errorf("class %d: want %v, got %v", lengthClass, metadata, result.Raw)
+			}
+		}
+	}
+
+	// every gap size can be filled, possibly using the next class
+	for length := 0; length < 300; length++ {
+		metadata := append(append([]byte{}, MetadataMagic...), MetadataVersion)
+		metadata = append(metadata, bytes.Repeat([]byte{0x7f, 0x00}, length/2)...)
+		padded, err := padMetadata(metadata, 130)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(padded)%130 != 0 {
+			t.Errorf("padded length %d is not a multiple of the class", len(padded))
+		}
+	}
+}
+
+func TestPadBucket(t *testing.T) {
+	username, password := []byte("username"), []byte("password")
+
+	for _, encryptorID := range []uint16{BucketEncryptorHKDFSHA256, BucketEncryptorAES256GCM} {
+		encryptor, err := NewBucketEncryptor(encryptorID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		overhead := encryptedLength(t, encryptor, nil) - HeaderSize
+
+		for _, test := range []struct {
+			padding      PaddingConfig
+			classEntries int
+		}{
+			{padding: PaddingConfig{BucketEntries: 8}},
+			{padding: PaddingConfig{MetadataLength: 256}, classEntries: 4},
+			{padding: PaddingConfig{BucketEntries: 4, MetadataLength: 256}, classEntries: 3},
+		} {
+			padding := test.padding
+			padding.BucketBytes = test.classEntries * (HeaderSize + overhead + padding.MetadataLength)
+			cfg := DefaultServerConfig()
+			cfg.BucketEncryptorID = encryptorID
+			cfg.Padding = padding
+			server, err := NewServer(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, numEntries := range []int{0, 1, 9} {
+				var bucket []byte
+				for i := 0; i < numEntries; i++ {
+					metadata := []byte("metadata" + strings.Repeat("!", 20*i))
+					entry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+					if err != nil {
+						t.Fatal(err)
+					}
+					bucket = append(bucket, entry...)
+				}
+				realLengths, err := BucketBodyLengths(bucket)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if numEntries == 0 {
+					emptyMetadata, err := padMetadata(nil, padding.MetadataLength)
+					if err != nil {
+						t.Fatal(err)
+					}
+					realLengths = []int{encryptedLength(t, encryptor, emptyMetadata) - HeaderSize}
+				}
+				minLength, maxLength := realLengths[0], realLengths[0]
+				for _, length := range realLengths {
+					if length < minLength {
+						minLength = length
+					}
+					if length > maxLength {
+						maxLength = length
+					}
+				}
+
+				padded, err := server.PadBucket(bucket)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(padded, bucket) {
+					t.Errorf("padding modified existing entries")
+				}
+				bodyLengths, err := BucketBodyLengths(padded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if padding.BucketEntries > 0 && padding.BucketBytes == 0 && len(bodyLengths)%padding.BucketEntries != 0 {
+					t.Errorf("%+v: got %d entries for %d real entries", padding, len(bodyLengths), numEntries)
+				}
+				if len(bodyLengths) < padding.BucketEntries {
+					t.Errorf("%+v: got %d entries, want at least %d", padding, len(bodyLengths), padding.BucketEntries)
+				}
+				// dummy entries have lengths within the range of the
+				// real entries
+				for _, length := range bodyLengths[numEntries:] {
+					if length < minLength || length > maxLength {
+						t.Errorf("%+v: dummy body length %d outside of the real range [%d, %d]", padding, length, minLength, maxLength)
+					}
+				}
+				if class := padding.BucketBytes; class > 0 && len(padded)%class != 0 {
+					t.Errorf("%+v: padded bucket size %d is not a multiple of the class", padding, len(padded))
+				}
+
+				client, err := NewClient(server.Config().Config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): padded}}
+				request, clientFinalize, err := client.Request(username, password)
+				if err != nil {
+					t.Fatal(err)
+				}
+				response, err := server.HandleRequest(request, kv)
+				if err != nil {
+					t.Fatal(err)
+				}
+				status, matches, err := clientFinalize.FinalizeAll(response)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantStatus := NotInBreach
+				if numEntries > 0 {
+					wantStatus = InBreach
+				}
+				if status != wantStatus || len(matches) != numEntries {
+					t.Errorf("%+v: got %s with %d matches for %d real entries", padding, status, len(matches), numEntries)
+				}
+			}
+		}
+	}
+}
+
+func TestPadBucketBytesConfig(t *testing.T) {
+	encryptor, err := NewBucketEncryptor(DefaultServerConfig().BucketEncryptorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entryLength := encryptedLength(t, encryptor, make([]byte, 64))
+
+	for _, test := range []struct {
+		padding PaddingConfig
+		valid   bool
+	}{
+		{PaddingConfig{BucketBytes: 4 * entryLength, MetadataLength: 64}, true},
+		{PaddingConfig{BucketBytes: 4 * entryLength}, false},
+		{PaddingConfig{BucketBytes: 4*entryLength + 1, MetadataLength: 64}, false},
+		{PaddingConfig{BucketBytes: 4 * (entryLength - 63), MetadataLength: 1}, false},
+	} {
+		cfg := DefaultServerConfig()
+		cfg.Padding = test.padding
+		_, err := NewServer(cfg)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%+v: got valid %v, want %v (%v)", test.padding, valid, test.valid, err)
+		}
+	}
+
+	cfg := DefaultServerConfig()
+	cfg.Padding = PaddingConfig{BucketBytes: 4 * entryLength, MetadataLength: 64}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.EncryptBucketEntry([]byte("username"), []byte("password"), MetadataBreachedPassword, make([]byte, 64)); err == nil {
+		t.Errorf("metadata longer than the metadata length was accepted")
+	}
+}
+
+func TestPadEmptyBucket(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.BucketEncryptorID = BucketEncryptorAES256GCM
+	cfg.Padding = PaddingConfig{BucketEntries: 8, MetadataLength: 32}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := server.CurrentKeyID()
+	bodyLengths := []int{100, 200, 300}
+
+	first, err := server.PadEmptyBucket(keyID, "00001", bodyLengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := server.PadEmptyBucket(keyID, "00001", bodyLengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("padding of an empty bucket differs between calls")
+	}
+	other, err := server.PadEmptyBucket(keyID, "00002", bodyLengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, other) {
+		t.Errorf("empty buckets with different IDs have the same padding")
+	}
+
+	lengths, err := BucketBodyLengths(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lengths) != 8 {
+		t.Errorf("got %d entries, want 8", len(lengths))
+	}
+	for _, length := range lengths {
+		if length != 100 && length != 200 && length != 300 {
+			t.Errorf("dummy body length %d not drawn from %v", length, bodyLengths)
+		}
+	}
+
+	if _, err := server.PadEmptyBucket(keyID+1, "00001", bodyLengths); err == nil {
+		t.Errorf("padding under an unknown key epoch succeeded")
+	}
+}
+
+// encryptedLength returns the length of an entry holding the given metadata
+func encryptedLength(t *testing.T, encryptor BucketEncryptor, metadata []byte) int {
+	entry, err := encryptor.Encrypt(make([]byte, dummySecretSize), MetadataDummy, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entry)
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultInitialBackoff is the delay before the first retry of a
+	// failed query, doubled on each subsequent retry.
+	DefaultInitialBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff is the maximum delay between two retries.
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// QueryClientConfig configures the HTTP transport of a QueryClient. The zero
+// value uses http.DefaultClient and does not retry failed requests.
+type QueryClientConfig struct {
+	// HTTPClient is the client used to send requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+	// BaseURL is the URL of the MIGP server, without the endpoint path,
+	// e.g., https://migp.cloudflare.com
+	BaseURL string
+	// Header holds additional headers to set on every request.
+	Header http.Header
+	// MaxRetries is the number of times a request is retried after a
+	// network error or a 5xx or 429 response.
+	MaxRetries int
+	// InitialBackoff and MaxBackoff bound the exponential backoff between
+	// retries. Zero values select DefaultInitialBackoff and
+	// DefaultMaxBackoff. A Retry-After header sent by the server takes
+	// precedence over the computed backoff, even beyond MaxBackoff. If the
+	// requested delay would exceed the deadline of the context, the query
+	// fails at once with the StatusError of the response.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// QueryClient is a long-lived MIGP client that submits queries to a MIGP
+// server over HTTP. It is safe for concurrent use.
+type QueryClient struct {
+	client         *Client
+	httpClient     *http.Client
+	baseURL        string
+	header         http.Header
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// StatusError is returned when the MIGP server answers with a non-200
+// status code.
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Request failed with status code %d", e.StatusCode)
+}
+
+// NewQueryClient returns a new QueryClient for the given MIGP configuration.
+func NewQueryClient(cfg Config, qcfg QueryClientConfig) (*QueryClient, error) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &QueryClient{
+		client:         client,
+		httpClient:     qcfg.HTTPClient,
+		baseURL:        strings.TrimSuffix(qcfg.BaseURL, "/"),
+		header:         qcfg.Header.Clone(),
+		maxRetries:     qcfg.MaxRetries,
+		initialBackoff: qcfg.InitialBackoff,
+		maxBackoff:     qcfg.MaxBackoff,
+	}
+	if q.httpClient == nil {
+		q.httpClient = http.DefaultClient
+	}
+	if q.initialBackoff <= 0 {
+		q.initialBackoff = DefaultInitialBackoff
+	}
+	if q.maxBackoff <= 0 {
+		q.maxBackoff = DefaultMaxBackoff
+	}
+	return q, nil
+}
+
+// FetchConfig retrieves the MIGP configuration advertised by the server at
+// baseURL. If httpClient is nil, http.DefaultClient is used.
+func FetchConfig(ctx context.Context, httpClient *http.Client, baseURL string) (Config, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(baseURL, "/")+"/config", nil)
+	if err != nil {
+		return Config{}, err
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return Config{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return Config{}, &StatusError{StatusCode: response.StatusCode}
+	}
+
+	var cfg Config
+	if err := json.NewDecoder(response.Body).Decode(&cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Query checks a credential pair against the server's /evaluate endpoint.
+func (q *QueryClient) Query(ctx context.Context, username, password []byte) (BreachStatus, []byte, error) {
+	return q.queryURL(ctx, q.baseURL+"/evaluate", username, password)
+}
+
+// QueryAll is like Query, but returns every bucket entry matching the
+// credential pair, along with the overall status computed by
+// ClientRequestContext.FinalizeAll.
+func (q *QueryClient) QueryAll(ctx context.Context, username, password []byte) (BreachStatus, []BucketMatch, error) {
+	migpRequest, requestContext, err := q.client.RequestContext(ctx, username, password)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+
+	body, err := q.post(ctx, q.baseURL+"/evaluate", migpRequest)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+
+	responsePayload, err := q.client.ParseResponse(body)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+
+	return requestContext.FinalizeAll(responsePayload)
+}
+
+// QueryBatch checks a batch of credentials against the server's
+// /evaluate-batch endpoint in a single round trip.
+func (q *QueryClient) QueryBatch(ctx context.Context, credentials []Credential) ([]BatchResult, error) {
+	return q.queryBatchURL(ctx, q.baseURL+"/evaluate-batch", credentials)
+}
+
+// queryURL submits a single query to the given evaluation endpoint
+func (q *QueryClient) queryURL(ctx context.Context, targetURL string, username, password []byte) (BreachStatus, []byte, error) {
+	migpRequest, requestContext, err := q.client.RequestContext(ctx, username, password)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+
+	body, err := q.post(ctx, targetURL, migpRequest)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+
+	responsePayload, err := q.client.ParseResponse(body)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+
+	return requestContext.Finalize(responsePayload)
+}
+
+// queryBatchURL submits a batch query to the given evaluation endpoint
+func (q *QueryClient) queryBatchURL(ctx context.Context, targetURL string, credentials []Credential) ([]BatchResult, error) {
+	migpRequest, requestContext, err := q.client.RequestBatchContext(ctx, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := q.post(ctx, targetURL, migpRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var responsePayload ServerBatchResponse
+	if err := responsePayload.UnmarshalBinary(body); err != nil {
+		return nil, err
+	}
+
+	return requestContext.Finalize(responsePayload)
+}
+
+// post submits a JSON-encoded request payload to the target URL and returns
+// the response body, retrying on network errors and retryable status codes.
+func (q *QueryClient) post(ctx context.Context, targetURL string, payload interface{}) ([]byte, error) {
+	serializedRequestPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	// Reject malformed URLs up front rather than retrying them.
+	if _, err := http.NewRequestWithContext(ctx, "POST", targetURL, nil); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		body, retryAfter, err := q.postOnce(ctx, targetURL, serializedRequestPayload)
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= q.maxRetries || !retryable(err) {
+			return nil, err
+		}
+
+		delay := retryAfter
+		if delay <= 0 {
+			delay = q.backoff(attempt)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			// Waiting would exceed the deadline, so fail now.
+			return nil, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// postOnce performs a single HTTP request, returning the response body or an
+// error together with any delay requested by the server
+func (q *QueryClient) postOnce(ctx context.Context, targetURL string, payload []byte) ([]byte, time.Duration, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", targetURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, 0, err
+	}
+	for name, values := range q.header {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := q.httpClient.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		retryAfter := parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+		return nil, retryAfter, &StatusError{StatusCode: response.StatusCode, RetryAfter: retryAfter}
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	return body, 0, err
+}
+
+// backoff returns the delay before the given retry attempt, using exponential
+// backoff with jitter
+func (q *QueryClient) backoff(attempt int) time.Duration {
+	delay := q.initialBackoff
+	for i := 0; i < attempt && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	// Wait between half and all of the computed delay.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryable reports whether a failed request should be retried
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	// Any other error comes from the transport.
+	return true
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestHTTPServer returns an HTTP server answering MIGP queries, which
+// fails the first failures requests with the given status code
+func newTestHTTPServer(t *testing.T, server *Server, kv Getter, failures int32, failureStatus int) (*httptest.Server, *int32) {
+	var calls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewEncoder(w).Encode(server.Config().Config); err != nil {
+			t.Error(err)
+		}
+	})
+	mux.HandleFunc("/evaluate", func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, http.StatusText(failureStatus), failureStatus)
+			return
+		}
+		if req.Header.Get("X-Test") != "migp" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var request ClientRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Error(err)
+		}
+		response, err := server.HandleRequest(request, kv)
+		if err != nil {
+			t.Error(err)
+		}
+		data, err := response.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write(data)
+	})
+	return httptest.NewServer(mux), &calls
+}
+
+// TestQueryClient checks that the query client retries server errors, sets
+// custom headers, and fetches the server configuration
+func TestQueryClient(t *testing.T) {
+	username, password, metadata := []byte("username"), []byte("password"), []byte("metadata")
+
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): newEntry}}
+
+	httpServer, calls := newTestHTTPServer(t, server, kv, 2, http.StatusServiceUnavailable)
+	defer httpServer.Close()
+
+	ctx := context.Background()
+	cfg, err := FetchConfig(ctx, httpServer.Client(), httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := make(http.Header)
+	header.Set("X-Test", "migp")
+	client, err := NewQueryClient(cfg, QueryClientConfig{
+		HTTPClient:     httpServer.Client(),
+		BaseURL:        httpServer.URL,
+		Header:         header,
+		MaxRetries:     2,
+		InitialBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, md, err := client.Query(ctx, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != InBreach || !bytes.Equal(md, metadata) {
+		t.Errorf("got %s '%s' (expected: %s '%s')", status, md, InBreach, metadata)
+	}
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Errorf("want %d calls, got %d", 3, n)
+	}
+}
+
+// TestQueryClientErrors checks that client errors are not retried, and that
+// retries give up once the retry budget is exhausted
+func TestQueryClientErrors(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{}}
+
+	for _, test := range []struct {
+		status     int
+		maxRetries int
+		wantCalls  int32
+	}{
+		{http.StatusBadRequest, 3, 1},
+		{http.StatusInternalServerError, 2, 3},
+		{http.StatusTooManyRequests, 1, 2},
+	} {
+		httpServer, calls := newTestHTTPServer(t, server, kv, 100, test.status)
+		client, err := NewQueryClient(server.Config().Config, QueryClientConfig{
+			HTTPClient:     httpServer.Client(),
+			BaseURL:        httpServer.URL,
+			MaxRetries:     test.maxRetries,
+			InitialBackoff: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = client.Query(context.Background(), []byte("username"), []byte("password"))
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status {
+			t.Errorf("want status error %d, got %v", test.status, err)
+		}
+		if n := atomic.LoadInt32(calls); n != test.wantCalls {
+			t.Errorf("status %d: want %d calls, got %d", test.status, test.wantCalls, n)
+		}
+		httpServer.Close()
+	}
+}
+
+// TestQueryClientRetryAfter checks that a Retry-After header is honored
+// beyond the maximum backoff, and that a query fails at once if the
+// requested delay exceeds its deadline
+func TestQueryClientRetryAfter(t *testing.T) {
+	var calls int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+		} else {
+			w.Header().Set("Retry-After", "30")
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}))
+	defer httpServer.Close()
+
+	client, err := NewQueryClient(DefaultConfig(), QueryClientConfig{
+		HTTPClient:     httpServer.Client(),
+		BaseURL:        httpServer.URL,
+		MaxRetries:     5,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, _, err = client.Query(ctx, []byte("username"), []byte("password"))
+	elapsed := time.Since(start)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter != 30*time.Second {
+		t.Errorf("want status error with a 30s delay, got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("want 2 calls, got %d", n)
+	}
+	if elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("want the query to wait for the 1s delay and then fail, took %s", elapsed)
+	}
+}
+
+// TestQueryClientCancel checks that a query returns promptly once its context
+// is done, including while the slow hash is running
+func TestQueryClientCancel(t *testing.T) {
+	client, err := NewQueryClient(DefaultConfig(), QueryClientConfig{BaseURL: "http://localhost:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := client.Query(ctx, []byte("username"), []byte("password")); !errors.Is(err, context.Canceled) {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	credentials := make([]Credential, 100)
+	for i := range credentials {
+		credentials[i] = Credential{[]byte("username"), []byte("password")}
+	}
+	start := time.Now()
+	if _, err := client.QueryBatch(ctx, credentials); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled batch query took %s", elapsed)
+	}
+}
+
+// TestParseRetryAfter tests parsing of Retry-After header values
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in  string
+		out time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{"Wed, 01 Dec 2021 00:00:10 GMT", 10 * time.Second},
+		{"soon", 0},
+	}
+	for i, test := range tests {
+		if result := parseRetryAfter(test.in, now); result != test.out {
+			t.Errorf("failed test %d: want %s, got %s", i, test.out, result)
+		}
+	}
+}
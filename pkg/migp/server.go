@@ -10,24 +10,48 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/cloudflare/circl/oprf"
 )
 
+// MaxBatchSize is the maximum number of credentials a server will evaluate in
+// a single batch request.
+const MaxBatchSize = 1024
+
 // Server implements the server-side functionality of MIGP, with
 // two primary functionalities: FullEvaluate, to evaluate a
 // (username, password) tuple and store it in the backing database,
 // and HandleRequest, to process a Client request and return the
 // corresponding bucket data.
+//
+// A server holds one or more OPRF key epochs, identified by key ID. The
+// current key is advertised to clients and used for new bucket entries, while
+// the other keys continue to serve requests from clients that were configured
+// before a key rotation.
 type Server struct {
 	version         uint16
 	bucketIDBitSize int
 	bucketHasher    BucketHasher
 	bucketEncryptor BucketEncryptor
 	slowHasher      SlowHasher
-	oprfServer      *oprf.Server
+	slowHashParams  SlowHasherParams
+	canonicalizer   UsernameCanonicalizer
 	oprfSuite       oprf.SuiteID
-	privateKey      *oprf.PrivateKey
+	oprfMode        oprf.Mode
+	padding         PaddingConfig
+
+	keysLock     sync.RWMutex
+	keys         map[uint32]*serverKey
+	currentKeyID uint32
+}
+
+// serverKey holds the OPRF state for a single key epoch
+type serverKey struct {
+	privateKey *oprf.PrivateKey
+	oprfServer *oprf.Server
 }
 
 // ServerConfig stores all version information associated with a given server.
@@ -35,12 +59,16 @@ type Server struct {
 type ServerConfig struct {
 	Config
 	PrivateKey *oprf.PrivateKey
+	// Padding configures the padding of buckets and metadata. It is not
+	// shared with clients.
+	Padding PaddingConfig
 }
 
 // auxServerConfig is used for custom JSON (un)marshaling of ServerConfig
 type auxServerConfig struct {
 	Config
-	PrivateKey []byte `json:"privateKey"`
+	PrivateKey []byte        `json:"privateKey"`
+	Padding    PaddingConfig `json:"padding"`
 }
 
 // MarshalJSON serializes a server configuration to JSON
@@ -52,6 +80,7 @@ func (c *ServerConfig) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&auxServerConfig{
 		Config:     c.Config,
 		PrivateKey: serializedPrivateKey,
+		Padding:    c.Padding,
 	})
 }
 
@@ -62,6 +91,7 @@ func (c *ServerConfig) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	c.Config = aux.Config
+	c.Padding = aux.Padding
 	c.PrivateKey = new(oprf.PrivateKey)
 	if err := c.PrivateKey.Deserialize(aux.OPRFSuite, aux.PrivateKey); err != nil {
 		return err
@@ -72,32 +102,98 @@ func (c *ServerConfig) UnmarshalJSON(data []byte) error {
 // Config returns an inspectable ServerConfig associated
 // with the given server.
 func (s *Server) Config() *ServerConfig {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	return s.configForKey(s.currentKeyID, s.keys[s.currentKeyID])
+}
+
+// ConfigForKey returns the ServerConfig associated with the given key epoch.
+func (s *Server) ConfigForKey(keyID uint32) (*ServerConfig, error) {
+	key, err := s.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return s.configForKey(keyID, key), nil
+}
+
+// configForKey returns the ServerConfig for the given key epoch
+func (s *Server) configForKey(keyID uint32, key *serverKey) *ServerConfig {
+	var publicKey []byte
+	if s.oprfMode == oprf.VerifiableMode {
+		var err error
+		publicKey, err = key.oprfServer.GetPublicKey().Serialize()
+		if err != nil {
+			// The key was validated when the server was created.
+			panic(err)
+		}
+	}
 	return &ServerConfig{
 		Config: Config{
 			Version:           s.version,
 			BucketIDBitSize:   s.bucketIDBitSize,
 			BucketHasherID:    s.bucketHasher.ID(),
 			SlowHasherID:      s.slowHasher.ID(),
+			SlowHasherParams:  s.slowHashParams,
 			BucketEncryptorID: s.bucketEncryptor.ID(),
 			OPRFSuite:         s.oprfSuite,
+			OPRFMode:          s.oprfMode,
+			KeyID:             keyID,
+			PublicKey:         publicKey,
+
+			UsernameCanonicalizerID: s.canonicalizer.ID(),
 		},
-		PrivateKey: s.privateKey,
+		PrivateKey: key.privateKey,
+		Padding:    s.padding,
 	}
 }
 
 // DefaultServerConfig generates a new default server state with a freshly keyed OPRF instance.
 func DefaultServerConfig() ServerConfig {
-	privateKey, err := oprf.GenerateKey(DefaultOPRFSuite, rand.Reader)
+	cfg, err := NewServerConfig(DefaultConfig())
 	if err != nil {
 		// This will only occur in the event of developer error as we
 		// supply working defaults.
 		panic(err)
 	}
+	return cfg
+}
+
+// NewServerConfig generates a new server state for the given configuration,
+// with a fresh private key for the configured OPRF suite. The slow hasher
+// parameters left at zero are set to their defaults, so that the
+// configuration records the parameters in use.
+func NewServerConfig(cfg Config) (ServerConfig, error) {
+	if _, _, err := oprfSizes(cfg.OPRFSuite); err != nil {
+		return ServerConfig{}, err
+	}
+	if err := cfg.SlowHasherParams.Validate(cfg.SlowHasherID); err != nil {
+		return ServerConfig{}, err
+	}
+	cfg.SlowHasherParams = cfg.SlowHasherParams.withDefaults(cfg.SlowHasherID)
+	privateKey, err := oprf.GenerateKey(cfg.OPRFSuite, rand.Reader)
+	if err != nil {
+		return ServerConfig{}, err
+	}
 
+	cfg.PublicKey = nil
 	return ServerConfig{
-		Config:     DefaultConfig(),
+		Config:     cfg,
 		PrivateKey: privateKey,
+	}, nil
+}
+
+// Rotate returns a copy of the server configuration with a freshly generated
+// private key and the next key ID.
+func (c ServerConfig) Rotate() (ServerConfig, error) {
+	privateKey, err := oprf.GenerateKey(c.OPRFSuite, rand.Reader)
+	if err != nil {
+		return ServerConfig{}, err
 	}
+	next := c
+	next.KeyID = c.KeyID + 1
+	next.PublicKey = nil
+	next.PrivateKey = privateKey
+	return next, nil
 }
 
 // NewServer initializes and returns a new MIGP server from the given
@@ -114,34 +210,125 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 		return nil, err
 	}
 
-	s.slowHasher, err = NewSlowHasher(cfg.SlowHasherID)
+	s.slowHasher, err = NewSlowHasherWithParams(cfg.SlowHasherID, cfg.SlowHasherParams)
 	if err != nil {
 		return nil, err
 	}
+	s.slowHashParams = cfg.SlowHasherParams.withDefaults(cfg.SlowHasherID)
 
 	s.bucketEncryptor, err = NewBucketEncryptor(cfg.BucketEncryptorID)
 	if err != nil {
 		return nil, err
 	}
 
+	s.canonicalizer, err = NewUsernameCanonicalizer(cfg.UsernameCanonicalizerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.setPadding(cfg.Padding); err != nil {
+		return nil, err
+	}
+
 	s.oprfSuite = cfg.OPRFSuite
-	s.privateKey = cfg.PrivateKey
+	s.oprfMode = cfg.OPRFMode
+	s.keys = make(map[uint32]*serverKey)
 
-	s.oprfServer, err = oprf.NewServer(s.oprfSuite, s.privateKey)
-	if err != nil {
+	if err := s.AddKey(cfg.KeyID, cfg.PrivateKey); err != nil {
 		return nil, err
 	}
+	s.currentKeyID = cfg.KeyID
 	return s, nil
 }
 
+// AddKey adds a key epoch to the server. The new key does not become current
+// until SetCurrentKey is called, so that bucket entries can be built under
+// the new key while clients are still served under the current one.
+func (s *Server) AddKey(keyID uint32, privateKey *oprf.PrivateKey) error {
+	oprfServer, err := newOPRFServer(s.oprfSuite, s.oprfMode, privateKey)
+	if err != nil {
+		return err
+	}
+
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+	if _, ok := s.keys[keyID]; ok {
+		return fmt.Errorf("key ID %d already in use", keyID)
+	}
+	s.keys[keyID] = &serverKey{
+		privateKey: privateKey,
+		oprfServer: oprfServer,
+	}
+	return nil
+}
+
+// SetCurrentKey makes the given key epoch the one advertised to clients and
+// used by EncryptBucketEntry.
+func (s *Server) SetCurrentKey(keyID uint32) error {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+	if _, ok := s.keys[keyID]; !ok {
+		return fmt.Errorf("unknown key ID %d", keyID)
+	}
+	s.currentKeyID = keyID
+	return nil
+}
+
+// RemoveKey removes a retired key epoch from the server. The current key
+// cannot be removed.
+func (s *Server) RemoveKey(keyID uint32) error {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+	if keyID == s.currentKeyID {
+		return errors.New("cannot remove the current key")
+	}
+	if _, ok := s.keys[keyID]; !ok {
+		return fmt.Errorf("unknown key ID %d", keyID)
+	}
+	delete(s.keys, keyID)
+	return nil
+}
+
+// CurrentKeyID returns the ID of the current key epoch.
+func (s *Server) CurrentKeyID() uint32 {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	return s.currentKeyID
+}
+
+// KeyIDs returns the IDs of all key epochs held by the server, in ascending
+// order.
+func (s *Server) KeyIDs() []uint32 {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	keyIDs := make([]uint32, 0, len(s.keys))
+	for keyID := range s.keys {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Slice(keyIDs, func(i, j int) bool { return keyIDs[i] < keyIDs[j] })
+	return keyIDs
+}
+
+// key returns the state for the given key epoch
+func (s *Server) key(keyID uint32) (*serverKey, error) {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %d", keyID)
+	}
+	return key, nil
+}
+
 // deriveBucketEntryKey derives a bucket entry key from a credential pair
-func (s *Server) deriveBucketEntryKey(username []byte, password []byte) ([]byte, error) {
+func (s *Server) deriveBucketEntryKey(key *serverKey, username []byte, password []byte) ([]byte, error) {
 	input := s.slowHasher.Hash(serializeUsernamePassword(username, password))
-	return s.oprfServer.FullEvaluate(input, OprfInfo)
+	return key.oprfServer.FullEvaluate(input, OprfInfo)
 }
 
 // BucketID returns the bucket ID for the given username
 func (s *Server) BucketID(username []byte) uint32 {
+	username = s.canonicalizer.Canonicalize(username)
 	return bucketHashToID(s.bucketHasher.Hash(username), s.bucketIDBitSize)
 }
 
@@ -150,26 +337,57 @@ func (s *Server) BucketID(username []byte) uint32 {
 // items. The return value is the bucket ID (2 byte hash of username) as well
 // as the ciphertext, both encoded as byte slices.
 func (s *Server) EncryptBucketEntry(username, password []byte, metadataFlag MetadataType, metadata []byte) ([]byte, error) {
+	return s.EncryptBucketEntryWithKey(s.CurrentKeyID(), username, password, metadataFlag, metadata)
+}
+
+// EncryptBucketEntryWithMetadata is like EncryptBucketEntry, but takes
+// structured breach metadata, which clients can decode with DecodeMetadata.
+func (s *Server) EncryptBucketEntryWithMetadata(username, password []byte, metadataFlag MetadataType, metadata BreachMetadata) ([]byte, error) {
+	encodedMetadata, err := metadata.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return s.EncryptBucketEntry(username, password, metadataFlag, encodedMetadata)
+}
+
+// EncryptBucketEntryWithKey is like EncryptBucketEntry, but encrypts the entry
+// under the given key epoch rather than the current one. This is used to build
+// the bucket data for a new key before it becomes current.
+func (s *Server) EncryptBucketEntryWithKey(keyID uint32, username, password []byte, metadataFlag MetadataType, metadata []byte) ([]byte, error) {
 	if !metadataFlag.Valid() {
-		return nil, errors.New("invalid metadata flag value: " + string(metadataFlag))
+		return nil, fmt.Errorf("invalid metadata flag value: %d", metadataFlag)
+	}
+	key, err := s.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	entryKey, err := s.deriveBucketEntryKey(key, s.canonicalizer.Canonicalize(username), password)
+	if err != nil {
+		return nil, err
 	}
-	key, err := s.deriveBucketEntryKey(username, password)
+	metadata, err = padMetadata(metadata, s.padding.MetadataLength)
 	if err != nil {
 		return nil, err
 	}
+	if s.padding.BucketBytes > 0 && len(metadata) != s.padding.MetadataLength {
+		return nil, fmt.Errorf("metadata does not fit in the metadata length of %d bytes", s.padding.MetadataLength)
+	}
 
-	return s.bucketEncryptor.Encrypt(key, metadataFlag, metadata)
+	return s.bucketEncryptor.Encrypt(entryKey, metadataFlag, metadata)
 }
 
-// ServerResponse wraps up the server's response state.
+// ServerResponse wraps up the server's response state. Proof is only set in
+// verifiable mode.
 type ServerResponse struct {
 	Version          uint32 `json:"version"`
 	EvaluatedElement []byte `json:"evaluatedElement"`
+	Proof            []byte `json:"proof,omitempty"`
 	BucketContents   []byte `json:"bucketContents"`
 }
 
 // MarshalBinary marshals the server response in the following binary format:
-// <32-bit version>|<evaluated-element>|<bucket-contents>
+// <32-bit version>|<evaluated-element>|<proof>|<bucket-contents>
+// where the proof is empty in base mode.
 func (r *ServerResponse) MarshalBinary() ([]byte, error) {
 	buffer := new(bytes.Buffer)
 	if err := binary.Write(buffer, binary.BigEndian, r.Version); err != nil {
@@ -178,40 +396,235 @@ func (r *ServerResponse) MarshalBinary() ([]byte, error) {
 	if _, err := buffer.Write(r.EvaluatedElement); err != nil {
 		return nil, err
 	}
+	if _, err := buffer.Write(r.Proof); err != nil {
+		return nil, err
+	}
 	if _, err := buffer.Write(r.BucketContents); err != nil {
 		return nil, err
 	}
 	return buffer.Bytes(), nil
 }
 
-// UnmarshalBinary unmarshals the server response from the following binary format:
+// UnmarshalBinary unmarshals a server response using the default OPRF suite
+// in base mode from the following binary format:
 // <32-bit version>|<evaluated-element>|<bucket-contents>
+// It only supports the default suite in base mode, and fails if the evaluated
+// element is not an element of the default suite's group. The length of the
+// evaluated element depends on the OPRF suite, so responses from servers
+// using any other suite or the verifiable mode must be parsed with
+// Client.ParseResponse or UnmarshalBinaryConfig instead.
 func (r *ServerResponse) UnmarshalBinary(data []byte) error {
+	return r.unmarshalBinary(data, DefaultOPRFSuite, 0)
+}
+
+// UnmarshalBinaryConfig unmarshals a server response produced under the OPRF
+// suite and mode of the given configuration.
+func (r *ServerResponse) UnmarshalBinaryConfig(cfg Config, data []byte) error {
+	proofLength, err := proofLength(cfg)
+	if err != nil {
+		return err
+	}
+	return r.unmarshalBinary(data, cfg.OPRFSuite, proofLength)
+}
+
+// unmarshalBinary unmarshals a server response given the OPRF suite and the
+// length of the evaluation proof
+func (r *ServerResponse) unmarshalBinary(data []byte, suite oprf.SuiteID, proofLength int) error {
 	buffer := bytes.NewBuffer(data)
 	if err := binary.Read(buffer, binary.BigEndian, &r.Version); err != nil {
 		return err
 	}
-	sizes, err := oprf.GetSizes(DefaultOPRFSuite)
+	elementLength, _, err := oprfSizes(suite)
 	if err != nil {
 		return err
 	}
-	r.EvaluatedElement = make([]byte, sizes.SerializedElementLength)
+	r.EvaluatedElement = make([]byte, elementLength)
 	if n, err := buffer.Read(r.EvaluatedElement); err != nil {
 		return err
 	} else if n != len(r.EvaluatedElement) {
 		return errors.New("too few bytes to deserialize EvaluatedElement")
 	}
+	// A public key is a group element, so deserializing the evaluated
+	// element as one checks that it belongs to the suite's group.
+	if err := new(oprf.PublicKey).Deserialize(suite, r.EvaluatedElement); err != nil {
+		return fmt.Errorf("invalid EvaluatedElement for OPRF suite 0x%04x: %v", suite, err)
+	}
+	r.Proof = nil
+	if proofLength > 0 {
+		r.Proof = make([]byte, proofLength)
+		if n, err := buffer.Read(r.Proof); err != nil {
+			return err
+		} else if n != len(r.Proof) {
+			return errors.New("too few bytes to deserialize Proof")
+		}
+	}
 	r.BucketContents = buffer.Bytes()
 	return nil
 }
 
+// ServerBatchResponse wraps up the server's response to a batch request.
+// EvaluatedElements are in request order, and Buckets maps each distinct
+// requested bucket ID to its contents. In verifiable mode, Proof covers all
+// evaluated elements.
+type ServerBatchResponse struct {
+	Version           uint32            `json:"version"`
+	EvaluatedElements [][]byte          `json:"evaluatedElements"`
+	Proof             []byte            `json:"proof,omitempty"`
+	Buckets           map[string][]byte `json:"buckets"`
+}
+
+// MarshalBinary marshals the server batch response in the following binary
+// format, with all integers big-endian and buckets sorted by ID:
+// <32-bit version>|<32-bit element count>|(<16-bit length>|<evaluated-element>)*|
+// <16-bit length>|<proof>|<32-bit bucket count>|(<16-bit length>|<bucket-id>|<32-bit length>|<bucket-contents>)*
+func (r *ServerBatchResponse) MarshalBinary() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.BigEndian, r.Version); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buffer, binary.BigEndian, uint32(len(r.EvaluatedElements))); err != nil {
+		return nil, err
+	}
+	for _, element := range r.EvaluatedElements {
+		if err := writeUint16Prefixed(buffer, element); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeUint16Prefixed(buffer, r.Proof); err != nil {
+		return nil, err
+	}
+
+	bucketIDs := make([]string, 0, len(r.Buckets))
+	for id := range r.Buckets {
+		bucketIDs = append(bucketIDs, id)
+	}
+	sort.Strings(bucketIDs)
+
+	if err := binary.Write(buffer, binary.BigEndian, uint32(len(bucketIDs))); err != nil {
+		return nil, err
+	}
+	for _, id := range bucketIDs {
+		if err := writeUint16Prefixed(buffer, []byte(id)); err != nil {
+			return nil, err
+		}
+		contents := r.Buckets[id]
+		if err := binary.Write(buffer, binary.BigEndian, uint32(len(contents))); err != nil {
+			return nil, err
+		}
+		if _, err := buffer.Write(contents); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary unmarshals the server batch response from the binary format
+// described in MarshalBinary.
+func (r *ServerBatchResponse) UnmarshalBinary(data []byte) error {
+	buffer := bytes.NewBuffer(data)
+	if err := binary.Read(buffer, binary.BigEndian, &r.Version); err != nil {
+		return err
+	}
+
+	var numElements uint32
+	if err := binary.Read(buffer, binary.BigEndian, &numElements); err != nil {
+		return err
+	}
+	if numElements > MaxBatchSize {
+		return errors.New("too many evaluated elements in batch response")
+	}
+	r.EvaluatedElements = make([][]byte, numElements)
+	for i := range r.EvaluatedElements {
+		element, err := readUint16Prefixed(buffer)
+		if err != nil {
+			return err
+		}
+		r.EvaluatedElements[i] = element
+	}
+	proof, err := readUint16Prefixed(buffer)
+	if err != nil {
+		return err
+	}
+	r.Proof = nil
+	if len(proof) > 0 {
+		r.Proof = proof
+	}
+
+	var numBuckets uint32
+	if err := binary.Read(buffer, binary.BigEndian, &numBuckets); err != nil {
+		return err
+	}
+	if numBuckets > numElements {
+		return errors.New("too many buckets in batch response")
+	}
+	r.Buckets = make(map[string][]byte, numBuckets)
+	for i := uint32(0); i < numBuckets; i++ {
+		id, err := readUint16Prefixed(buffer)
+		if err != nil {
+			return err
+		}
+		var length uint32
+		if err := binary.Read(buffer, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if int(length) > buffer.Len() {
+			return errors.New("too few bytes to deserialize bucket contents")
+		}
+		r.Buckets[string(id)] = append([]byte{}, buffer.Next(int(length))...)
+	}
+	if buffer.Len() != 0 {
+		return errors.New("trailing bytes in batch response")
+	}
+	return nil
+}
+
+// writeUint16Prefixed writes a byte string prefixed with its 16-bit big-endian length
+func writeUint16Prefixed(buffer *bytes.Buffer, b []byte) error {
+	if len(b) >= (1 << 16) {
+		return errors.New("length overflow")
+	}
+	if err := binary.Write(buffer, binary.BigEndian, uint16(len(b))); err != nil {
+		return err
+	}
+	_, err := buffer.Write(b)
+	return err
+}
+
+// readUint16Prefixed reads a byte string prefixed with its 16-bit big-endian length
+func readUint16Prefixed(buffer *bytes.Buffer) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(buffer, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if int(length) > buffer.Len() {
+		return nil, errors.New("too few bytes to deserialize length-prefixed value")
+	}
+	return append([]byte{}, buffer.Next(int(length))...), nil
+}
+
 // Getter defines the interface needed for fetching bucket items to insert into
 // a response. The caller should define an implementation of this interface
-// appropriate for their deployment.
+// appropriate for their deployment. Each key epoch has its own bucket data, so
+// callers holding several keys should pass the Getter matching the KeyID of
+// the request.
 type Getter interface {
 	Get(id string) ([]byte, error)
 }
 
+// checkBucketID checks that a requested bucket ID is the hex encoding of a
+// bucket ID of the configured size, as returned by BucketIDToHex, so that
+// requests cannot reference buckets that no username maps to
+func (s *Server) checkBucketID(id string) error {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return errors.New("bucket ID not valid hex")
+	}
+	if len(b) != 4 || binary.BigEndian.Uint32(b)>>s.bucketIDBitSize != 0 {
+		return fmt.Errorf("bucket ID is not a %d-bit bucket ID", s.bucketIDBitSize)
+	}
+	return nil
+}
+
 // HandleRequest takes as input a client request buffer and kv that implements
 // the Getter interface. The request is a JSON encoding of a bucket
 // identifier and oprf.IntValue  (a blinded group element) Should return a new
@@ -224,7 +637,12 @@ func (s *Server) HandleRequest(request ClientRequest, kv Getter) (ServerResponse
 		return ServerResponse{}, errors.New("requested version doesn't match server version")
 	}
 
-	evaluation, err := s.oprfServer.Evaluate([]oprf.Blinded{request.BlindElement}, OprfInfo)
+	key, err := s.key(request.KeyID)
+	if err != nil {
+		return ServerResponse{}, err
+	}
+
+	evaluation, err := key.oprfServer.Evaluate([]oprf.Blinded{request.BlindElement}, OprfInfo)
 	if err != nil {
 		return ServerResponse{}, err
 	}
@@ -232,9 +650,8 @@ func (s *Server) HandleRequest(request ClientRequest, kv Getter) (ServerResponse
 		return ServerResponse{}, errors.New("invalid Evaluation response")
 	}
 
-	_, err = hex.DecodeString(request.BucketID)
-	if err != nil {
-		return ServerResponse{}, errors.New("bucket ID not valid hex")
+	if err := s.checkBucketID(request.BucketID); err != nil {
+		return ServerResponse{}, err
 	}
 
 	bucketContents, err := kv.Get(request.BucketID)
@@ -245,6 +662,61 @@ func (s *Server) HandleRequest(request ClientRequest, kv Getter) (ServerResponse
 	return ServerResponse{
 		Version:          request.Version,
 		EvaluatedElement: evaluation.Elements[0],
+		Proof:            serializeProof(evaluation.Proof),
 		BucketContents:   bucketContents,
 	}, nil
 }
+
+// HandleBatchRequest evaluates all blinded elements in a batch request with a
+// single OPRF evaluation and returns the evaluated elements along with the
+// contents of each requested bucket. Buckets requested by several credentials
+// are only fetched and returned once.
+func (s *Server) HandleBatchRequest(request ClientBatchRequest, kv Getter) (ServerBatchResponse, error) {
+	if uint16(request.Version) != s.version {
+		return ServerBatchResponse{}, errors.New("requested version doesn't match server version")
+	}
+	if len(request.BlindElements) == 0 {
+		return ServerBatchResponse{}, errors.New("empty batch")
+	}
+	if len(request.BlindElements) > MaxBatchSize {
+		return ServerBatchResponse{}, fmt.Errorf("batch size exceeds maximum of %d", MaxBatchSize)
+	}
+	if len(request.BucketIDs) != len(request.BlindElements) {
+		return ServerBatchResponse{}, errors.New("mismatched number of bucket IDs and blinded elements")
+	}
+
+	key, err := s.key(request.KeyID)
+	if err != nil {
+		return ServerBatchResponse{}, err
+	}
+
+	evaluation, err := key.oprfServer.Evaluate(request.BlindElements, OprfInfo)
+	if err != nil {
+		return ServerBatchResponse{}, err
+	}
+	if len(evaluation.Elements) != len(request.BlindElements) {
+		return ServerBatchResponse{}, errors.New("invalid Evaluation response")
+	}
+
+	buckets := make(map[string][]byte)
+	for _, bucketID := range request.BucketIDs {
+		if _, ok := buckets[bucketID]; ok {
+			continue
+		}
+		if err := s.checkBucketID(bucketID); err != nil {
+			return ServerBatchResponse{}, err
+		}
+		bucketContents, err := kv.Get(bucketID)
+		if err != nil {
+			return ServerBatchResponse{}, err
+		}
+		buckets[bucketID] = bucketContents
+	}
+
+	return ServerBatchResponse{
+		Version:           request.Version,
+		EvaluatedElements: evaluation.Elements,
+		Proof:             serializeProof(evaluation.Proof),
+		Buckets:           buckets,
+	}, nil
+}
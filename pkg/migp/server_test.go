@@ -59,36 +59,252 @@ func TestSerialization(t *testing.T) {
 	}
 }
 
-// TestServerResponseSerialization tests the serialization of a MIGP server response
+// TestServerResponseSerialization tests the serialization of a MIGP server
+// response for each supported OPRF suite and mode
 func TestServerResponseSerialization(t *testing.T) {
+	for _, suite := range SupportedOPRFSuites {
+		for _, mode := range []oprf.Mode{oprf.BaseMode, oprf.VerifiableMode} {
+			cfg := DefaultConfig()
+			cfg.OPRFSuite, cfg.OPRFMode = suite, mode
+			privateKey, err := oprf.GenerateKey(suite, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// any group element will do as an evaluated element
+			element, err := privateKey.Public().Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			proofLength, err := proofLength(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r1 := ServerResponse{
+				Version:          123,
+				EvaluatedElement: element,
+				BucketContents:   []byte{1, 2, 3, 4, 5, 6, 7, 8, 9},
+			}
+			if proofLength > 0 {
+				r1.Proof = make([]byte, proofLength)
+				if _, err := rand.Read(r1.Proof); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := r1.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedLen := 4 + len(r1.EvaluatedElement) + len(r1.Proof) + len(r1.BucketContents)
+			if len(data) != expectedLen {
+				t.Fatalf("suite 0x%04x mode %d: want %d, got %d", suite, mode, expectedLen, len(data))
+			}
+
+			var r2 ServerResponse
+			if err = r2.UnmarshalBinaryConfig(cfg, data); err != nil {
+				t.Fatalf("suite 0x%04x mode %d: %v", suite, mode, err)
+			}
+			if r1.Version != r2.Version || !bytes.Equal(r1.EvaluatedElement, r2.EvaluatedElement) ||
+				!bytes.Equal(r1.Proof, r2.Proof) || !bytes.Equal(r1.BucketContents, r2.BucketContents) {
+				t.Fatalf("suite 0x%04x mode %d: mismatch", suite, mode)
+			}
+
+			if suite == DefaultOPRFSuite && mode == oprf.BaseMode {
+				var r3 ServerResponse
+				if err = r3.UnmarshalBinary(data); err != nil {
+					t.Fatal(err)
+				}
+				if r1.Version != r3.Version || !bytes.Equal(r1.EvaluatedElement, r3.EvaluatedElement) || !bytes.Equal(r1.BucketContents, r3.BucketContents) {
+					t.Fatal("mismatch")
+				}
+			}
+		}
+	}
+
+	// responses whose evaluated element is not a group element are rejected
 	sizes, err := oprf.GetSizes(DefaultOPRFSuite)
 	if err != nil {
 		t.Fatal(err)
 	}
-	r1 := ServerResponse{
-		123,
-		make([]byte, sizes.SerializedElementLength),
-		[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9},
+	data := make([]byte, 4+sizes.SerializedElementLength)
+	for i := 4; i < len(data); i++ {
+		data[i] = 0xff
 	}
-	if _, err := rand.Read(r1.EvaluatedElement); err != nil {
-		t.Fatal(err)
+	var r ServerResponse
+	if err := r.UnmarshalBinary(data); err == nil {
+		t.Error("response with an invalid evaluated element accepted")
+	}
+	if err := r.UnmarshalBinary(data[:10]); err == nil {
+		t.Error("truncated response accepted")
+	}
+}
+
+// TestServerBatchResponseSerialization tests the serialization of a MIGP
+// server batch response
+func TestServerBatchResponseSerialization(t *testing.T) {
+	r1 := ServerBatchResponse{
+		Version:           1,
+		EvaluatedElements: [][]byte{{1, 2, 3}, {4, 5, 6}},
+		Buckets: map[string][]byte{
+			"00000001": {7, 8, 9},
+			"00000002": {},
+		},
 	}
 	data, err := r1.MarshalBinary()
 	if err != nil {
 		t.Fatal(err)
 	}
-	expectedLen := 4 + len(r1.EvaluatedElement) + len(r1.BucketContents)
-	if len(data) != expectedLen {
-		t.Fatalf("want %d, got %d", expectedLen, len(data))
-	}
-
-	r2 := ServerResponse{}
 
+	r2 := ServerBatchResponse{}
 	if err = r2.UnmarshalBinary(data); err != nil {
 		t.Fatal(err)
 	}
 
-	if r1.Version != r2.Version || !bytes.Equal(r1.EvaluatedElement, r2.EvaluatedElement) || !bytes.Equal(r1.BucketContents, r2.BucketContents) {
+	if r1.Version != r2.Version || len(r1.EvaluatedElements) != len(r2.EvaluatedElements) || len(r1.Buckets) != len(r2.Buckets) {
 		t.Fatal("mismatch")
 	}
+	for i := range r1.EvaluatedElements {
+		if !bytes.Equal(r1.EvaluatedElements[i], r2.EvaluatedElements[i]) {
+			t.Fatalf("element %d mismatch", i)
+		}
+	}
+	for id, contents := range r1.Buckets {
+		if !bytes.Equal(contents, r2.Buckets[id]) {
+			t.Fatalf("bucket %s mismatch", id)
+		}
+	}
+
+	if err = r2.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Fatal("truncated response accepted")
+	}
+}
+
+// TestKeyRotation checks that a server keeps serving clients configured with
+// a previous key epoch while a new key is introduced and made current
+func TestKeyRotation(t *testing.T) {
+	username, password, metadata := []byte("username"), []byte("password"), []byte("metadata")
+
+	oldCfg := DefaultServerConfig()
+	newCfg, err := oldCfg.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newCfg.KeyID != oldCfg.KeyID+1 {
+		t.Fatalf("key ID: want %d, got %d", oldCfg.KeyID+1, newCfg.KeyID)
+	}
+
+	server, err := NewServer(oldCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddKey(newCfg.KeyID, newCfg.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddKey(newCfg.KeyID, newCfg.PrivateKey); err == nil {
+		t.Error("duplicate key ID accepted")
+	}
+
+	// each key epoch has its own bucket data
+	kvs := make(map[uint32]*KVMock)
+	bucketIDHex := BucketIDToHex(server.BucketID(username))
+	for _, keyID := range server.KeyIDs() {
+		newEntry, err := server.EncryptBucketEntryWithKey(keyID, username, password, MetadataBreachedPassword, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kvs[keyID] = &KVMock{store: map[string][]byte{bucketIDHex: newEntry}}
+	}
+
+	query := func(cfg Config) BreachStatus {
+		client, err := NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, clientFinalize, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request.KeyID != cfg.KeyID {
+			t.Fatalf("request key ID: want %d, got %d", cfg.KeyID, request.KeyID)
+		}
+		response, err := server.HandleRequest(request, kvs[request.KeyID])
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, err := clientFinalize.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	// clients pick up the current key from the server config
+	if current := server.Config().KeyID; current != oldCfg.KeyID {
+		t.Fatalf("current key ID: want %d, got %d", oldCfg.KeyID, current)
+	}
+	oldClientCfg := server.Config().Config
+	if status := query(oldClientCfg); status != InBreach {
+		t.Errorf("status: want %s, got %s", InBreach, status)
+	}
+
+	if err := server.SetCurrentKey(newCfg.KeyID); err != nil {
+		t.Fatal(err)
+	}
+	if current := server.Config().KeyID; current != newCfg.KeyID {
+		t.Fatalf("current key ID: want %d, got %d", newCfg.KeyID, current)
+	}
+	if status := query(server.Config().Config); status != InBreach {
+		t.Errorf("status: want %s, got %s", InBreach, status)
+	}
+	if status := query(oldClientCfg); status != InBreach {
+		t.Errorf("status: want %s, got %s", InBreach, status)
+	}
+
+	// retired keys are no longer served
+	if err := server.RemoveKey(newCfg.KeyID); err == nil {
+		t.Error("current key removed")
+	}
+	if err := server.RemoveKey(oldCfg.KeyID); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(oldClientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.HandleRequest(request, kvs[oldCfg.KeyID]); err == nil {
+		t.Error("request for removed key accepted")
+	}
+}
+
+// TestCheckBucketID tests that requests are rejected for bucket IDs that the
+// server's bucket ID bit size cannot produce
+func TestCheckBucketID(t *testing.T) {
+	cfg := DefaultServerConfig()
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.checkBucketID(BucketIDToHex(server.BucketID([]byte("username")))); err != nil {
+		t.Error(err)
+	}
+	maxID := BucketIDToHex(uint32(1)<<cfg.BucketIDBitSize - 1)
+	if err := server.checkBucketID(maxID); err != nil {
+		t.Error(err)
+	}
+	for _, id := range []string{
+		"",
+		"zzzzzzzz",
+		"000",
+		"0000",
+		"0000000000",
+		BucketIDToHex(uint32(1) << cfg.BucketIDBitSize),
+		"ffffffff",
+	} {
+		if err := server.checkBucketID(id); err == nil {
+			t.Errorf("bucket ID %q accepted", id)
+		}
+	}
 }
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ShuffleSeedSalt separates the keys of seeded shuffles from other uses of
+// the build seed.
+var ShuffleSeedSalt = []byte("MIGP shuffle seed")
+
+// ShuffleBucket returns a copy of the bucket with its entries in a uniformly
+// random order, drawn from rnd. Shuffling hides which entries were inserted
+// together and which kind of entry, e.g., exact password or variant, was
+// inserted first. Use crypto/rand.Reader as rnd, or NewSeededReader to
+// reproduce the same permutation across builds.
+func ShuffleBucket(bucket []byte, rnd io.Reader) ([]byte, error) {
+	bodyLengths, err := BucketBodyLengths(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([][]byte, len(bodyLengths))
+	offset := 0
+	for i, bodyLength := range bodyLengths {
+		entries[i] = bucket[offset : offset+HeaderSize+bodyLength]
+		offset += HeaderSize + bodyLength
+	}
+
+	// Fisher-Yates shuffle
+	for i := len(entries) - 1; i > 0; i-- {
+		j, err := uniformIndex(rnd, i+1)
+		if err != nil {
+			return nil, err
+		}
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	shuffled := make([]byte, 0, len(bucket))
+	for _, entry := range entries {
+		shuffled = append(shuffled, entry...)
+	}
+	return shuffled, nil
+}
+
+// NewSeededReader returns a deterministic stream of random bytes for
+// shuffling the given bucket. The stream is the ChaCha20 keystream under
+// SHA256(ShuffleSeedSalt | seed | bucketID), so each bucket gets an
+// independent permutation that is reproducible given the seed. The seed must
+// be kept secret, since it reveals the permutation of every bucket.
+func NewSeededReader(seed []byte, bucketID string) io.Reader {
+	h := sha256.New()
+	h.Write(ShuffleSeedSalt)
+	h.Write(seed)
+	h.Write([]byte(bucketID))
+	return newKeystreamReader(h.Sum(nil))
+}
+
+// uniformIndex returns a uniformly random integer in [0, n) drawn from rnd,
+// using rejection sampling to avoid modulo bias
+func uniformIndex(rnd io.Reader, n int) (int, error) {
+	if n <= 0 {
+		return 0, errors.New("invalid range")
+	}
+	limit := ^uint64(0) - ^uint64(0)%uint64(n)
+	buf := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(rnd, buf); err != nil {
+			return 0, err
+		}
+		if v := binary.BigEndian.Uint64(buf); v < limit {
+			return int(v % uint64(n)), nil
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sort"
+	"testing"
+)
+
+// splitBucket returns the entries of a bucket as strings
+func splitBucket(t *testing.T, bucket []byte) []string {
+	bodyLengths, err := BucketBodyLengths(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	offset := 0
+	for _, bodyLength := range bodyLengths {
+		entries = append(entries, string(bucket[offset:offset+HeaderSize+bodyLength]))
+		offset += HeaderSize + bodyLength
+	}
+	return entries
+}
+
+func TestShuffleBucket(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bucket []byte
+	for i := 0; i < 20; i++ {
+		entry, err := server.EncryptBucketEntry([]byte("username"), []byte{byte(i)}, MetadataBreachedPassword, bytes.Repeat([]byte{'a'}, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket = append(bucket, entry...)
+	}
+
+	shuffled, err := ShuffleBucket(bucket, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(shuffled, bucket) {
+		t.Errorf("bucket was not shuffled")
+	}
+	want, got := splitBucket(t, bucket), splitBucket(t, shuffled)
+	sort.Strings(want)
+	sort.Strings(got)
+	if len(want) != len(got) {
+		t.Fatalf("want %d entries, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("shuffled bucket does not hold the same entries")
+		}
+	}
+
+	// seeded shuffles are reproducible, and independent across buckets
+	seed := []byte("build seed")
+	first, err := ShuffleBucket(bucket, NewSeededReader(seed, "00001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ShuffleBucket(bucket, NewSeededReader(seed, "00001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ShuffleBucket(bucket, NewSeededReader(seed, "00002"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("seeded shuffle is not reproducible")
+	}
+	if bytes.Equal(first, other) {
+		t.Errorf("seeded shuffle does not depend on the bucket ID")
+	}
+
+	if _, err := ShuffleBucket(bucket[:len(bucket)-1], rand.Reader); err == nil {
+		t.Errorf("expected shuffling a truncated bucket to fail")
+	}
+}
+
+func TestUniformIndex(t *testing.T) {
+	const n, samples = 5, 50000
+	rnd := NewSeededReader([]byte("seed"), "")
+	var counts [n]int
+	for i := 0; i < samples; i++ {
+		j, err := uniformIndex(rnd, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[j]++
+	}
+	for j, count := range counts {
+		if count < samples/n*9/10 || count > samples/n*11/10 {
+			t.Errorf("index %d drawn %d times out of %d", j, count, samples)
+		}
+	}
+}
@@ -4,14 +4,17 @@
 package migp
 
 import (
+	"context"
 	"errors"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/scrypt"
 )
 
 const (
-	SlowHasherNull   uint16 = 0x0000
-	SlowHasherScrypt uint16 = 0x0001
+	SlowHasherNull     uint16 = 0x0000
+	SlowHasherScrypt   uint16 = 0x0001
+	SlowHasherArgon2id uint16 = 0x0002
 )
 
 const (
@@ -20,8 +23,86 @@ const (
 	ScryptN      = 16384 // scrypt N
 	Scryptr      = 8     // scrypt r
 	Scryptp      = 1     // scrypt p
+
+	Argon2Time    = 3         // argon2id number of passes
+	Argon2Memory  = 64 * 1024 // argon2id memory in KiB
+	Argon2Threads = 4         // argon2id degree of parallelism
+)
+
+// Maximum cost parameters of the slow hashers. Clients reject configurations
+// exceeding them, so that a server cannot make clients spend unbounded time
+// or memory on each query.
+const (
+	MaxSlowHashMemory = 1 << 30 // memory in bytes
+
+	MaxScryptN = 1 << 20 // scrypt N
+	MaxScryptR = 32      // scrypt r
+	MaxScryptP = 16      // scrypt p
+
+	MaxArgon2Time    = 16 // argon2id number of passes
+	MaxArgon2Threads = 16 // argon2id degree of parallelism
 )
 
+// SlowHasherParams holds the cost parameters of the slow hasher. They are
+// carried in Config so that clients and servers always agree on them. Only
+// the parameters of the configured hasher are used, and zero values select
+// the defaults above.
+type SlowHasherParams struct {
+	ScryptN       int    `json:"scryptN,omitempty"`
+	ScryptR       int    `json:"scryptR,omitempty"`
+	ScryptP       int    `json:"scryptP,omitempty"`
+	Argon2Time    uint32 `json:"argon2Time,omitempty"`
+	Argon2Memory  uint32 `json:"argon2Memory,omitempty"`
+	Argon2Threads uint8  `json:"argon2Threads,omitempty"`
+}
+
+// withDefaults returns the parameters relevant to the given slow hasher, with
+// zero values replaced by the defaults
+func (p SlowHasherParams) withDefaults(id uint16) SlowHasherParams {
+	var out SlowHasherParams
+	switch id {
+	case SlowHasherScrypt:
+		out.ScryptN, out.ScryptR, out.ScryptP = p.ScryptN, p.ScryptR, p.ScryptP
+		if out.ScryptN == 0 {
+			out.ScryptN = ScryptN
+		}
+		if out.ScryptR == 0 {
+			out.ScryptR = Scryptr
+		}
+		if out.ScryptP == 0 {
+			out.ScryptP = Scryptp
+		}
+	case SlowHasherArgon2id:
+		out.Argon2Time, out.Argon2Memory, out.Argon2Threads = p.Argon2Time, p.Argon2Memory, p.Argon2Threads
+		if out.Argon2Time == 0 {
+			out.Argon2Time = Argon2Time
+		}
+		if out.Argon2Memory == 0 {
+			out.Argon2Memory = Argon2Memory
+		}
+		if out.Argon2Threads == 0 {
+			out.Argon2Threads = Argon2Threads
+		}
+	}
+	return out
+}
+
+// Validate checks that the parameters, with zero values replaced by the
+// defaults, are valid for the given slow hasher and within the maximum cost
+func (p SlowHasherParams) Validate(id uint16) error {
+	p = p.withDefaults(id)
+	switch id {
+	case SlowHasherNull:
+		return nil
+	case SlowHasherScrypt:
+		return validateScryptParams(p.ScryptN, p.ScryptR, p.ScryptP)
+	case SlowHasherArgon2id:
+		return validateArgon2idParams(p.Argon2Time, p.Argon2Memory, p.Argon2Threads)
+	default:
+		return errors.New("Unsupported slow hasher")
+	}
+}
+
 // SlowHasher is a generic interface for a slow (memory hard) hash algorithm
 type SlowHasher interface {
 	ID() uint16
@@ -44,13 +125,42 @@ type scryptSlowHasher struct {
 // - p: 1
 // See: https://github.com/google/mundane/blob/master/src/password.rs#L68
 func NewScryptSlowHasher() scryptSlowHasher {
+	h, err := NewScryptSlowHasherWithParams(ScryptN, Scryptr, Scryptp)
+	if err != nil {
+		// The default parameters are valid.
+		panic(err)
+	}
+	return h
+}
+
+// NewScryptSlowHasherWithParams returns a SlowHasher instance using Scrypt
+// with the given cost parameters.
+func NewScryptSlowHasherWithParams(N, r, p int) (scryptSlowHasher, error) {
+	if err := validateScryptParams(N, r, p); err != nil {
+		return scryptSlowHasher{}, err
+	}
 	return scryptSlowHasher{
 		salt: SlowHashSalt,
-		N:    ScryptN,
-		r:    Scryptr,
-		p:    Scryptp,
+		N:    N,
+		r:    r,
+		p:    p,
 		L:    SlowHashLen,
+	}, nil
+}
+
+// validateScryptParams checks the scrypt cost parameters. scrypt uses
+// 128*N*r bytes of memory.
+func validateScryptParams(N, r, p int) error {
+	if N <= 1 || N&(N-1) != 0 {
+		return errors.New("scrypt N must be a power of two greater than one")
+	}
+	if r <= 0 || p <= 0 {
+		return errors.New("invalid scrypt r and p parameters")
+	}
+	if N > MaxScryptN || r > MaxScryptR || p > MaxScryptP || 128*uint64(N)*uint64(r) > MaxSlowHashMemory {
+		return errors.New("scrypt parameters exceed the maximum cost")
 	}
+	return nil
 }
 
 // ID returns the identifier of this particular hash function
@@ -70,6 +180,70 @@ func (h scryptSlowHasher) Hash(buf []byte) []byte {
 	return temp[:]
 }
 
+// argon2idSlowHasher implements SlowHasher using Argon2id
+type argon2idSlowHasher struct {
+	salt    string
+	time    uint32
+	memory  uint32
+	threads uint8
+	L       uint32
+}
+
+// NewArgon2idSlowHasher returns a SlowHasher instance using Argon2id with the
+// second recommended option of RFC 9106:
+// - time: 3
+// - memory: 64 MiB
+// - threads: 4
+func NewArgon2idSlowHasher() argon2idSlowHasher {
+	h, err := NewArgon2idSlowHasherWithParams(Argon2Time, Argon2Memory, Argon2Threads)
+	if err != nil {
+		// The default parameters are valid.
+		panic(err)
+	}
+	return h
+}
+
+// NewArgon2idSlowHasherWithParams returns a SlowHasher instance using
+// Argon2id with the given number of passes, memory in KiB, and degree of
+// parallelism.
+func NewArgon2idSlowHasherWithParams(time, memory uint32, threads uint8) (argon2idSlowHasher, error) {
+	if err := validateArgon2idParams(time, memory, threads); err != nil {
+		return argon2idSlowHasher{}, err
+	}
+	return argon2idSlowHasher{
+		salt:    SlowHashSalt,
+		time:    time,
+		memory:  memory,
+		threads: threads,
+		L:       SlowHashLen,
+	}, nil
+}
+
+// validateArgon2idParams checks the Argon2id cost parameters, where memory
+// is in KiB
+func validateArgon2idParams(time, memory uint32, threads uint8) error {
+	if time < 1 || threads < 1 {
+		return errors.New("argon2id time and threads must be positive")
+	}
+	if memory < 8*uint32(threads) {
+		return errors.New("argon2id memory must be at least 8 KiB per thread")
+	}
+	if time > MaxArgon2Time || threads > MaxArgon2Threads || 1024*uint64(memory) > MaxSlowHashMemory {
+		return errors.New("argon2id parameters exceed the maximum cost")
+	}
+	return nil
+}
+
+// ID returns the identifier of this particular hash function
+func (h argon2idSlowHasher) ID() uint16 {
+	return SlowHasherArgon2id
+}
+
+// Hash applies Argon2id, with the corresponding parameters, to the input buf
+func (h argon2idSlowHasher) Hash(buf []byte) []byte {
+	return argon2.IDKey(buf, []byte(h.salt), h.time, h.memory, h.threads, h.L)
+}
+
 // nullSlowHasher implements SlowHasher using a no-op
 type nullSlowHasher struct{}
 
@@ -88,13 +262,55 @@ func (h nullSlowHasher) Hash(buf []byte) []byte {
 	return buf
 }
 
+// slowHashContext hashes each input with the slow hasher, returning early with
+// the context error if the context is done first. Slow hash computations are
+// not interruptible, so the hash in progress when the context is done runs to
+// completion in the background, but its result is discarded and no further
+// inputs are hashed.
+func slowHashContext(ctx context.Context, hasher SlowHasher, inputs [][]byte) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan [][]byte, 1)
+	go func() {
+		outputs := make([][]byte, len(inputs))
+		for i, input := range inputs {
+			if ctx.Err() != nil {
+				return
+			}
+			outputs[i] = hasher.Hash(input)
+		}
+		done <- outputs
+	}()
+
+	select {
+	case outputs := <-done:
+		return outputs, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // NewHasher returns an slow hasher given its ID
 func NewSlowHasher(id uint16) (SlowHasher, error) {
+	return NewSlowHasherWithParams(id, SlowHasherParams{})
+}
+
+// NewSlowHasherWithParams returns a slow hasher given its ID and cost
+// parameters. Zero parameters select the defaults for the hasher.
+func NewSlowHasherWithParams(id uint16, params SlowHasherParams) (SlowHasher, error) {
+	if err := params.Validate(id); err != nil {
+		return nil, err
+	}
+	params = params.withDefaults(id)
 	switch id {
 	case SlowHasherNull:
 		return NewNullSlowHasher(), nil
 	case SlowHasherScrypt:
-		return NewScryptSlowHasher(), nil
+		return NewScryptSlowHasherWithParams(params.ScryptN, params.ScryptR, params.ScryptP)
+	case SlowHasherArgon2id:
+		return NewArgon2idSlowHasherWithParams(params.Argon2Time, params.Argon2Memory, params.Argon2Threads)
 	default:
 		return nil, errors.New("Unsupported slow hasher")
 	}
@@ -14,3 +14,86 @@ func BenchmarkScryptSlowHasher(b *testing.B) {
 		_ = slowHasher.Hash(input)
 	}
 }
+
+// BenchmarkArgon2idSlowHasher runs benchmark tests for the Argon2id slow hasher
+func BenchmarkArgon2idSlowHasher(b *testing.B) {
+	input := []byte{32}
+
+	slowHasher := NewArgon2idSlowHasher()
+	for i := 0; i < b.N; i++ {
+		_ = slowHasher.Hash(input)
+	}
+}
+
+// TestSlowHasherParams checks that cost parameters are validated and change
+// the hash output
+func TestSlowHasherParams(t *testing.T) {
+	input := []byte("input")
+
+	tests := []struct {
+		id     uint16
+		params SlowHasherParams
+		valid  bool
+	}{
+		{SlowHasherScrypt, SlowHasherParams{ScryptN: 1024, ScryptR: 8, ScryptP: 1}, true},
+		{SlowHasherScrypt, SlowHasherParams{ScryptN: 1000}, false},
+		{SlowHasherScrypt, SlowHasherParams{ScryptN: 1024, ScryptR: -1}, false},
+		{SlowHasherArgon2id, SlowHasherParams{Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}, true},
+		{SlowHasherArgon2id, SlowHasherParams{Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 2}, true},
+		{SlowHasherArgon2id, SlowHasherParams{Argon2Time: 1, Argon2Memory: 8, Argon2Threads: 2}, false},
+		{SlowHasherScrypt, SlowHasherParams{ScryptN: 1 << 30}, false},
+		{SlowHasherScrypt, SlowHasherParams{ScryptN: MaxScryptN, ScryptR: MaxScryptR}, false},
+		{SlowHasherScrypt, SlowHasherParams{ScryptN: 1024, ScryptP: MaxScryptP + 1}, false},
+		{SlowHasherArgon2id, SlowHasherParams{Argon2Time: MaxArgon2Time + 1}, false},
+		{SlowHasherArgon2id, SlowHasherParams{Argon2Memory: 1 << 21}, false},
+		{SlowHasherArgon2id, SlowHasherParams{Argon2Threads: MaxArgon2Threads + 1}, false},
+		{0xffff, SlowHasherParams{}, false},
+	}
+
+	seen := make(map[string]int)
+	for i, test := range tests {
+		if err := test.params.Validate(test.id); (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got validation error %v", i, test.valid, err)
+		}
+		hasher, err := NewSlowHasherWithParams(test.id, test.params)
+		if (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got error %v", i, test.valid, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if hasher.ID() != test.id {
+			t.Errorf("failed test %d: want ID %d, got %d", i, test.id, hasher.ID())
+		}
+		output := string(hasher.Hash(input))
+		if j, ok := seen[output]; ok {
+			t.Errorf("tests %d and %d produced the same hash", j, i)
+		}
+		seen[output] = i
+	}
+
+	// default parameters are filled in and advertised
+	params := SlowHasherParams{ScryptN: 1024}.withDefaults(SlowHasherScrypt)
+	if params != (SlowHasherParams{ScryptN: 1024, ScryptR: Scryptr, ScryptP: Scryptp}) {
+		t.Errorf("unexpected scrypt parameters %+v", params)
+	}
+	if DefaultConfig().SlowHasherParams.ScryptN != ScryptN {
+		t.Error("default scrypt parameters missing from default config")
+	}
+	cfg := DefaultConfig()
+	cfg.SlowHasherID, cfg.SlowHasherParams = SlowHasherArgon2id, SlowHasherParams{}
+	serverCfg, err := NewServerConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverCfg.SlowHasherParams != (SlowHasherParams{Argon2Time: Argon2Time, Argon2Memory: Argon2Memory, Argon2Threads: Argon2Threads}) {
+		t.Errorf("unexpected argon2id parameters %+v", serverCfg.SlowHasherParams)
+	}
+
+	// clients reject configurations exceeding the maximum cost
+	cfg.SlowHasherParams.Argon2Memory = 1 << 21
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("expected a client with excessive slow hasher parameters to fail")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+// UnionMutator combines the variants of several mutators. Variants are
+// taken by rank, i.e., the first variant of each mutator in order, then the
+// second of each, and so on, so that every mutator contributes to small
+// budgets. Duplicates across mutators are skipped.
+type UnionMutator struct {
+	mutators []Mutator
+}
+
+// NewUnionMutator returns a mutator combining the variants of the mutators
+func NewUnionMutator(mutators ...Mutator) *UnionMutator {
+	return &UnionMutator{mutators: mutators}
+}
+
+// Mutate generates up to the requested number of unique variants
+func (m *UnionMutator) Mutate(password []byte, num int) [][]byte {
+	return passwords(takeVariants(m.iterate(password), num))
+}
+
+// iterate returns an iterator taking the variants of the mutators by rank
+func (m *UnionMutator) iterate(password []byte) variantIterator {
+	sources := make([]variantIterator, len(m.mutators))
+	for i, mutator := range m.mutators {
+		sources[i] = iterate(mutator, password)
+	}
+	return &unionIterator{
+		sources: sources,
+		seen:    map[string]struct{}{string(password): {}},
+	}
+}
+
+// unionIterator takes the variants of several iterators in turn, skipping
+// exhausted iterators and duplicates
+type unionIterator struct {
+	sources []variantIterator
+	turn    int
+	seen    map[string]struct{}
+}
+
+// next returns the next unique variant of the iterators
+func (it *unionIterator) next() (Variant, bool) {
+	for len(it.sources) > 0 {
+		it.turn %= len(it.sources)
+		variant, ok := it.sources[it.turn].next()
+		if !ok {
+			it.sources = append(it.sources[:it.turn], it.sources[it.turn+1:]...)
+			continue
+		}
+		it.turn++
+		if _, ok := it.seen[string(variant.Password)]; !ok {
+			it.seen[string(variant.Password)] = struct{}{}
+			return variant, true
+		}
+	}
+	return Variant{}, false
+}
+
+// ChainMutator applies a second mutator to the variants of a first mutator,
+// e.g., to capitalize the first letter and append "!". The variant combining
+// the i-th variant of the first mutator with the j-th variant of the second
+// is ranked by i+j, then by i, so that pairs of likely edits come first.
+// Chains of more than two mutators can be built by nesting chains.
+type ChainMutator struct {
+	first, second Mutator
+}
+
+// NewChainMutator returns a mutator applying second to the variants of first
+func NewChainMutator(first, second Mutator) *ChainMutator {
+	return &ChainMutator{first: first, second: second}
+}
+
+// Mutate generates up to the requested number of unique variants
+func (m *ChainMutator) Mutate(password []byte, num int) [][]byte {
+	return passwords(takeVariants(m.iterate(password), num))
+}
+
+// iterate returns an iterator over the variants combining the variants of
+// the two mutators, by rank. Variants of the first mutator, and their
+// variants, are only generated once their rank is reached.
+func (m *ChainMutator) iterate(password []byte) variantIterator {
+	return &chainIterator{
+		second: m.second,
+		firsts: iterate(m.first, password),
+		seen:   map[string]struct{}{string(password): {}},
+	}
+}
+
+// chainIterator walks the ranks of a ChainMutator. At rank r, the j-th
+// variant of the i-th first variant is taken for i from 0 to r and j = r-i,
+// so each iterator of second variants is advanced once per rank.
+type chainIterator struct {
+	second     Mutator
+	firsts     variantIterator
+	firstsDone bool
+	// seconds iterates over the variants of each first variant, or is nil
+	// once they are exhausted
+	seconds []variantIterator
+	// rank and i locate the next variant to take
+	rank, i int
+	// taken reports whether a variant was taken at the current rank
+	taken bool
+	seen  map[string]struct{}
+}
+
+// next returns the next unique variant of the chain
+func (it *chainIterator) next() (Variant, bool) {
+	for {
+		if it.i > it.rank || (it.firstsDone && it.i >= len(it.seconds)) {
+			// Once all first variants are known, a rank without any
+			// variant means that all iterators are exhausted.
+			if it.firstsDone && !it.taken {
+				return Variant{}, false
+			}
+			it.rank, it.i, it.taken = it.rank+1, 0, false
+			continue
+		}
+		if it.i == len(it.seconds) {
+			first, ok := it.firsts.next()
+			if !ok {
+				it.firstsDone = true
+				continue
+			}
+			it.seconds = append(it.seconds, iterate(it.second, first.Password))
+		}
+
+		i := it.i
+		it.i++
+		if it.seconds[i] == nil {
+			continue
+		}
+		variant, ok := it.seconds[i].next()
+		if !ok {
+			it.seconds[i] = nil
+			continue
+		}
+		it.taken = true
+		if _, ok := it.seen[string(variant.Password)]; !ok {
+			it.seen[string(variant.Password)] = struct{}{}
+			return variant, true
+		}
+	}
+}
+
+// NewPairMutator returns a mutator generating the variants of m
+// interleaved with the variants of pairs of edits of m, e.g., pairs of RDas
+// rules
+func NewPairMutator(m Mutator) *UnionMutator {
+	return NewUnionMutator(m, NewChainMutator(m, m))
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"testing"
+)
+
+// TestCompositeMutators tests the ranking and deduplication of the variants
+// of union and chain mutators
+func TestCompositeMutators(t *testing.T) {
+	m, err := NewRDasMutatorFromRules([]RDasRule{
+		{RuleType: "c", Position: 0},
+		{RuleType: "i", Position: -1, String1: "!"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashcat, err := NewHashcatMutatorFromRules([]string{"$1", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		mutator Mutator
+		num     int
+		want    []string
+	}{
+		{"union", NewUnionMutator(m, hashcat), 10, []string{"Hello", "hello1", "hello!"}},
+		{"union duplicates", NewUnionMutator(m, m), 10, []string{"Hello", "hello!"}},
+		{"chain", NewChainMutator(m, m), 10, []string{"Hello!", "hello!!"}},
+		{"chain of chains", NewChainMutator(NewChainMutator(m, m), hashcat), 10, []string{"Hello!1", "hello!!1", "Hello!!"}},
+		{"pairs", NewPairMutator(m), 10, []string{"Hello", "Hello!", "hello!", "hello!!"}},
+		{"pairs budget", NewPairMutator(m), 3, []string{"Hello", "Hello!", "hello!"}},
+		{"empty budget", NewPairMutator(m), 0, nil},
+	} {
+		variants := test.mutator.Mutate([]byte("hello"), test.num)
+		if len(variants) != len(test.want) {
+			t.Errorf("%s: want %q, got %q", test.name, test.want, variants)
+			continue
+		}
+		for i := range test.want {
+			if string(variants[i]) != test.want[i] {
+				t.Errorf("%s: variant %d: want %q, got %q", test.name, i, test.want[i], variants[i])
+			}
+		}
+	}
+
+	if variants := NewPairMutator(NewRDasMutator()).Mutate([]byte("password"), 100); len(variants) != 100 {
+		t.Errorf("want 100 variants of built-in rule pairs, got %d", len(variants))
+	}
+}
+
+// countingMutator records the passwords that an RDas mutator is applied to,
+// standing in for mutators of other packages
+type countingMutator struct {
+	mutator  *RDasMutator
+	mutated  map[string]bool
+	requests int
+}
+
+// Mutate records the password and returns its RDas variants
+func (m *countingMutator) Mutate(password []byte, num int) [][]byte {
+	m.mutated[string(password)] = true
+	m.requests++
+	return m.mutator.Mutate(password, num)
+}
+
+// TestChainLaziness tests that a chain only applies the second mutator to
+// the variants of the first whose rank is reached, and that mutators of
+// other packages are iterated over by growing requests
+func TestChainLaziness(t *testing.T) {
+	second := &countingMutator{mutator: NewRDasMutator(), mutated: make(map[string]bool)}
+	variants := NewChainMutator(NewRDasMutator(), second).Mutate([]byte("password"), 10)
+	if len(variants) != 10 {
+		t.Fatalf("want 10 variants, got %d", len(variants))
+	}
+	// ranks 0 to 3 hold up to 10 variants, from the first 4 variants of
+	// the first mutator
+	if len(second.mutated) > 5 {
+		t.Errorf("second mutator applied to %d variants for a budget of 10", len(second.mutated))
+	}
+
+	want := NewRDasMutator().Mutate([]byte("password"), 1000)
+	counting := &countingMutator{mutator: NewRDasMutator(), mutated: make(map[string]bool)}
+	got := takeVariants(iterate(counting, []byte("password")), 1000)
+	if len(got) != len(want) {
+		t.Fatalf("want %d variants, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if string(got[i].Password) != string(want[i]) {
+			t.Fatalf("variant %d: want %q, got %q", i, want[i], got[i].Password)
+		}
+	}
+	if counting.requests > 8 {
+		t.Errorf("want at most 8 requests, got %d", counting.requests)
+	}
+}
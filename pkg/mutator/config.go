@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"fmt"
+)
+
+// Formats of rules files
+const (
+	// RulesFormatRDas is a JSON list of RDas rules
+	RulesFormatRDas = "rdas"
+	// RulesFormatHashcat is a hashcat rule file
+	RulesFormatHashcat = "hashcat"
+)
+
+// Config describes a mutator, e.g., as configured by command-line flags
+type Config struct {
+	// RulesFile holds the mangling rules. If empty, the built-in RDas rules
+	// are used.
+	RulesFile string
+	// RulesFormat is the format of RulesFile. If empty, RulesFormatRDas is
+	// used.
+	RulesFormat string
+	// ByteCompatible applies RDas rules to bytes rather than characters.
+	ByteCompatible bool
+	// RulePairs adds variants combining two rules.
+	RulePairs bool
+	// PolicyFile holds a JSON password policy that variants must comply
+	// with. If empty, variants are not filtered.
+	PolicyFile string
+}
+
+// NewMutatorFromConfig returns the mutator described by the configuration
+func NewMutatorFromConfig(cfg Config) (Mutator, error) {
+	m, err := newRulesMutator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RulePairs {
+		m = NewPairMutator(m)
+	}
+	if cfg.PolicyFile == "" {
+		return m, nil
+	}
+	policy, err := NewPolicyFromFile(cfg.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	if pm, ok := m.(ProvenanceMutator); ok {
+		return NewProvenancePolicyMutator(pm, policy)
+	}
+	return NewPolicyMutator(m, policy)
+}
+
+// newRulesMutator returns the mutator applying single rules
+func newRulesMutator(cfg Config) (Mutator, error) {
+	var m *RDasMutator
+	switch {
+	case cfg.RulesFile == "":
+		m = NewRDasMutator()
+	case cfg.RulesFormat == RulesFormatRDas || cfg.RulesFormat == "":
+		var err error
+		if m, err = NewRDasMutatorFromFile(cfg.RulesFile); err != nil {
+			return nil, err
+		}
+	case cfg.RulesFormat == RulesFormatHashcat:
+		return NewHashcatMutatorFromFile(cfg.RulesFile)
+	default:
+		return nil, fmt.Errorf("unsupported rules format %q", cfg.RulesFormat)
+	}
+	m.SetByteCompatible(cfg.ByteCompatible)
+	return m, nil
+}
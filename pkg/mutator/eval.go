@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+// RuleTypeUnknown is the rule type of variants generated by a mutator that
+// does not report their provenance
+const RuleTypeUnknown = "unknown"
+
+// Evaluation measures how well a mutator anticipates password reuse: for
+// pairs of a breached password and the password that the user chose next,
+// it records whether the new password is among the variants of the breached
+// one, and at which rank. Hits are broken down by the type of the rule
+// producing the variant if the mutator is a ProvenanceMutator.
+type Evaluation struct {
+	mutator   Mutator
+	maxBudget int
+	pairs     int
+	unchanged int
+	// hits maps a rule type to the number of hits at each rank
+	hits map[string][]int
+}
+
+// NewEvaluation returns an evaluation of the first maxBudget variants of m.
+// As for the server, the variants of a budget are assumed to be the first
+// variants of larger budgets.
+func NewEvaluation(m Mutator, maxBudget int) (*Evaluation, error) {
+	if maxBudget <= 0 {
+		return nil, errors.New("non-positive variant budget")
+	}
+	return &Evaluation{mutator: m, maxBudget: maxBudget, hits: make(map[string][]int)}, nil
+}
+
+// Add evaluates a pair of a breached password and the user's new password,
+// and returns the rank of the new password among the variants, or -1 if it
+// is not a variant. Unchanged passwords are counted separately, since they
+// match the breached entry rather than a variant.
+func (e *Evaluation) Add(oldPassword, newPassword []byte) int {
+	if bytes.Equal(oldPassword, newPassword) {
+		e.unchanged++
+		return -1
+	}
+	e.pairs++
+
+	if pm, ok := e.mutator.(ProvenanceMutator); ok {
+		for rank, variant := range pm.MutateWithProvenance(oldPassword, e.maxBudget) {
+			if bytes.Equal(variant.Password, newPassword) {
+				e.hit(variant.Rule.RuleType, rank)
+				return rank
+			}
+		}
+		return -1
+	}
+	for rank, variant := range e.mutator.Mutate(oldPassword, e.maxBudget) {
+		if bytes.Equal(variant, newPassword) {
+			e.hit(RuleTypeUnknown, rank)
+			return rank
+		}
+	}
+	return -1
+}
+
+// hit counts a hit of a variant of the rule type at the rank
+func (e *Evaluation) hit(ruleType string, rank int) {
+	if e.hits[ruleType] == nil {
+		e.hits[ruleType] = make([]int, e.maxBudget)
+	}
+	e.hits[ruleType][rank]++
+}
+
+// BudgetResult is the outcome of an evaluation for a variant budget
+type BudgetResult struct {
+	// Budget is the number of variants inserted per credential.
+	Budget int `json:"budget"`
+	// Hits is the number of changed passwords among the variants.
+	Hits int `json:"hits"`
+	// HitRate is the fraction of changed passwords among the variants.
+	HitRate float64 `json:"hitRate"`
+	// RuleTypes breaks the hits down by the type of the rule producing the
+	// variant, e.g., "c" or "i".
+	RuleTypes map[string]int `json:"ruleTypes"`
+}
+
+// EvaluationReport summarizes an evaluation
+type EvaluationReport struct {
+	// Pairs is the number of pairs with a changed password.
+	Pairs int `json:"pairs"`
+	// Unchanged is the number of pairs where the password was reused as is.
+	Unchanged int `json:"unchanged"`
+	// Budgets holds the results for each evaluated budget.
+	Budgets []BudgetResult `json:"budgets"`
+}
+
+// Report returns the results of the evaluation for the given budgets, which
+// are capped by the maximum budget
+func (e *Evaluation) Report(budgets []int) EvaluationReport {
+	report := EvaluationReport{Pairs: e.pairs, Unchanged: e.unchanged}
+	budgets = append([]int{}, budgets...)
+	sort.Ints(budgets)
+	last := 0
+	for _, budget := range budgets {
+		if budget > e.maxBudget {
+			budget = e.maxBudget
+		}
+		if budget <= last {
+			continue
+		}
+		last = budget
+		result := BudgetResult{Budget: budget, RuleTypes: make(map[string]int)}
+		for ruleType, hits := range e.hits {
+			count := 0
+			for _, n := range hits[:budget] {
+				count += n
+			}
+			if count > 0 {
+				result.RuleTypes[ruleType] = count
+				result.Hits += count
+			}
+		}
+		if e.pairs > 0 {
+			result.HitRate = float64(result.Hits) / float64(e.pairs)
+		}
+		report.Budgets = append(report.Budgets, result)
+	}
+	return report
+}
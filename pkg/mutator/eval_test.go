@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestEvaluation tests the hit rates at each budget and their breakdown by
+// rule type
+func TestEvaluation(t *testing.T) {
+	m, err := NewRDasMutatorFromRules([]RDasRule{
+		{RuleType: "c", Position: 0},
+		{RuleType: "i", Position: -1, String1: "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashcat, err := NewHashcatMutatorFromRules([]string{"c", "$1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := [][2]string{
+		{"password", "Password"},
+		{"password", "password1"},
+		{"sunshine", "sunshine"},
+		{"dragon", "dragon!"},
+	}
+
+	for _, test := range []struct {
+		mutator Mutator
+		c, i    string
+	}{
+		{m, "c", "i"},
+		{hashcat, RuleTypeUnknown, RuleTypeUnknown},
+	} {
+		e, err := NewEvaluation(test.mutator, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ranks []int
+		for _, pair := range pairs {
+			ranks = append(ranks, e.Add([]byte(pair[0]), []byte(pair[1])))
+		}
+		if want := []int{0, 1, -1, -1}; !reflect.DeepEqual(ranks, want) {
+			t.Errorf("want ranks %v, got %v", want, ranks)
+		}
+
+		report := e.Report([]int{5, 1, 2})
+		want := EvaluationReport{
+			Pairs:     3,
+			Unchanged: 1,
+			Budgets: []BudgetResult{
+				{Budget: 1, Hits: 1, HitRate: 1.0 / 3, RuleTypes: map[string]int{test.c: 1}},
+				{Budget: 2, Hits: 2, HitRate: 2.0 / 3, RuleTypes: map[string]int{test.c: 1, test.i: 1}},
+			},
+		}
+		if test.c == test.i {
+			want.Budgets[1].RuleTypes = map[string]int{test.c: 2}
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("want %+v, got %+v", want, report)
+		}
+	}
+
+	if _, err := NewEvaluation(m, 0); err == nil {
+		t.Errorf("expected an empty budget to fail")
+	}
+}
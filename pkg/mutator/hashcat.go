@@ -0,0 +1,449 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// hashcatMaxLength is the maximum length of a password produced by a hashcat
+// rule. Functions that would exceed it leave the password unchanged, as in
+// hashcat.
+const hashcatMaxLength = 256
+
+// hashcatArgs gives the parameters of each supported function of the
+// hashcat rule language: N is a position or count in 0-9 or A-Z (10-35), and
+// X or Y is a character. See https://hashcat.net/wiki/doku.php?id=rule_based_attack
+//
+// Supported functions:
+//   - nothing:       :
+//   - case:          l u c C t TN E
+//   - reorder:       r { } k K *NM
+//   - duplicate:     d pN f zN ZN q yN YN
+//   - add:           $X ^X iNX oNX
+//   - delete:        [ ] DN xNM ONM 'N @X
+//   - substitute:    sXY
+//   - reject unless: <N >N _N !X /X (X )X =NX %NX
+//
+// The rejection functions follow hashcat: <N rejects passwords longer than
+// N, and >N rejects passwords shorter than N.
+var hashcatArgs = map[byte]string{
+	':': "", 'l': "", 'u': "", 'c': "", 'C': "", 't': "", 'T': "N", 'E': "",
+	'r': "", '{': "", '}': "", 'k': "", 'K': "", '*': "NN",
+	'd': "", 'p': "N", 'f': "", 'z': "N", 'Z': "N", 'q': "", 'y': "N", 'Y': "N",
+	'$': "X", '^': "X", 'i': "NX", 'o': "NX",
+	'[': "", ']': "", 'D': "N", 'x': "NN", 'O': "NN", '\'': "N", '@': "X",
+	's': "XX",
+	'<': "N", '>': "N", '_': "N", '!': "X", '/': "X", '(': "X", ')': "X", '=': "NX", '%': "NX",
+}
+
+// hashcatOp is a function of a hashcat rule with its parameters. n and m
+// hold positions, and x and y characters.
+type hashcatOp struct {
+	name byte
+	n, m int
+	x, y byte
+}
+
+// HashcatRule is a parsed rule of the hashcat rule language, which applies a
+// sequence of functions to a password
+type HashcatRule struct {
+	source string
+	ops    []hashcatOp
+}
+
+// ParseHashcatRule parses a rule of the hashcat rule language. Spaces between
+// functions are ignored.
+func ParseHashcatRule(rule string) (HashcatRule, error) {
+	r := HashcatRule{source: rule}
+	for i := 0; i < len(rule); {
+		name := rule[i]
+		i++
+		if name == ' ' || name == '\t' {
+			continue
+		}
+		args, ok := hashcatArgs[name]
+		if !ok {
+			return HashcatRule{}, fmt.Errorf("unsupported function %q at offset %d", name, i-1)
+		}
+		if i+len(args) > len(rule) {
+			return HashcatRule{}, fmt.Errorf("missing parameter of function %q", name)
+		}
+		op := hashcatOp{name: name}
+		positions, chars := 0, 0
+		for _, kind := range []byte(args) {
+			c := rule[i]
+			i++
+			if kind == 'X' {
+				if chars == 0 {
+					op.x = c
+				} else {
+					op.y = c
+				}
+				chars++
+				continue
+			}
+			position, err := hashcatPosition(c)
+			if err != nil {
+				return HashcatRule{}, fmt.Errorf("function %q: %v", name, err)
+			}
+			if positions == 0 {
+				op.n = position
+			} else {
+				op.m = position
+			}
+			positions++
+		}
+		r.ops = append(r.ops, op)
+	}
+	if len(r.ops) == 0 {
+		return HashcatRule{}, errors.New("empty rule")
+	}
+	return r, nil
+}
+
+// hashcatPosition decodes a position or count
+func hashcatPosition(c byte) (int, error) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), nil
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, nil
+	default:
+		return 0, fmt.Errorf("invalid position %q", c)
+	}
+}
+
+// String returns the source of the rule
+func (r HashcatRule) String() string {
+	return r.source
+}
+
+// Apply applies the rule to a password. It returns false if a rejection
+// function rejected the password. Case functions only apply to ASCII
+// letters.
+func (r HashcatRule) Apply(password []byte) ([]byte, bool) {
+	s := append([]byte(nil), password...)
+	for _, op := range r.ops {
+		var ok bool
+		if s, ok = op.apply(s); !ok {
+			return nil, false
+		}
+	}
+	return s, true
+}
+
+// apply applies the function to s, which it may modify
+func (op hashcatOp) apply(s []byte) ([]byte, bool) {
+	n, m := op.n, op.m
+	switch op.name {
+	case ':':
+	case 'l':
+		mapBytes(s, toLower)
+	case 'u':
+		mapBytes(s, toUpper)
+	case 'c':
+		mapBytes(s, toLower)
+		if len(s) > 0 {
+			s[0] = toUpper(s[0])
+		}
+	case 'C':
+		mapBytes(s, toUpper)
+		if len(s) > 0 {
+			s[0] = toLower(s[0])
+		}
+	case 't':
+		mapBytes(s, toggleCase)
+	case 'T':
+		if n < len(s) {
+			s[n] = toggleCase(s[n])
+		}
+	case 'E':
+		mapBytes(s, toLower)
+		for i := range s {
+			if i == 0 || s[i-1] == ' ' {
+				s[i] = toUpper(s[i])
+			}
+		}
+
+	case 'r':
+		for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+			s[i], s[j] = s[j], s[i]
+		}
+	case '{':
+		if len(s) > 0 {
+			s = append(s[1:], s[0])
+		}
+	case '}':
+		if len(s) > 0 {
+			s = append([]byte{s[len(s)-1]}, s[:len(s)-1]...)
+		}
+	case 'k':
+		if len(s) >= 2 {
+			s[0], s[1] = s[1], s[0]
+		}
+	case 'K':
+		if len(s) >= 2 {
+			s[len(s)-1], s[len(s)-2] = s[len(s)-2], s[len(s)-1]
+		}
+	case '*':
+		if n < len(s) && m < len(s) {
+			s[n], s[m] = s[m], s[n]
+		}
+
+	case 'd':
+		s = grow(s, bytes.Repeat(s, 2))
+	case 'p':
+		s = grow(s, bytes.Repeat(s, n+1))
+	case 'f':
+		reflection := make([]byte, len(s))
+		for i := range s {
+			reflection[i] = s[len(s)-1-i]
+		}
+		s = grow(s, append(append([]byte(nil), s...), reflection...))
+	case 'z':
+		if len(s) > 0 {
+			s = grow(s, append(bytes.Repeat(s[:1], n), s...))
+		}
+	case 'Z':
+		if len(s) > 0 {
+			s = grow(s, append(append([]byte(nil), s...), bytes.Repeat(s[len(s)-1:], n)...))
+		}
+	case 'q':
+		doubled := make([]byte, 0, 2*len(s))
+		for _, c := range s {
+			doubled = append(doubled, c, c)
+		}
+		s = grow(s, doubled)
+	case 'y':
+		if n <= len(s) {
+			s = grow(s, append(append([]byte(nil), s[:n]...), s...))
+		}
+	case 'Y':
+		if n <= len(s) {
+			s = grow(s, append(append([]byte(nil), s...), s[len(s)-n:]...))
+		}
+
+	case '$':
+		s = grow(s, append(append([]byte(nil), s...), op.x))
+	case '^':
+		s = grow(s, append([]byte{op.x}, s...))
+	case 'i':
+		if n <= len(s) {
+			inserted := append(append(append([]byte(nil), s[:n]...), op.x), s[n:]...)
+			s = grow(s, inserted)
+		}
+	case 'o':
+		if n < len(s) {
+			s[n] = op.x
+		}
+
+	case '[':
+		if len(s) > 0 {
+			s = s[1:]
+		}
+	case ']':
+		if len(s) > 0 {
+			s = s[:len(s)-1]
+		}
+	case 'D':
+		if n < len(s) {
+			s = append(s[:n], s[n+1:]...)
+		}
+	case 'x':
+		if n < len(s) && n+m <= len(s) {
+			s = s[n : n+m]
+		}
+	case 'O':
+		if n < len(s) && n+m <= len(s) {
+			s = append(s[:n], s[n+m:]...)
+		}
+	case '\'':
+		if n < len(s) {
+			s = s[:n]
+		}
+	case '@':
+		s = bytes.ReplaceAll(s, []byte{op.x}, nil)
+
+	case 's':
+		for i := range s {
+			if s[i] == op.x {
+				s[i] = op.y
+			}
+		}
+
+	case '<':
+		return s, len(s) <= n
+	case '>':
+		return s, len(s) >= n
+	case '_':
+		return s, len(s) == n
+	case '!':
+		return s, bytes.IndexByte(s, op.x) < 0
+	case '/':
+		return s, bytes.IndexByte(s, op.x) >= 0
+	case '(':
+		return s, len(s) > 0 && s[0] == op.x
+	case ')':
+		return s, len(s) > 0 && s[len(s)-1] == op.x
+	case '=':
+		return s, n < len(s) && s[n] == op.x
+	case '%':
+		return s, bytes.Count(s, []byte{op.x}) >= n
+	default:
+		panic("hashcat function unrecognized")
+	}
+	return s, true
+}
+
+// grow returns the longer password unless it exceeds hashcatMaxLength, in
+// which case the password is unchanged
+func grow(s, longer []byte) []byte {
+	if len(longer) > hashcatMaxLength {
+		return s
+	}
+	return longer
+}
+
+// mapBytes replaces each byte of s with f(byte)
+func mapBytes(s []byte, f func(byte) byte) {
+	for i := range s {
+		s[i] = f(s[i])
+	}
+}
+
+// toLower lowercases an ASCII letter
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// toUpper uppercases an ASCII letter
+func toUpper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - ('a' - 'A')
+	}
+	return c
+}
+
+// toggleCase switches the case of an ASCII letter
+func toggleCase(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return toUpper(c)
+	}
+	return toLower(c)
+}
+
+// HashcatMutator applies rules of the hashcat rule language in order
+type HashcatMutator struct {
+	rules []HashcatRule
+}
+
+// NewHashcatMutatorFromRules returns a HashcatMutator applying the given
+// rules in order, or an error if a rule cannot be parsed
+func NewHashcatMutatorFromRules(rules []string) (*HashcatMutator, error) {
+	m := new(HashcatMutator)
+	for i, rule := range rules {
+		parsed, err := ParseHashcatRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		m.rules = append(m.rules, parsed)
+	}
+	if len(m.rules) == 0 {
+		return nil, errors.New("empty rule list")
+	}
+	return m, nil
+}
+
+// NewHashcatMutatorFromReader returns a HashcatMutator applying the rules of
+// a hashcat rule file: one rule per line, ignoring empty lines and comments
+// starting with #
+func NewHashcatMutatorFromReader(r io.Reader) (*HashcatMutator, error) {
+	m := new(HashcatMutator)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		rule := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(rule) == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		parsed, err := ParseHashcatRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		m.rules = append(m.rules, parsed)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(m.rules) == 0 {
+		return nil, errors.New("empty rule list")
+	}
+	return m, nil
+}
+
+// NewHashcatMutatorFromFile returns a HashcatMutator applying the rules of a
+// hashcat rule file
+func NewHashcatMutatorFromFile(path string) (*HashcatMutator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m, err := NewHashcatMutatorFromReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Mutate generates up to the requested number of mutations by applying the
+// rules in order. Rejected passwords, and those equal to the password or to
+// an earlier mutation, are skipped. May return fewer than requested number,
+// caller should check.
+func (m *HashcatMutator) Mutate(password []byte, num int) [][]byte {
+	return passwords(takeVariants(m.iterate(password), num))
+}
+
+// iterate returns an iterator applying the rules to the password in order
+func (m *HashcatMutator) iterate(password []byte) variantIterator {
+	return &hashcatIterator{
+		rules:    m.rules,
+		password: password,
+		seen:     map[string]struct{}{string(password): {}},
+	}
+}
+
+// hashcatIterator generates the variants of a password by applying hashcat
+// rules in order
+type hashcatIterator struct {
+	rules    []HashcatRule
+	password []byte
+	seen     map[string]struct{}
+}
+
+// next returns the variant of the next rule producing a new password
+func (it *hashcatIterator) next() (Variant, bool) {
+	for len(it.rules) > 0 {
+		rule := it.rules[0]
+		it.rules = it.rules[1:]
+		s, ok := rule.Apply(it.password)
+		if !ok {
+			continue
+		}
+		if _, ok := it.seen[string(s)]; !ok {
+			it.seen[string(s)] = struct{}{}
+			return Variant{Password: s}, true
+		}
+	}
+	return Variant{}, false
+}
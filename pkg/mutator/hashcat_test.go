@@ -0,0 +1,150 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestHashcatRules tests the functions of the hashcat rule language against
+// the examples of the hashcat wiki
+func TestHashcatRules(t *testing.T) {
+	tests := []struct {
+		rule, in, out string
+	}{
+		{":", "p@ssW0rd", "p@ssW0rd"},
+		{"l", "p@ssW0rd", "p@ssw0rd"},
+		{"u", "p@ssW0rd", "P@SSW0RD"},
+		{"c", "p@ssW0rd", "P@ssw0rd"},
+		{"C", "p@ssW0rd", "p@SSW0RD"},
+		{"t", "p@ssW0rd", "P@SSw0RD"},
+		{"T3", "p@ssW0rd", "p@sSW0rd"},
+		{"r", "p@ssW0rd", "dr0Wss@p"},
+		{"d", "p@ssW0rd", "p@ssW0rdp@ssW0rd"},
+		{"p2", "p@ssW0rd", "p@ssW0rdp@ssW0rdp@ssW0rd"},
+		{"f", "p@ssW0rd", "p@ssW0rddr0Wss@p"},
+		{"{", "p@ssW0rd", "@ssW0rdp"},
+		{"}", "p@ssW0rd", "dp@ssW0r"},
+		{"$1$2", "p@ssW0rd", "p@ssW0rd12"},
+		{"^2^1", "p@ssW0rd", "12p@ssW0rd"},
+		{"[", "p@ssW0rd", "@ssW0rd"},
+		{"]", "p@ssW0rd", "p@ssW0r"},
+		{"D3", "p@ssW0rd", "p@sW0rd"},
+		{"x04", "p@ssW0rd", "p@ss"},
+		{"O12", "p@ssW0rd", "psW0rd"},
+		{"i4!", "p@ssW0rd", "p@ss!W0rd"},
+		{"o3$", "p@ssW0rd", "p@s$W0rd"},
+		{"'6", "p@ssW0rd", "p@ssW0"},
+		{"ss$", "p@ssW0rd", "p@$$W0rd"},
+		{"@s", "p@ssW0rd", "p@W0rd"},
+		{"z2", "p@ssW0rd", "ppp@ssW0rd"},
+		{"Z2", "p@ssW0rd", "p@ssW0rddd"},
+		{"q", "p@ssW0rd", "pp@@ssssWW00rrdd"},
+		{"k", "p@ssW0rd", "@pssW0rd"},
+		{"K", "p@ssW0rd", "p@ssW0dr"},
+		{"*34", "p@ssW0rd", "p@sWs0rd"},
+		{"y2", "p@ssW0rd", "p@p@ssW0rd"},
+		{"Y2", "p@ssW0rd", "p@ssW0rdrd"},
+		{"E", "p@ssW0rd w0rld", "P@ssw0rd W0rld"},
+
+		// leetspeak, spaces between functions, and parameters above 9
+		{"sa@ so0 se3", "password", "p@ssw0rd"},
+		{"$ $!", "pass", "pass !"},
+		{"TA", "abcdefghijk", "abcdefghijK"},
+
+		// out-of-range positions leave the password unchanged
+		{"T9", "p@ssW0rd", "p@ssW0rd"},
+		{"D8", "p@ssW0rd", "p@ssW0rd"},
+		{"x45", "p@ssW0rd", "p@ssW0rd"},
+		{"i9!", "p@ssW0rd", "p@ssW0rd"},
+		{"i8!", "p@ssW0rd", "p@ssW0rd!"},
+		{"'9", "p@ssW0rd", "p@ssW0rd"},
+		{"c", "", ""},
+		{"pZ", strings.Repeat("a", 10), strings.Repeat("a", 10)},
+
+		// rejection functions
+		{"<8", "p@ssW0rd", "p@ssW0rd"},
+		{"<7", "p@ssW0rd", ""},
+		{">8", "p@ssW0rd", "p@ssW0rd"},
+		{">9", "p@ssW0rd", ""},
+		{"_8", "p@ssW0rd", "p@ssW0rd"},
+		{"_7", "p@ssW0rd", ""},
+		{"!z", "p@ssW0rd", "p@ssW0rd"},
+		{"!@", "p@ssW0rd", ""},
+		{"/@", "p@ssW0rd", "p@ssW0rd"},
+		{"/z", "p@ssW0rd", ""},
+		{"(p", "p@ssW0rd", "p@ssW0rd"},
+		{"(P", "p@ssW0rd", ""},
+		{")d", "p@ssW0rd", "p@ssW0rd"},
+		{")D", "p@ssW0rd", ""},
+		{"=1@", "p@ssW0rd", "p@ssW0rd"},
+		{"=9@", "p@ssW0rd", ""},
+		{"%2s", "p@ssW0rd", "p@ssW0rd"},
+		{"%3s", "p@ssW0rd", ""},
+		{"$1 <8", "p@ssW0rd", ""},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseHashcatRule(test.rule)
+		if err != nil {
+			t.Errorf("%s: %v", test.rule, err)
+			continue
+		}
+		out, ok := rule.Apply([]byte(test.in))
+		if test.out == "" && test.in != "" {
+			if ok {
+				t.Errorf("%s: %q: expected rejection, got %q", test.rule, test.in, out)
+			}
+			continue
+		}
+		if !ok || string(out) != test.out {
+			t.Errorf("%s: %q: want %q, got %q (accepted: %v)", test.rule, test.in, test.out, out, ok)
+		}
+	}
+
+	for _, invalid := range []string{"", " ", "X", "T", "Ta", "$", "sa", "x0", "*1"} {
+		if _, err := ParseHashcatRule(invalid); err == nil {
+			t.Errorf("%q: expected parsing to fail", invalid)
+		}
+	}
+}
+
+// TestHashcatMutate tests that the mutator applies rules in order, and skips
+// rejected and duplicate variants
+func TestHashcatMutate(t *testing.T) {
+	rules := `# comment
+
+c
+:
+$1
+u <4
+C
+c
+`
+	m, err := NewHashcatMutatorFromReader(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := m.Mutate([]byte("password"), 10)
+	want := []string{"Password", "password1", "pASSWORD"}
+	if len(variants) != len(want) {
+		t.Fatalf("want %q, got %q", want, variants)
+	}
+	for i := range want {
+		if string(variants[i]) != want[i] {
+			t.Errorf("variant %d: want %q, got %q", i, want[i], variants[i])
+		}
+	}
+	if variants := m.Mutate([]byte("password"), 2); len(variants) != 2 {
+		t.Errorf("want 2 variants, got %d", len(variants))
+	}
+
+	if _, err := NewHashcatMutatorFromReader(strings.NewReader("c\n$\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+	if _, err := NewHashcatMutatorFromRules(nil); err == nil {
+		t.Errorf("expected an empty rule list to fail")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// maxPairLineLength is the maximum length of a line of password pairs
+const maxPairLineLength = 1 << 20
+
+// InferRules returns the RDas rules that transform the old password into the
+// new one, with positions counted in characters. Both positive and negative
+// positions are returned when both explain the pair. Substitutions are only
+// inferred for single characters. The result is empty if the passwords are
+// equal or no single rule explains the pair.
+func InferRules(oldPassword, newPassword []byte) []RDasRule {
+	if bytes.Equal(oldPassword, newPassword) || !utf8.Valid(oldPassword) || !utf8.Valid(newPassword) {
+		return nil
+	}
+	oldRunes, newRunes := []rune(string(oldPassword)), []rune(string(newPassword))
+
+	var candidates []RDasRule
+	switch {
+	case len(newRunes) == len(oldRunes):
+		// a capitalization or a substitution keeps the length
+		var diffs []int
+		for i := range oldRunes {
+			if oldRunes[i] != newRunes[i] {
+				diffs = append(diffs, i)
+			}
+		}
+		// Capitalizations are preferred to substitutions of a letter by
+		// the same letter in another case.
+		if r, err := switchRuneCase(oldRunes[diffs[0]]); err == nil && r == newRunes[diffs[0]] {
+			if len(diffs) == 1 {
+				candidates = append(candidates,
+					RDasRule{RuleType: "c", Position: diffs[0]},
+					RDasRule{RuleType: "c", Position: diffs[0] - len(oldRunes)})
+			}
+		} else {
+			candidates = append(candidates, RDasRule{RuleType: "s", String1: string(oldRunes[diffs[0]]), String2: string(newRunes[diffs[0]])})
+		}
+	case len(newRunes) < len(oldRunes):
+		k := len(oldRunes) - len(newRunes)
+		candidates = append(candidates, RDasRule{RuleType: "d", Position: k}, RDasRule{RuleType: "d", Position: -k})
+		// a substitution with an empty string deletes characters
+		if diffs := firstDiff(oldRunes, newRunes); diffs < len(oldRunes) {
+			candidates = append(candidates, RDasRule{RuleType: "s", String1: string(oldRunes[diffs])})
+		}
+	default:
+		k := len(newRunes) - len(oldRunes)
+		for p := 0; p <= len(oldRunes); p++ {
+			if string(newRunes[:p]) == string(oldRunes[:p]) && string(newRunes[p+k:]) == string(oldRunes[p:]) {
+				inserted := string(newRunes[p : p+k])
+				candidates = append(candidates,
+					RDasRule{RuleType: "i", Position: p, String1: inserted},
+					RDasRule{RuleType: "i", Position: p - len(oldRunes) - 1, String1: inserted})
+			}
+		}
+	}
+
+	// Only keep the candidates that do transform the old password into the
+	// new one, e.g., substitutions that replace every occurrence.
+	var rules []RDasRule
+	seen := make(map[RDasRule]bool)
+	for _, rule := range candidates {
+		if !seen[rule] && rule.Validate() == nil && bytes.Equal(applyRule(rule, oldPassword, true), newPassword) {
+			seen[rule] = true
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// firstDiff returns the index of the first rune that differs between a and
+// b, or the length of the shorter one
+func firstDiff(a, b []rune) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// RuleLearner ranks RDas rules by the number of password pairs they explain,
+// e.g., pairs of old and new passwords of the same user
+type RuleLearner struct {
+	counts    map[RDasRule]int
+	pairs     int
+	explained int
+}
+
+// NewRuleLearner returns a learner without pairs
+func NewRuleLearner() *RuleLearner {
+	return &RuleLearner{counts: make(map[RDasRule]int)}
+}
+
+// Add counts the rules explaining the transformation of the old password
+// into the new one, and reports whether any rule does
+func (l *RuleLearner) Add(oldPassword, newPassword []byte) bool {
+	l.pairs++
+	rules := InferRules(oldPassword, newPassword)
+	for _, rule := range rules {
+		l.counts[rule]++
+	}
+	if len(rules) > 0 {
+		l.explained++
+	}
+	return len(rules) > 0
+}
+
+// Pairs returns the number of pairs added, and the number of pairs explained
+// by a rule
+func (l *RuleLearner) Pairs() (pairs, explained int) {
+	return l.pairs, l.explained
+}
+
+// Rules returns the rules explaining at least minCount pairs, by decreasing
+// count. Ties are broken by rule type, position and strings, so that the
+// order is deterministic.
+func (l *RuleLearner) Rules(minCount int) []RDasRule {
+	var rules []RDasRule
+	for rule, count := range l.counts {
+		if count >= minCount {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		switch {
+		case l.counts[a] != l.counts[b]:
+			return l.counts[a] > l.counts[b]
+		case a.RuleType != b.RuleType:
+			return a.RuleType < b.RuleType
+		case a.Position != b.Position:
+			return a.Position < b.Position
+		case a.String1 != b.String1:
+			return a.String1 < b.String1
+		default:
+			return a.String2 < b.String2
+		}
+	})
+	return rules
+}
+
+// Count returns the number of pairs explained by the rule
+func (l *RuleLearner) Count(rule RDasRule) int {
+	return l.counts[rule]
+}
+
+// ReadPairs calls fn with each pair of passwords of r, one pair per line as
+// <old password>\t<new password>. Empty lines are ignored, and lines without
+// a tab are skipped and counted. The passwords are only valid during the call
+// to fn.
+func ReadPairs(r io.Reader, fn func(oldPassword, newPassword []byte) error) (skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxPairLineLength)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.SplitN(line, []byte("\t"), 2)
+		if len(fields) < 2 {
+			skipped++
+			continue
+		}
+		if err := fn(fields[0], fields[1]); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, scanner.Err()
+}
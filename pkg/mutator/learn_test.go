@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestInferRules tests that the rules explaining password pairs are found
+func TestInferRules(t *testing.T) {
+	for _, test := range []struct {
+		old, new string
+		want     []RDasRule
+	}{
+		{"password", "Password", []RDasRule{{RuleType: "c", Position: 0}, {RuleType: "c", Position: -8}}},
+		{"пароль", "паролЬ", []RDasRule{{RuleType: "c", Position: 5}, {RuleType: "c", Position: -1}}},
+		{"password", "password1", []RDasRule{{RuleType: "i", Position: 8, String1: "1"}, {RuleType: "i", Position: -1, String1: "1"}}},
+		{"password", "!!password", []RDasRule{{RuleType: "i", Position: 0, String1: "!!"}, {RuleType: "i", Position: -9, String1: "!!"}}},
+		{"hello", "helllo", []RDasRule{
+			{RuleType: "i", Position: 2, String1: "l"}, {RuleType: "i", Position: -4, String1: "l"},
+			{RuleType: "i", Position: 3, String1: "l"}, {RuleType: "i", Position: -3, String1: "l"},
+			{RuleType: "i", Position: 4, String1: "l"}, {RuleType: "i", Position: -2, String1: "l"},
+		}},
+		{"password123", "password", []RDasRule{{RuleType: "d", Position: -3}}},
+		{"123password", "password", []RDasRule{{RuleType: "d", Position: 3}}},
+		{"p@ssword", "pssword", []RDasRule{{RuleType: "s", String1: "@"}}},
+		{"password", "p@ssword", []RDasRule{{RuleType: "s", String1: "a", String2: "@"}}},
+		{"banana", "b@nana", nil},
+		{"password", "drowssap", nil},
+		{"password", "password", nil},
+		{"", "1", []RDasRule{{RuleType: "i", Position: 0, String1: "1"}, {RuleType: "i", Position: -1, String1: "1"}}},
+	} {
+		got := InferRules([]byte(test.old), []byte(test.new))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q -> %q: want %+v, got %+v", test.old, test.new, test.want, got)
+		}
+	}
+
+	// The built-in rules are inferred from the variants they produce,
+	// except for substitutions of several characters.
+	password := []byte("password1")
+	for _, rule := range NewRDasMutator().dasRules {
+		variant := applyRule(rule, password, true)
+		if bytes.Equal(variant, password) || (rule.RuleType == "s" && utf8.RuneCountInString(rule.String1) > 1) {
+			continue
+		}
+		found := false
+		for _, inferred := range InferRules(password, variant) {
+			found = found || inferred == rule
+		}
+		if !found {
+			t.Errorf("rule %+v not inferred from %q", rule, variant)
+		}
+	}
+}
+
+// TestRuleLearner tests that learned rules are ranked by frequency and can be
+// loaded by the mutator
+func TestRuleLearner(t *testing.T) {
+	l := NewRuleLearner()
+	for _, pair := range [][2]string{
+		{"password", "password1"},
+		{"sunshine", "sunshine1"},
+		{"dragon", "Dragon"},
+		{"monkey", "monkey1"},
+		{"letmein", "Letmein"},
+		{"qwerty", "qwerty!"},
+		{"abc", "xyz"},
+	} {
+		l.Add([]byte(pair[0]), []byte(pair[1]))
+	}
+	if pairs, explained := l.Pairs(); pairs != 7 || explained != 6 {
+		t.Errorf("want 7 pairs and 6 explained, got %d and %d", pairs, explained)
+	}
+
+	rules := l.Rules(2)
+	want := []RDasRule{
+		{RuleType: "i", Position: -1, String1: "1"},
+		{RuleType: "c", Position: 0},
+		{RuleType: "i", Position: 8, String1: "1"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Fatalf("want %+v, got %+v", want, rules)
+	}
+	if l.Count(want[0]) != 3 || len(l.Rules(1)) <= len(rules) {
+		t.Errorf("unexpected counts")
+	}
+
+	data, err := json.Marshal(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewRDasMutatorFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants := m.Mutate([]byte("princess"), 2); len(variants) != 2 || string(variants[0]) != "princess1" || string(variants[1]) != "Princess" {
+		t.Errorf("unexpected variants %q", variants)
+	}
+}
+
+// TestReadPairs tests the parsing of tab-separated password pairs
+func TestReadPairs(t *testing.T) {
+	var pairs []string
+	skipped, err := ReadPairs(strings.NewReader("old\tnew\r\n\nmalformed\na\tb\tc\n\tempty"), func(oldPassword, newPassword []byte) error {
+		pairs = append(pairs, string(oldPassword)+"|"+string(newPassword))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"old|new", "a|b\tc", "|empty"}
+	if skipped != 1 || !reflect.DeepEqual(pairs, want) {
+		t.Errorf("want %q with 1 skipped line, got %q with %d", want, pairs, skipped)
+	}
+}
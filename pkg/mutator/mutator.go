@@ -8,3 +8,98 @@ package mutator
 type Mutator interface {
 	Mutate([]byte, int) [][]byte
 }
+
+// Variant is a password variant along with the rule that produced it
+type Variant struct {
+	Password []byte
+	Rule     RDasRule
+}
+
+// ProvenanceMutator is a Mutator that also reports the rule producing each
+// variant, e.g., to tell users how their password relates to a breached one
+type ProvenanceMutator interface {
+	Mutator
+	MutateWithProvenance([]byte, int) []Variant
+}
+
+// variantIterator generates the variants of a password one at a time, in the
+// order in which Mutate returns them, so that callers that skip variants,
+// e.g., PolicyMutator, only generate the variants they examine
+type variantIterator interface {
+	// next returns the next variant, or false once there are no more
+	next() (Variant, bool)
+}
+
+// iterableMutator is a Mutator that generates its variants one at a time,
+// as do the mutators of this package
+type iterableMutator interface {
+	Mutator
+	iterate(password []byte) variantIterator
+}
+
+// iterate returns an iterator over the variants of the password generated by
+// m, with their rules if m is a ProvenanceMutator. Other mutators than those
+// of this package are asked for twice as many variants each time the
+// iterator runs out.
+func iterate(m Mutator, password []byte) variantIterator {
+	if im, ok := m.(iterableMutator); ok {
+		return im.iterate(password)
+	}
+	return &mutateIterator{mutator: m, password: password}
+}
+
+// takeVariants returns up to num variants of the iterator
+func takeVariants(variants variantIterator, num int) []Variant {
+	taken := make([]Variant, 0, num)
+	for len(taken) < num {
+		variant, ok := variants.next()
+		if !ok {
+			break
+		}
+		taken = append(taken, variant)
+	}
+	return taken
+}
+
+// passwords returns the passwords of the variants
+func passwords(variants []Variant) [][]byte {
+	mutations := make([][]byte, len(variants))
+	for i, variant := range variants {
+		mutations[i] = variant.Password
+	}
+	return mutations
+}
+
+// mutateIterator iterates over the variants of a mutator through Mutate. The
+// mutator must return the same variants first when asked for more.
+type mutateIterator struct {
+	mutator   Mutator
+	password  []byte
+	variants  []Variant
+	position  int
+	exhausted bool
+}
+
+// next returns the next variant, requesting more from the mutator if needed
+func (it *mutateIterator) next() (Variant, bool) {
+	if it.position == len(it.variants) && !it.exhausted {
+		request := 2 * len(it.variants)
+		if request == 0 {
+			request = 16
+		}
+		if pm, ok := it.mutator.(ProvenanceMutator); ok {
+			it.variants = pm.MutateWithProvenance(it.password, request)
+		} else {
+			it.variants = nil
+			for _, password := range it.mutator.Mutate(it.password, request) {
+				it.variants = append(it.variants, Variant{Password: password})
+			}
+		}
+		it.exhausted = len(it.variants) < request
+	}
+	if it.position >= len(it.variants) {
+		return Variant{}, false
+	}
+	it.position++
+	return it.variants[it.position-1], true
+}
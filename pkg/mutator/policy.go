@@ -0,0 +1,197 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Character classes that a policy may require
+const (
+	ClassLetter = "letter"
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// maxPolicyOversampling bounds the number of variants of the underlying
+// mutator that a PolicyMutator examines, as a multiple of the budget
+const maxPolicyOversampling = 64
+
+// Policy is a site's password policy. Lengths are counted in characters.
+type Policy struct {
+	// MinLength is the minimum length of a password.
+	MinLength int `json:"minLength"`
+	// MaxLength is the maximum length of a password, or zero if there is
+	// no maximum.
+	MaxLength int `json:"maxLength"`
+	// RequiredClasses lists the character classes that a password must
+	// contain: letter, lower, upper, digit, or symbol, i.e., any character
+	// that is neither a letter nor a digit.
+	RequiredClasses []string `json:"requiredClasses"`
+	// Disallowed lists passwords that are rejected.
+	Disallowed []string `json:"disallowed"`
+}
+
+// Validate checks that the lengths are consistent and the character classes
+// are known
+func (p Policy) Validate() error {
+	if p.MinLength < 0 || p.MaxLength < 0 {
+		return errors.New("negative password length")
+	}
+	if p.MaxLength != 0 && p.MaxLength < p.MinLength {
+		return errors.New("maximum password length below the minimum")
+	}
+	for _, class := range p.RequiredClasses {
+		switch class {
+		case ClassLetter, ClassLower, ClassUpper, ClassDigit, ClassSymbol:
+		default:
+			return fmt.Errorf("unknown character class %q", class)
+		}
+	}
+	return nil
+}
+
+// NewPolicyFromReader reads a policy encoded as a JSON object, e.g.,
+// {"minLength": 8, "requiredClasses": ["digit"], "disallowed": ["password1"]}
+func NewPolicyFromReader(r io.Reader) (Policy, error) {
+	var p Policy
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return Policy{}, fmt.Errorf("invalid password policy: %v", err)
+	}
+	if err := p.Validate(); err != nil {
+		return Policy{}, fmt.Errorf("invalid password policy: %v", err)
+	}
+	return p, nil
+}
+
+// NewPolicyFromFile reads a policy from a JSON file
+func NewPolicyFromFile(path string) (Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Policy{}, err
+	}
+	defer f.Close()
+	return NewPolicyFromReader(f)
+}
+
+// PolicyMutator filters the variants of a mutator with a password policy.
+// Variants that the policy rejects are skipped, and the following variants of
+// the underlying mutator fill the budget, up to a bound. The mutators of this
+// package generate their variants one at a time, so only the examined
+// variants are generated. Other mutators must return the same variants first
+// when asked for more.
+type PolicyMutator struct {
+	mutator    Mutator
+	policy     Policy
+	disallowed map[string]struct{}
+}
+
+// NewPolicyMutator returns a mutator filtering the variants of m with the
+// policy. Use NewProvenancePolicyMutator to keep the provenance of variants.
+func NewPolicyMutator(m Mutator, policy Policy) (*PolicyMutator, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	disallowed := make(map[string]struct{}, len(policy.Disallowed))
+	for _, password := range policy.Disallowed {
+		disallowed[password] = struct{}{}
+	}
+	return &PolicyMutator{mutator: m, policy: policy, disallowed: disallowed}, nil
+}
+
+// Allows reports whether the password complies with the policy
+func (m *PolicyMutator) Allows(password []byte) bool {
+	length := utf8.RuneCount(password)
+	if length < m.policy.MinLength || (m.policy.MaxLength != 0 && length > m.policy.MaxLength) {
+		return false
+	}
+	if _, ok := m.disallowed[string(password)]; ok {
+		return false
+	}
+	for _, class := range m.policy.RequiredClasses {
+		if !containsClass(password, class) {
+			return false
+		}
+	}
+	return true
+}
+
+// Mutate generates up to the requested number of variants allowed by the
+// policy
+func (m *PolicyMutator) Mutate(password []byte, num int) [][]byte {
+	return passwords(m.mutate(password, num))
+}
+
+// mutate returns up to num variants allowed by the policy, examining at most
+// maxPolicyOversampling times as many variants of the underlying mutator
+func (m *PolicyMutator) mutate(password []byte, num int) []Variant {
+	variants := iterate(m.mutator, password)
+	mutations := make([]Variant, 0, num)
+	for examined := 0; len(mutations) < num && examined < num*maxPolicyOversampling; examined++ {
+		variant, ok := variants.next()
+		if !ok {
+			break
+		}
+		if m.Allows(variant.Password) {
+			mutations = append(mutations, variant)
+		}
+	}
+	return mutations
+}
+
+// ProvenancePolicyMutator is a PolicyMutator filtering the variants of a
+// ProvenanceMutator, which reports the rule producing each variant
+type ProvenancePolicyMutator struct {
+	*PolicyMutator
+}
+
+// NewProvenancePolicyMutator returns a mutator filtering the variants of m
+// with the policy, and reporting their provenance
+func NewProvenancePolicyMutator(m ProvenanceMutator, policy Policy) (*ProvenancePolicyMutator, error) {
+	pm, err := NewPolicyMutator(m, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &ProvenancePolicyMutator{PolicyMutator: pm}, nil
+}
+
+// MutateWithProvenance is Mutate, but returns each variant along with the
+// rule that produced it
+func (m *ProvenancePolicyMutator) MutateWithProvenance(password []byte, num int) []Variant {
+	return m.mutate(password, num)
+}
+
+// containsClass reports whether the password contains a character of the
+// class
+func containsClass(password []byte, class string) bool {
+	for _, r := range string(password) {
+		var ok bool
+		switch class {
+		case ClassLetter:
+			ok = unicode.IsLetter(r)
+		case ClassLower:
+			ok = unicode.IsLower(r)
+		case ClassUpper:
+			ok = unicode.IsUpper(r)
+		case ClassDigit:
+			ok = unicode.IsDigit(r)
+		case ClassSymbol:
+			ok = !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
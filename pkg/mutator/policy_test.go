@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPolicyMutator tests that variants rejected by the policy are skipped
+// and replaced by the variants of later rules
+func TestPolicyMutator(t *testing.T) {
+	policy := Policy{
+		MinLength:       8,
+		MaxLength:       12,
+		RequiredClasses: []string{ClassDigit},
+		Disallowed:      []string{"password1"},
+	}
+	m, err := NewPolicyMutator(NewRDasMutator(), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		password string
+		allowed  bool
+	}{
+		{"passw0rd", true},
+		{"pässwörd1", true},
+		{"password", false},
+		{"pass1", false},
+		{"password1234!", false},
+		{"password1", false},
+		{"Password1", true},
+	} {
+		if allowed := m.Allows([]byte(test.password)); allowed != test.allowed {
+			t.Errorf("%s: want allowed %v, got %v", test.password, test.allowed, allowed)
+		}
+	}
+
+	variants := m.Mutate([]byte("sunshine"), 100)
+	if len(variants) != 100 {
+		t.Fatalf("want 100 variants, got %d", len(variants))
+	}
+	seen := make(map[string]bool)
+	for _, variant := range variants {
+		if !m.Allows(variant) || seen[string(variant)] {
+			t.Errorf("unexpected variant %q", variant)
+		}
+		seen[string(variant)] = true
+	}
+	// The variants are the allowed variants of the underlying mutator, in
+	// order.
+	var want []string
+	for _, variant := range NewRDasMutator().Mutate([]byte("sunshine"), 10000) {
+		if m.Allows(variant) && len(want) < 100 {
+			want = append(want, string(variant))
+		}
+	}
+	for i := range want {
+		if string(variants[i]) != want[i] {
+			t.Fatalf("variant %d: want %q, got %q", i, want[i], variants[i])
+		}
+	}
+
+	// A policy that no variant satisfies yields no variants.
+	strict, err := NewPolicyMutator(NewRDasMutator(), Policy{MinLength: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants := strict.Mutate([]byte("sunshine"), 10); len(variants) != 0 {
+		t.Errorf("want no variants, got %q", variants)
+	}
+}
+
+// TestPolicyProvenance tests that a policy mutator reports the rules of the
+// variants of a ProvenanceMutator, and that configured policies keep the
+// provenance of RDas rules only
+func TestPolicyProvenance(t *testing.T) {
+	policy := Policy{MinLength: 9}
+	m, err := NewProvenancePolicyMutator(NewRDasMutator(), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := m.MutateWithProvenance([]byte("sunshine"), 50)
+	mutations := m.Mutate([]byte("sunshine"), 50)
+	if len(variants) != 50 || len(mutations) != 50 {
+		t.Fatalf("want 50 variants, got %d and %d", len(variants), len(mutations))
+	}
+	byRule := make(map[string]RDasRule)
+	for _, variant := range NewRDasMutator().MutateWithProvenance([]byte("sunshine"), 10000) {
+		byRule[string(variant.Password)] = variant.Rule
+	}
+	for i, variant := range variants {
+		if string(variant.Password) != string(mutations[i]) || !m.Allows(variant.Password) {
+			t.Fatalf("variant %d: unexpected %q", i, variant.Password)
+		}
+		if variant.Rule != byRule[string(variant.Password)] {
+			t.Errorf("%q: want rule %+v, got %+v", variant.Password, byRule[string(variant.Password)], variant.Rule)
+		}
+	}
+
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(policyPath, []byte(`{"minLength": 9}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rulesPath := filepath.Join(dir, "rules.txt")
+	if err := os.WriteFile(rulesPath, []byte("$1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		cfg        Config
+		provenance bool
+	}{
+		{Config{PolicyFile: policyPath}, true},
+		{Config{PolicyFile: policyPath, RulePairs: true}, false},
+		{Config{PolicyFile: policyPath, RulesFile: rulesPath, RulesFormat: RulesFormatHashcat}, false},
+	} {
+		configured, err := NewMutatorFromConfig(test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := configured.(ProvenanceMutator); ok != test.provenance {
+			t.Errorf("%+v: want provenance %v, got %v", test.cfg, test.provenance, ok)
+		}
+	}
+}
+
+// TestPolicyLoading tests that policies are loaded from JSON and validated
+func TestPolicyLoading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"minLength": 8, "requiredClasses": ["upper", "symbol"], "disallowed": ["Password!"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewPolicyFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.MinLength != 8 || len(policy.RequiredClasses) != 2 || len(policy.Disallowed) != 1 {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+
+	for _, invalid := range []string{
+		`{"minLength": -1}`,
+		`{"minLength": 8, "maxLength": 6}`,
+		`{"requiredClasses": ["emoji"]}`,
+		`{"minlen": 8}`,
+		`[]`,
+	} {
+		if _, err := NewPolicyFromReader(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%s: expected loading the policy to fail", invalid)
+		}
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 	"unicode"
-
-	"github.com/spaolacci/murmur3"
+	"unicode/utf8"
 )
 
 // RDasRule struct is for initizializing the re-ordered Das rules. Rules are of
@@ -35,8 +37,107 @@ type RDasRule struct {
 }
 
 // RDasMutator uses the ordered Das et al. mangling rules defined in dasrules.go
+//
+// Positions are counted in characters (runes) of UTF-8 passwords, so that
+// rules never split a multi-byte character. Passwords that are not valid
+// UTF-8, and all passwords in byte-compatible mode, are mangled byte by byte.
 type RDasMutator struct {
 	dasRules []RDasRule
+	// byteCompatible applies the rules to bytes, as in earlier versions
+	byteCompatible bool
+}
+
+// Validate checks that the rule has a known type, and that its position and
+// strings are meaningful for that type
+func (r RDasRule) Validate() error {
+	switch r.RuleType {
+	case "c":
+		if r.String1 != "" || r.String2 != "" {
+			return errors.New("capitalization rule with strings")
+		}
+	case "d":
+		if r.Position == 0 {
+			return errors.New("deletion rule at position 0")
+		}
+		if r.String1 != "" || r.String2 != "" {
+			return errors.New("deletion rule with strings")
+		}
+	case "i":
+		if r.String1 == "" {
+			return errors.New("insertion rule without string1")
+		}
+		if r.String2 != "" {
+			return errors.New("insertion rule with string2")
+		}
+	case "s":
+		if r.Position != 0 {
+			return errors.New("substitution rule with a position")
+		}
+		if r.String1 == "" {
+			return errors.New("substitution rule without string1")
+		}
+		if r.String1 == r.String2 {
+			return errors.New("substitution rule replacing string1 with itself")
+		}
+	default:
+		return fmt.Errorf("unknown rule type %q", r.RuleType)
+	}
+	return nil
+}
+
+// Describe returns a short description of how the rule transforms a
+// password, e.g., "trailing digits added". The description does not include
+// the inserted or substituted strings, so that it can be shown to users
+// without revealing the breached password.
+func (r RDasRule) Describe() string {
+	switch r.RuleType {
+	case "c":
+		return "capitalization differs"
+	case "d":
+		if r.Position > 0 {
+			return "leading characters removed"
+		}
+		return "trailing characters removed"
+	case "i":
+		kind := describeCharacters(r.String1)
+		switch r.Position {
+		case 0:
+			return "leading " + kind + " added"
+		case -1:
+			return "trailing " + kind + " added"
+		default:
+			return kind + " inserted"
+		}
+	case "s":
+		return "characters substituted"
+	default:
+		return "password differs"
+	}
+}
+
+// describeCharacters names the class of the characters of a string
+func describeCharacters(s string) string {
+	var letters, digits, others bool
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r):
+			letters = true
+		case unicode.IsDigit(r):
+			digits = true
+		default:
+			others = true
+		}
+	}
+	switch {
+	case letters && !digits && !others:
+		return "letters"
+	case digits && !letters && !others:
+		return "digits"
+	case others && !letters && !digits:
+		return "symbols"
+	default:
+		return "characters"
+	}
 }
 
 // NewRDasMutator returns a new RDasMutator
@@ -49,6 +150,57 @@ func NewRDasMutator() *RDasMutator {
 	return m
 }
 
+// NewRDasMutatorFromRules returns an RDasMutator applying the given rules in
+// order, or an error if a rule is invalid
+func NewRDasMutatorFromRules(rules []RDasRule) (*RDasMutator, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("empty rule list")
+	}
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	m := new(RDasMutator)
+	m.dasRules = append([]RDasRule(nil), rules...)
+	return m, nil
+}
+
+// NewRDasMutatorFromReader returns an RDasMutator applying the rules of a
+// JSON array in the format of dasrules.go
+func NewRDasMutatorFromReader(r io.Reader) (*RDasMutator, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var rules []RDasRule
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("could not decode rules: %v", err)
+	}
+	return NewRDasMutatorFromRules(rules)
+}
+
+// NewRDasMutatorFromFile returns an RDasMutator applying the rules of a JSON
+// file in the format of dasrules.go
+func NewRDasMutatorFromFile(path string) (*RDasMutator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m, err := NewRDasMutatorFromReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// SetByteCompatible selects whether rules are applied to bytes rather than
+// characters. Byte-compatible mode generates the same variants as earlier
+// versions, e.g., to extend existing datasets, but may produce invalid UTF-8
+// from non-ASCII passwords. Both modes agree on ASCII passwords.
+func (m *RDasMutator) SetByteCompatible(byteCompatible bool) {
+	m.byteCompatible = byteCompatible
+}
+
 // switchCase switches an upper-case letter to a lower-case letter, and vice-versa
 func switchCase(b byte) (byte, error) {
 	r := rune(b)
@@ -68,47 +220,82 @@ func switchCase(b byte) (byte, error) {
 // unique strings.  May return fewer than requested number, caller should
 // check.
 func (m *RDasMutator) Mutate(password []byte, num int) [][]byte {
+	return passwords(m.MutateWithProvenance(password, num))
+}
 
+// MutateWithProvenance is Mutate, but returns each mutation along with the
+// rule that produced it
+func (m *RDasMutator) MutateWithProvenance(password []byte, num int) []Variant {
+	return takeVariants(m.iterate(password), num)
+}
+
+// iterate returns an iterator applying the rules to the password in order
+func (m *RDasMutator) iterate(password []byte) variantIterator {
 	if len(m.dasRules) == 0 {
 		panic("RDasMutator used without being initialized")
 	}
+	return &rdasIterator{
+		rules:    m.dasRules,
+		password: password,
+		byRune:   !m.byteCompatible && utf8.Valid(password),
+		seen:     map[string]struct{}{string(password): {}},
+	}
+}
 
-	mutations := make([][]byte, 0, num)
-	seen := make(map[uint32]struct{})
-	seen[murmur3.Sum32(password)] = struct{}{}
-	for i, j := 0, 0; j < num && i < len(m.dasRules); i++ {
-		s := password
-		rule := m.dasRules[i]
-
-		// Rules were trained only on ASCII strings. We will anyway apply them
-		// here, since if there are non-ASCII characters only other option
-		// would be to just generate dummies, and we might nevertheless get
-		// some benefit from applying mangling to UTF8 strings. (E.g., because
-		// the first few characters are ASCII)
-
-		position := rule.Position
-
-		switch rule.RuleType {
-		case "c":
-			s = changeCap(s, position)
-		case "d":
-			s = deletePortion(s, position)
-		case "i":
-			s = insert(s, position, rule.String1)
-		case "s":
-			s = substitute(s, position, rule.String1, rule.String2)
-		default:
-			panic("One of the dasRules unrecognized")
-		}
+// rdasIterator generates the variants of a password by applying RDas rules
+// in order
+type rdasIterator struct {
+	rules    []RDasRule
+	password []byte
+	byRune   bool
+	seen     map[string]struct{}
+}
 
-		key := murmur3.Sum32(s)
-		if _, ok := seen[key]; !ok {
-			j++
-			seen[key] = struct{}{}
-			mutations = append(mutations, s)
+// next returns the variant of the next rule producing a new password
+func (it *rdasIterator) next() (Variant, bool) {
+	for len(it.rules) > 0 {
+		rule := it.rules[0]
+		it.rules = it.rules[1:]
+		s := applyRule(rule, it.password, it.byRune)
+		// Variants are deduplicated exactly, since a hash collision
+		// would drop a variant.
+		if _, ok := it.seen[string(s)]; !ok {
+			it.seen[string(s)] = struct{}{}
+			return Variant{Password: s, Rule: rule}, true
 		}
 	}
-	return mutations
+	return Variant{}, false
+}
+
+// applyRule returns a copy of the password transformed by the rule, with
+// positions counted in runes if byRune is set
+func applyRule(rule RDasRule, password []byte, byRune bool) []byte {
+	// Rules were trained only on ASCII strings. We will anyway apply them
+	// here, since if there are non-ASCII characters only other option
+	// would be to just generate dummies, and we might nevertheless get
+	// some benefit from applying mangling to UTF8 strings. Positions
+	// then count characters rather than bytes, unless byte-compatible.
+
+	position := rule.Position
+
+	switch {
+	case rule.RuleType == "c" && byRune:
+		return []byte(string(changeCapRunes([]rune(string(password)), position)))
+	case rule.RuleType == "c":
+		return changeCap(password, position)
+	case rule.RuleType == "d" && byRune:
+		return []byte(string(deletePortionRunes([]rune(string(password)), position)))
+	case rule.RuleType == "d":
+		return deletePortion(password, position)
+	case rule.RuleType == "i" && byRune:
+		return []byte(string(insertRunes([]rune(string(password)), position, rule.String1)))
+	case rule.RuleType == "i":
+		return insert(password, position, rule.String1)
+	case rule.RuleType == "s":
+		return substitute(password, position, rule.String1, rule.String2)
+	default:
+		panic("One of the dasRules unrecognized")
+	}
 }
 
 // changeCap returns a copy of the buffer with the case switched at the given
@@ -167,6 +354,59 @@ func insert(oldBuf []byte, position int, string1 string) []byte {
 	return newBuf
 }
 
+// switchRuneCase switches the case of a letter
+func switchRuneCase(r rune) (rune, error) {
+	if unicode.IsLetter(r) {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r), nil
+		} else if unicode.IsLower(r) {
+			return unicode.ToUpper(r), nil
+		} else {
+			return 0, errors.New("invalid rune")
+		}
+	}
+	return 0, errors.New("not a letter")
+}
+
+// changeCapRunes is changeCap with positions counted in runes
+func changeCapRunes(oldBuf []rune, position int) []rune {
+	newBuf := make([]rune, len(oldBuf))
+	copy(newBuf, oldBuf)
+	if position < 0 {
+		position = len(oldBuf) + position
+	}
+	if position >= 0 && position < len(oldBuf) {
+		if r, err := switchRuneCase(oldBuf[position]); err == nil {
+			newBuf[position] = r
+		}
+	}
+	return newBuf
+}
+
+// deletePortionRunes is deletePortion with positions counted in runes
+func deletePortionRunes(oldBuf []rune, position int) []rune {
+	if position >= 0 && position <= len(oldBuf) {
+		return oldBuf[position:]
+	} else if position < 0 && len(oldBuf)+position >= 0 {
+		return oldBuf[:len(oldBuf)+position]
+	}
+	return oldBuf
+}
+
+// insertRunes is insert with positions counted in runes
+func insertRunes(oldBuf []rune, position int, string1 string) []rune {
+	if position < 0 {
+		position = position + len(oldBuf) + 1
+	}
+	if position < 0 || position > len(oldBuf) {
+		return oldBuf
+	}
+	newBuf := make([]rune, 0, len(oldBuf)+len(string1))
+	newBuf = append(newBuf, oldBuf[:position]...)
+	newBuf = append(newBuf, []rune(string1)...)
+	return append(newBuf, oldBuf[position:]...)
+}
+
 // substitute returns a copy of the buffer with instances of one substring
 // replaced with another substring
 func substitute(buf []byte, _ int, string1, string2 string) []byte {
@@ -5,7 +5,14 @@ package mutator
 
 import (
 	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"unicode/utf8"
+
+	"github.com/spaolacci/murmur3"
 )
 
 // TestRdasMutate tests that the mutator produces the expected variants
@@ -42,6 +49,287 @@ func TestRdasMutate(t *testing.T) {
 	}
 }
 
+// TestRdasRules tests that the built-in rules are valid, and that rule sets
+// can be loaded and are validated
+func TestRdasRules(t *testing.T) {
+	for i, rule := range NewRDasMutator().dasRules {
+		if err := rule.Validate(); err != nil {
+			t.Errorf("built-in rule %d: %v", i, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[{"ruletype": "i", "position": -1, "string1": "!"}, {"ruletype": "s", "string1": "a", "string2": "@"}]`
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewRDasMutatorFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := m.Mutate([]byte("password"), 10)
+	if len(variants) != 2 || string(variants[0]) != "password!" || string(variants[1]) != "p@ssword" {
+		t.Errorf("unexpected variants %q", variants)
+	}
+
+	for _, invalid := range []string{
+		`[]`,
+		`[{"ruletype": "x"}]`,
+		`[{"ruletype": "d", "position": 0}]`,
+		`[{"ruletype": "c", "string1": "a"}]`,
+		`[{"ruletype": "i", "position": 1}]`,
+		`[{"ruletype": "s", "string1": "a", "string2": "a"}]`,
+		`[{"ruletype": "s", "position": 1, "string1": "a", "string2": "b"}]`,
+		`[{"rule_type": "c"}]`,
+		`{"ruletype": "c"}`,
+	} {
+		if _, err := NewRDasMutatorFromReader(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%s: expected loading rules to fail", invalid)
+		}
+	}
+	if _, err := NewRDasMutatorFromFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("expected loading a missing file to fail")
+	}
+}
+
+// TestRdasUnicode tests that positions count characters of UTF-8 passwords,
+// and that the byte-compatible mode matches earlier versions
+func TestRdasUnicode(t *testing.T) {
+	rules := []RDasRule{
+		{RuleType: "c", Position: 0},
+		{RuleType: "c", Position: -1},
+		{RuleType: "d", Position: 1},
+		{RuleType: "d", Position: -1},
+		{RuleType: "i", Position: 1, String1: "!"},
+		{RuleType: "i", Position: -2, String1: "ё"},
+		{RuleType: "s", String1: "é", String2: "e"},
+	}
+	m, err := NewRDasMutatorFromRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		in  string
+		out []string
+	}{
+		{"café", []string{"Café", "cafÉ", "afé", "caf", "c!afé", "cafёé", "cafe"}},
+		{"пароль", []string{"Пароль", "паролЬ", "ароль", "парол", "п!ароль", "паролёь"}},
+		{"密码123", []string{"码123", "密码12", "密!码123", "密码12ё3"}},
+		{"Ωmega", []string{"ωmega", "ΩmegA", "mega", "Ωmeg", "Ω!mega", "Ωmegёa"}},
+	} {
+		variants := m.Mutate([]byte(test.in), 10)
+		if len(variants) != len(test.out) {
+			t.Errorf("%s: want %q, got %q", test.in, test.out, variants)
+			continue
+		}
+		for i := range test.out {
+			if string(variants[i]) != test.out[i] {
+				t.Errorf("%s: variant %d: want %q, got %q", test.in, i, test.out[i], variants[i])
+			}
+		}
+	}
+
+	// The built-in rules never produce invalid UTF-8.
+	builtin := NewRDasMutator()
+	for _, password := range []string{"café", "Müller", "пароль", "密码123", "パスワード"} {
+		for _, variant := range builtin.Mutate([]byte(password), 1000) {
+			if !utf8.Valid(variant) {
+				t.Errorf("%s: invalid variant %q", password, variant)
+			}
+		}
+	}
+
+	// Byte-compatible mode mangles bytes, and both modes agree on ASCII
+	// passwords and on passwords that are not valid UTF-8.
+	m.SetByteCompatible(true)
+	variants := m.Mutate([]byte("пароль"), 10)
+	if len(variants) == 0 || string(variants[0]) != "\xf0\xbfароль" {
+		t.Errorf("unexpected byte-compatible variants %q", variants)
+	}
+	byteMutator := NewRDasMutator()
+	byteMutator.SetByteCompatible(true)
+	for _, password := range []string{"hello", "asdf1234asdf", "", "caf\xe9"} {
+		want := byteMutator.Mutate([]byte(password), 1000)
+		got := builtin.Mutate([]byte(password), 1000)
+		if len(got) != len(want) {
+			t.Errorf("%q: want %d variants, got %d", password, len(want), len(got))
+			continue
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("%q: variant %d: want %q, got %q", password, i, want[i], got[i])
+			}
+		}
+	}
+}
+
+// TestRdasProvenance tests that variants are reported with the rule that
+// produced them, and that rules are described without their strings
+func TestRdasProvenance(t *testing.T) {
+	m := NewRDasMutator()
+	mutations := m.Mutate([]byte("hello"), 100)
+	variants := m.MutateWithProvenance([]byte("hello"), 100)
+	if len(variants) != len(mutations) {
+		t.Fatalf("want %d variants, got %d", len(mutations), len(variants))
+	}
+	for i, variant := range variants {
+		if !bytes.Equal(variant.Password, mutations[i]) {
+			t.Errorf("variant %d: want %q, got %q", i, mutations[i], variant.Password)
+		}
+		if variant.Rule.Describe() == "" {
+			t.Errorf("variant %d: rule %+v has no description", i, variant.Rule)
+		}
+	}
+	if variants[0].Rule != (RDasRule{RuleType: "c"}) {
+		t.Errorf("unexpected rule %+v for %q", variants[0].Rule, variants[0].Password)
+	}
+
+	for _, test := range []struct {
+		rule RDasRule
+		want string
+	}{
+		{RDasRule{RuleType: "c"}, "capitalization differs"},
+		{RDasRule{RuleType: "d", Position: 2}, "leading characters removed"},
+		{RDasRule{RuleType: "d", Position: -1}, "trailing characters removed"},
+		{RDasRule{RuleType: "i", Position: -1, String1: "123"}, "trailing digits added"},
+		{RDasRule{RuleType: "i", String1: "!!"}, "leading symbols added"},
+		{RDasRule{RuleType: "i", Position: 2, String1: "ab"}, "letters inserted"},
+		{RDasRule{RuleType: "i", Position: -1, String1: "a1"}, "trailing characters added"},
+		{RDasRule{RuleType: "s", String1: "a", String2: "@"}, "characters substituted"},
+	} {
+		if got := test.rule.Describe(); got != test.want {
+			t.Errorf("%+v: want %q, got %q", test.rule, test.want, got)
+		}
+	}
+}
+
+// murmur3Mutate is the reference implementation of Mutate that deduplicates
+// variants by their 32-bit murmur3 hash
+func murmur3Mutate(m *RDasMutator, password []byte, num int) [][]byte {
+	byRune := !m.byteCompatible && utf8.Valid(password)
+	mutations := make([][]byte, 0, num)
+	seen := make(map[uint32]struct{})
+	seen[murmur3.Sum32(password)] = struct{}{}
+	for i, j := 0, 0; j < num && i < len(m.dasRules); i++ {
+		s := applyRule(m.dasRules[i], password, byRune)
+		key := murmur3.Sum32(s)
+		if _, ok := seen[key]; !ok {
+			j++
+			seen[key] = struct{}{}
+			mutations = append(mutations, s)
+		}
+	}
+	return mutations
+}
+
+// randomPassword returns a random password mixing ASCII, accented and
+// Cyrillic characters, digits and symbols
+func randomPassword(r *rand.Rand) []byte {
+	alphabet := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%éüпароль密码")
+	password := make([]rune, r.Intn(17))
+	for i := range password {
+		password[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return []byte(string(password))
+}
+
+// TestRdasDeduplication tests that no variant is lost to deduplication, and
+// that the variants match those of murmur3 deduplication unless hashes
+// collide
+func TestRdasDeduplication(t *testing.T) {
+	m := NewRDasMutator()
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		password := randomPassword(r)
+
+		// Every distinct output of the rules, other than the password,
+		// is a variant, in the order of the rules.
+		var want [][]byte
+		seen := map[string]bool{string(password): true}
+		hashes := map[uint32]bool{murmur3.Sum32(password): true}
+		collision := false
+		for _, rule := range m.dasRules {
+			s := applyRule(rule, password, true)
+			if !seen[string(s)] {
+				seen[string(s)] = true
+				want = append(want, s)
+				collision = collision || hashes[murmur3.Sum32(s)]
+				hashes[murmur3.Sum32(s)] = true
+			}
+		}
+		got := m.Mutate(password, len(m.dasRules))
+		if len(got) != len(want) {
+			t.Fatalf("%q: want %d variants, got %d", password, len(want), len(got))
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Fatalf("%q: variant %d: want %q, got %q", password, i, want[i], got[i])
+			}
+		}
+
+		for _, num := range []int{1, 9, 100} {
+			reference := murmur3Mutate(m, password, num)
+			got := m.Mutate(password, num)
+			if collision {
+				continue
+			}
+			if len(got) != len(reference) {
+				t.Fatalf("%q: want %d variants, got %d", password, len(reference), len(got))
+			}
+			for i := range reference {
+				if !bytes.Equal(got[i], reference[i]) {
+					t.Fatalf("%q: variant %d: want %q, got %q", password, i, reference[i], got[i])
+				}
+			}
+		}
+	}
+
+	// a and b have the same 32-bit murmur3 hash (0x4a039b61). Check that
+	// neither a variant colliding with another variant nor a variant
+	// colliding with the password is dropped.
+	a, b := "p70999", "p133487"
+	if murmur3.Sum32([]byte(a)) != murmur3.Sum32([]byte(b)) {
+		t.Fatalf("%q and %q do not collide", a, b)
+	}
+	colliding, err := NewRDasMutatorFromRules([]RDasRule{
+		{RuleType: "i", Position: -1, String1: a[1:]},
+		{RuleType: "i", Position: -1, String1: b[1:]},
+		{RuleType: "s", String1: a, String2: b},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants := colliding.Mutate([]byte("p"), 10); len(variants) != 2 || string(variants[0]) != a || string(variants[1]) != b {
+		t.Errorf("want variants of colliding hashes, got %q", variants)
+	}
+	if variants := murmur3Mutate(colliding, []byte("p"), 10); len(variants) != 1 {
+		t.Errorf("expected murmur3 deduplication to drop a variant, got %q", variants)
+	}
+	if variants := colliding.Mutate([]byte(a), 10); len(variants) != 3 || string(variants[2]) != b {
+		t.Errorf("want a variant colliding with the password, got %q", variants)
+	}
+}
+
+// BenchmarkRdasMutator1000 benchmarks the first 1000 mutator rules, where
+// deduplication is a larger share of the work
+func BenchmarkRdasMutator1000(b *testing.B) {
+	m := NewRDasMutator()
+	testPassword := []byte("password1")
+	for i := 0; i < b.N; i++ {
+		_ = m.Mutate(testPassword, 1000)
+	}
+}
+
+// BenchmarkRdasMutatorMurmur3 benchmarks the first 1000 mutator rules with
+// murmur3 deduplication, for comparison
+func BenchmarkRdasMutatorMurmur3(b *testing.B) {
+	m := NewRDasMutator()
+	testPassword := []byte("password1")
+	for i := 0; i < b.N; i++ {
+		_ = murmur3Mutate(m, testPassword, 1000)
+	}
+}
+
 // BenchmarkRdasMutator100 benchmarks the first 100 mutator rules
 func BenchmarkRdasMutator100(b *testing.B) {
 	m := NewRDasMutator()